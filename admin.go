@@ -0,0 +1,346 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"rq/config"
+	"rq/logging"
+	"rq/records"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// adminPath is the prefix of the admin dashboard and its JSON endpoints
+	adminPath = "/admin"
+	// defaultAdminListen is the address the admin dashboard is served on if none is configured
+	defaultAdminListen = "127.0.0.1:8081"
+	// defaultAdminListLimit and maxAdminListLimit bound the number of records listed at once
+	defaultAdminListLimit = 50
+	maxAdminListLimit     = 500
+)
+
+//go:embed admin
+var adminAssets embed.FS
+
+// AdminServer serves the admin dashboard, and the JSON endpoints it uses to show the queue and retry, cancel or
+// inspect records:
+//
+//	GET  /admin/api/summary                 queue depth and the records held for each destination
+//	GET  /admin/api/records?status=&limit=  recent records, newest first
+//	GET  /admin/api/records/{id}            a single record, with its payload and redacted headers
+//	POST /admin/api/records/{id}/retry      clears the error of a failed record, so it is sent on the next delivery
+//	POST /admin/api/records/{id}/cancel     removes a record and its files
+type AdminServer struct {
+	Records *RecordServer
+}
+
+// adminRecord is a record as shown in the dashboard, with its status
+type adminRecord struct {
+	records.RqRecord
+	Status string `json:"status"`
+}
+
+// adminDestination counts the records held for a destination host
+type adminDestination struct {
+	Host        string  `json:"host"`
+	Queued      int64   `json:"queued"`
+	Failed      int64   `json:"failed"`
+	FailureRate float64 `json:"failure_rate"`
+}
+
+// adminSummary describes the queue. DeliveryEnabled is false if queued records are not being sent, so the dashboard
+// can warn that retried records will stay queued.
+type adminSummary struct {
+	QueueDepth      map[string]int64   `json:"queue_depth"`
+	FileStoreBytes  int64              `json:"file_store_bytes"`
+	DeliveryEnabled bool               `json:"delivery_enabled"`
+	Destinations    []adminDestination `json:"destinations"`
+}
+
+func (as *AdminServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, adminPath)
+	// Requests to other hosts are refused, so a site whose domain resolves to the dashboard's address can't read it
+	if !allowedAdminHost(req) {
+		ReturnHTTPErrorResponse(w, "unknown host", http.StatusMisdirectedRequest)
+		return
+	}
+
+	api, isApi := strings.CutPrefix(path, "/api/")
+	if !isApi {
+		as.HandleAssets(w, req)
+		return
+	}
+
+	// Actions are refused from other sites, so a page open in the operator's browser cannot make them
+	if req.Method == http.MethodPost && !sameOrigin(req) {
+		ReturnHTTPErrorResponse(w, "cross-origin request refused", http.StatusForbidden)
+		return
+	}
+
+	id, action, _ := strings.Cut(strings.TrimPrefix(api, "records/"), "/")
+	switch {
+	case api == "summary" && req.Method == http.MethodGet:
+		as.HandleSummary(w, req)
+	case api == "records" && req.Method == http.MethodGet:
+		as.HandleList(w, req)
+	case strings.HasPrefix(api, "records/") && action == "" && req.Method == http.MethodGet:
+		as.HandleInspect(w, req, id)
+	case strings.HasPrefix(api, "records/") && action == "retry" && req.Method == http.MethodPost:
+		as.HandleRetry(w, req, id)
+	case strings.HasPrefix(api, "records/") && action == "cancel" && req.Method == http.MethodPost:
+		as.HandleCancel(w, req, id)
+	default:
+		ReturnHTTPErrorResponse(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	}
+}
+
+// HandleAssets serves the dashboard's page from the files embedded in the binary
+func (as *AdminServer) HandleAssets(w http.ResponseWriter, req *http.Request) {
+	assets, _ := fs.Sub(adminAssets, "admin")
+	http.StripPrefix(adminPath, http.FileServer(http.FS(assets))).ServeHTTP(w, req)
+}
+
+// HandleSummary returns the number of records queued and failed, overall and for each destination host, with the
+// hosts with the highest share of failed records first
+func (as *AdminServer) HandleSummary(w http.ResponseWriter, req *http.Request) {
+	depth, err := as.Records.Store.StatusCounts()
+	if err != nil {
+		as.serverError(w, req, err)
+		return
+	}
+	hostCounts, err := as.Records.Store.HostStatusCounts()
+	if err != nil {
+		as.serverError(w, req, err)
+		return
+	}
+	usage, err := as.Records.FileStore.Usage()
+	if err != nil {
+		as.serverError(w, req, err)
+		return
+	}
+
+	destinations := []adminDestination{}
+	for host, counts := range hostCounts {
+		destination := adminDestination{Host: host, Queued: counts[records.StatusQueued], Failed: counts[records.StatusFailed]}
+		if total := destination.Queued + destination.Failed; total > 0 {
+			destination.FailureRate = float64(destination.Failed) / float64(total)
+		}
+		destinations = append(destinations, destination)
+	}
+	sort.Slice(destinations, func(i, j int) bool {
+		if destinations[i].FailureRate != destinations[j].FailureRate {
+			return destinations[i].FailureRate > destinations[j].FailureRate
+		}
+		return destinations[i].Host < destinations[j].Host
+	})
+
+	writeAdminResponse(w, adminSummary{
+		QueueDepth:      depth,
+		FileStoreBytes:  usage,
+		DeliveryEnabled: config.Config.Delivery.Enabled,
+		Destinations:    destinations,
+	})
+}
+
+// HandleList returns the most recent records, optionally only those queued or failed
+func (as *AdminServer) HandleList(w http.ResponseWriter, req *http.Request) {
+	status, limit, err := parseListQuery(req.URL.Query())
+	if err != nil {
+		ReturnHTTPErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	list, err := as.Records.Store.List(status, limit)
+	if err != nil {
+		as.serverError(w, req, err)
+		return
+	}
+	out := []adminRecord{}
+	for _, record := range list {
+		out = append(out, adminRecord{RqRecord: record, Status: record.Status()})
+	}
+	writeAdminResponse(w, out)
+}
+
+// HandleInspect returns a record in full, with its payload and headers. Sensitive headers, such as Authorization and
+// cookies, are redacted as they are in the logs.
+func (as *AdminServer) HandleInspect(w http.ResponseWriter, req *http.Request, id string) {
+	record, err := as.Records.Store.Get(id)
+	if err != nil {
+		as.storeError(w, req, err)
+		return
+	}
+	if len(record.Headers) > 0 {
+		headers := http.Header{}
+		if err := json.Unmarshal(record.Headers, &headers); err != nil {
+			as.serverError(w, req, fmt.Errorf("invalid headers for record %v: %w", id, err))
+			return
+		}
+		record.Headers, _ = json.Marshal(logging.Redact(headers))
+	}
+	writeAdminResponse(w, adminRecord{RqRecord: *record, Status: record.Status()})
+}
+
+// HandleRetry clears the error of a failed record, returning it to the queue to be sent on the next delivery pass. If
+// delivery is disabled, the record stays queued until it is enabled.
+func (as *AdminServer) HandleRetry(w http.ResponseWriter, req *http.Request, id string) {
+	record, err := as.Records.Store.Get(id)
+	if err != nil {
+		as.storeError(w, req, err)
+		return
+	}
+	if record.Status() != records.StatusFailed {
+		ReturnHTTPErrorResponse(w, "only failed records can be retried", http.StatusConflict)
+		return
+	}
+
+	if err := as.Records.Store.Requeue(id); err != nil {
+		as.storeError(w, req, err)
+		return
+	}
+	slog.InfoContext(req.Context(), "record requeued from the admin dashboard", "rqid", id)
+	record.Error = ""
+	writeAdminResponse(w, adminRecord{RqRecord: *record, Status: record.Status()})
+}
+
+// HandleCancel removes a record, so it is never sent, and then the files uploaded with it
+func (as *AdminServer) HandleCancel(w http.ResponseWriter, req *http.Request, id string) {
+	record, err := as.Records.Store.Get(id)
+	if err != nil {
+		as.storeError(w, req, err)
+		return
+	}
+
+	if err := as.Records.Store.Delete(id); err != nil {
+		as.storeError(w, req, err)
+		return
+	}
+	storedFiles, _ := record.GetFiles()
+	for _, storedFile := range storedFiles {
+		if err := as.Records.FileStore.Delete(storedFile.Filename); err != nil {
+			slog.ErrorContext(req.Context(), "error removing file of cancelled record", "rqid", id, "file", storedFile.Filename, "error", err)
+		}
+	}
+	slog.InfoContext(req.Context(), "record cancelled from the admin dashboard", "rqid", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// storeError responds with a 404 if the record was not found, and a 500 for any other error
+func (as *AdminServer) storeError(w http.ResponseWriter, req *http.Request, err error) {
+	if errors.Is(err, records.ErrNotFound) {
+		ReturnHTTPErrorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	as.serverError(w, req, err)
+}
+
+func (as *AdminServer) serverError(w http.ResponseWriter, req *http.Request, err error) {
+	slog.ErrorContext(req.Context(), "admin request failed", "path", req.URL.Path, "error", err)
+	ReturnHTTPErrorResponse(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// parseListQuery returns the status and limit of a request to list records, defaulting to records of any status and
+// defaultAdminListLimit of them
+func parseListQuery(query url.Values) (string, int, error) {
+	status := query.Get("status")
+	if status != "" && status != records.StatusQueued && status != records.StatusFailed {
+		return "", 0, fmt.Errorf("status must be %v or %v", records.StatusQueued, records.StatusFailed)
+	}
+
+	limit := defaultAdminListLimit
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxAdminListLimit {
+			return "", 0, fmt.Errorf("limit must be between 1 and %v", maxAdminListLimit)
+		}
+		limit = parsed
+	}
+	return status, limit, nil
+}
+
+// sameOrigin reports whether req was made from a page served by RQ, or by a client which does not send an Origin
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	return err == nil && parsed.Host == req.Host
+}
+
+// allowedAdminHost reports whether req was addressed to the dashboard by IP address, as localhost, or by the host it is
+// configured to listen on. Pages on other sites can only reach the dashboard by name, by pointing their own domain at
+// its address, so their requests are refused.
+func allowedAdminHost(req *http.Request) bool {
+	host := adminHostname(req.Host)
+	if host == "localhost" || net.ParseIP(host) != nil {
+		return true
+	}
+	listen := config.Config.Admin.Listen
+	if listen == "" {
+		listen = defaultAdminListen
+	}
+	return host != "" && host == adminHostname(listen)
+}
+
+// adminHostname returns the lower case hostname of a host and optional port
+func adminHostname(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+func writeAdminResponse(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(v)
+}
+
+// checkAdminConfig returns an error if the admin dashboard is enabled on an address other than loopback without being
+// marked insecure, as it has no authentication and anyone who can reach it can read and cancel records
+func checkAdminConfig(adminConfig config.RqAdminConfig) error {
+	if !adminConfig.Enabled {
+		return nil
+	}
+	listen := adminConfig.Listen
+	if listen == "" {
+		listen = defaultAdminListen
+	}
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return fmt.Errorf("invalid admin listen address %v: %w", listen, err)
+	}
+	if adminConfig.Insecure {
+		return nil
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("admin listen address %v is not loopback, and the dashboard has no authentication; set admin.insecure to serve it anyway", listen)
+	}
+	return nil
+}
+
+// listenAndServeAdmin serves the admin dashboard on its own address, so it is not exposed wherever the API is
+func listenAndServeAdmin(adminServer *AdminServer) error {
+	listen := config.Config.Admin.Listen
+	if listen == "" {
+		listen = defaultAdminListen
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(adminPath+"/", adminServer)
+	mux.Handle("/", http.RedirectHandler(adminPath+"/", http.StatusFound))
+
+	slog.Info("admin dashboard listening", "address", listen)
+	return http.ListenAndServe(listen, mux)
+}
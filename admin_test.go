@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"rq/config"
+	"rq/files"
+	"rq/records"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAdminServer returns an AdminServer holding a queued record for api.example.com, a failed record for
+// hooks.example.com with a file, and a failed record for api.example.com
+func newTestAdminServer(t *testing.T) (*AdminServer, *MockMemoryRecordStore, files.FileStore) {
+	store := &MockMemoryRecordStore{db: make(map[string]records.RqRecord)}
+	fileStore, _ := files.NewInMemoryFileStore()
+	fileStore.Save("failed-photo.jpg", strings.NewReader("jpeg"))
+
+	now := time.Now()
+	withFile := records.RqRecord{Id: "failed", Host: "hooks.example.com", Error: "connection refused", CreatedAt: now.Add(-time.Minute)}
+	withFile.SetFiles(map[string]records.RqFile{"photo": {Filename: "failed-photo.jpg", Size: 4}})
+	headers, _ := json.Marshal(http.Header{"Authorization": {"Bearer secret"}, "Accept": {"application/json"}})
+	store.Add(records.RqRecord{Id: "queued", Host: "api.example.com", Headers: headers, Payload: json.RawMessage(`{"a":1}`), CreatedAt: now})
+	store.Add(withFile)
+	store.Add(records.RqRecord{Id: "rejected", Host: "api.example.com", Error: "400 Bad Request", CreatedAt: now.Add(-time.Hour)})
+
+	return &AdminServer{Records: &RecordServer{Store: store, FileStore: fileStore}}, store, fileStore
+}
+
+// newAdminRequest returns a request addressed to the dashboard's default listen address
+func newAdminRequest(method string, target string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	req.Host = defaultAdminListen
+	return req
+}
+
+func TestAdminServer_HandleSummary(t *testing.T) {
+	defer func(delivery config.RqDeliveryConfig) { config.Config.Delivery = delivery }(config.Config.Delivery)
+	config.Config.Delivery.Enabled = true
+
+	as, _, _ := newTestAdminServer(t)
+	response := httptest.NewRecorder()
+	as.ServeHTTP(response, newAdminRequest(http.MethodGet, "/admin/api/summary"))
+
+	var summary adminSummary
+	if err := json.Unmarshal(response.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("body %q is not JSON: %v", response.Body.String(), err)
+	}
+	if summary.QueueDepth[records.StatusQueued] != 1 || summary.QueueDepth[records.StatusFailed] != 2 {
+		t.Errorf("queue depth = %v, want 1 queued and 2 failed", summary.QueueDepth)
+	}
+	if summary.FileStoreBytes != 4 {
+		t.Errorf("file store bytes = %v, want 4", summary.FileStoreBytes)
+	}
+	if !summary.DeliveryEnabled {
+		t.Error("delivery enabled = false, want true")
+	}
+	want := []adminDestination{
+		{Host: "hooks.example.com", Failed: 1, FailureRate: 1},
+		{Host: "api.example.com", Queued: 1, Failed: 1, FailureRate: 0.5},
+	}
+	if len(summary.Destinations) != len(want) {
+		t.Fatalf("destinations = %+v, want %+v", summary.Destinations, want)
+	}
+	for i := range want {
+		if summary.Destinations[i] != want[i] {
+			t.Errorf("destination %v = %+v, want %+v", i, summary.Destinations[i], want[i])
+		}
+	}
+}
+
+func TestAdminServer_HandleList(t *testing.T) {
+	as, _, _ := newTestAdminServer(t)
+
+	tests := []struct {
+		name       string
+		target     string
+		wantStatus int
+		wantIds    []string
+	}{
+		{name: "all, newest first", target: "/admin/api/records", wantStatus: http.StatusOK, wantIds: []string{"queued", "failed", "rejected"}},
+		{name: "failed", target: "/admin/api/records?status=failed", wantStatus: http.StatusOK, wantIds: []string{"failed", "rejected"}},
+		{name: "limited", target: "/admin/api/records?limit=1", wantStatus: http.StatusOK, wantIds: []string{"queued"}},
+		{name: "unknown status", target: "/admin/api/records?status=sent", wantStatus: http.StatusBadRequest},
+		{name: "limit too large", target: "/admin/api/records?limit=100000", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := httptest.NewRecorder()
+			as.ServeHTTP(response, newAdminRequest(http.MethodGet, test.target))
+			if response.Code != test.wantStatus {
+				t.Fatalf("status = %v, want %v: %v", response.Code, test.wantStatus, response.Body.String())
+			}
+			if test.wantStatus != http.StatusOK {
+				return
+			}
+
+			var list []adminRecord
+			json.Unmarshal(response.Body.Bytes(), &list)
+			ids := []string{}
+			for _, record := range list {
+				ids = append(ids, record.Id)
+			}
+			if strings.Join(ids, ",") != strings.Join(test.wantIds, ",") {
+				t.Errorf("records = %v, want %v", ids, test.wantIds)
+			}
+		})
+	}
+}
+
+func TestAdminServer_Actions(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		target       string
+		host         string
+		origin       string
+		wantStatus   int
+		validate     func(t *testing.T, store *MockMemoryRecordStore, fileStore files.FileStore)
+		validateBody func(t *testing.T, body string)
+	}{
+		{
+			name:       "inspect",
+			method:     http.MethodGet,
+			target:     "/admin/api/records/queued",
+			wantStatus: http.StatusOK,
+			validateBody: func(t *testing.T, body string) {
+				var record adminRecord
+				json.Unmarshal([]byte(body), &record)
+				headers := http.Header{}
+				json.Unmarshal(record.Headers, &headers)
+				if got := headers.Get("Authorization"); got == "" || strings.Contains(got, "secret") {
+					t.Errorf("inspected Authorization = %q, want it redacted", got)
+				}
+				if got := headers.Get("Accept"); got != "application/json" {
+					t.Errorf("inspected Accept = %q, want application/json", got)
+				}
+			},
+		},
+		{
+			name:       "inspect by another host name",
+			method:     http.MethodGet,
+			target:     "/admin/api/records/queued",
+			host:       "rebound.attacker.example:8081",
+			wantStatus: http.StatusMisdirectedRequest,
+		},
+		{
+			name:       "inspect by localhost",
+			method:     http.MethodGet,
+			target:     "/admin/api/records/queued",
+			host:       "localhost:8081",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "inspect unknown record",
+			method:     http.MethodGet,
+			target:     "/admin/api/records/missing",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "retry failed record",
+			method:     http.MethodPost,
+			target:     "/admin/api/records/failed/retry",
+			wantStatus: http.StatusOK,
+			validate: func(t *testing.T, store *MockMemoryRecordStore, fileStore files.FileStore) {
+				if record := store.db["failed"]; record.Status() != records.StatusQueued {
+					t.Errorf("retried record status = %v, want %v", record.Status(), records.StatusQueued)
+				}
+			},
+		},
+		{
+			name:       "retry queued record",
+			method:     http.MethodPost,
+			target:     "/admin/api/records/queued/retry",
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "cancel",
+			method:     http.MethodPost,
+			target:     "/admin/api/records/failed/cancel",
+			origin:     "http://127.0.0.1:8081",
+			wantStatus: http.StatusNoContent,
+			validate: func(t *testing.T, store *MockMemoryRecordStore, fileStore files.FileStore) {
+				if _, exists := store.db["failed"]; exists {
+					t.Error("cancelled record was not removed")
+				}
+				if _, err := fileStore.Stat("failed-photo.jpg"); err == nil {
+					t.Error("file of cancelled record was not removed")
+				}
+			},
+		},
+		{
+			name:       "cancel from another site",
+			method:     http.MethodPost,
+			target:     "/admin/api/records/failed/cancel",
+			origin:     "https://attacker.example",
+			wantStatus: http.StatusForbidden,
+			validate: func(t *testing.T, store *MockMemoryRecordStore, fileStore files.FileStore) {
+				if _, exists := store.db["failed"]; !exists {
+					t.Error("record was removed by a cross-origin request")
+				}
+			},
+		},
+		{
+			name:       "cancel with GET",
+			method:     http.MethodGet,
+			target:     "/admin/api/records/failed/cancel",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			as, store, fileStore := newTestAdminServer(t)
+			req := newAdminRequest(test.method, test.target)
+			if test.host != "" {
+				req.Host = test.host
+			}
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+			response := httptest.NewRecorder()
+			as.ServeHTTP(response, req)
+
+			if response.Code != test.wantStatus {
+				t.Fatalf("status = %v, want %v: %v", response.Code, test.wantStatus, response.Body.String())
+			}
+			if test.validate != nil {
+				test.validate(t, store, fileStore)
+			}
+			if test.validateBody != nil {
+				test.validateBody(t, response.Body.String())
+			}
+		})
+	}
+}
+
+func TestAdminServer_HandleAssets(t *testing.T) {
+	as, _, _ := newTestAdminServer(t)
+	response := httptest.NewRecorder()
+	as.ServeHTTP(response, newAdminRequest(http.MethodGet, "/admin/"))
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("status = %v, want %v", response.Code, http.StatusOK)
+	}
+	if !strings.Contains(response.Body.String(), "<title>RQ Admin</title>") {
+		t.Error("dashboard page not served")
+	}
+}
+
+func TestCheckAdminConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		adminConfig config.RqAdminConfig
+		wantErr     bool
+	}{
+		{name: "disabled on all interfaces", adminConfig: config.RqAdminConfig{Listen: ":8081"}},
+		{name: "default listen", adminConfig: config.RqAdminConfig{Enabled: true}},
+		{name: "ipv4 loopback", adminConfig: config.RqAdminConfig{Enabled: true, Listen: "127.0.0.2:9000"}},
+		{name: "ipv6 loopback", adminConfig: config.RqAdminConfig{Enabled: true, Listen: "[::1]:8081"}},
+		{name: "localhost", adminConfig: config.RqAdminConfig{Enabled: true, Listen: "localhost:8081"}},
+		{name: "all interfaces", adminConfig: config.RqAdminConfig{Enabled: true, Listen: ":8081"}, wantErr: true},
+		{name: "unspecified address", adminConfig: config.RqAdminConfig{Enabled: true, Listen: "0.0.0.0:8081"}, wantErr: true},
+		{name: "private address", adminConfig: config.RqAdminConfig{Enabled: true, Listen: "192.168.1.10:8081"}, wantErr: true},
+		{name: "hostname", adminConfig: config.RqAdminConfig{Enabled: true, Listen: "rq.internal:8081"}, wantErr: true},
+		{name: "all interfaces marked insecure", adminConfig: config.RqAdminConfig{Enabled: true, Listen: ":8081", Insecure: true}},
+		{name: "no port", adminConfig: config.RqAdminConfig{Enabled: true, Listen: "127.0.0.1", Insecure: true}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := checkAdminConfig(test.adminConfig); (err != nil) != test.wantErr {
+				t.Errorf("checkAdminConfig(%+v) error = %v, wantErr %v", test.adminConfig, err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"rq/config"
+	"rq/logging"
+	"strings"
+)
+
+// defaultApiKeyHeader is the header clients send API keys in, if none is configured
+const defaultApiKeyHeader = "X-Api-Key"
+
+// authKey is a configured client key, hashed so keys are compared in constant time regardless of their length
+type authKey struct {
+	name   string
+	tenant string
+	bearer bool
+	hash   [32]byte
+}
+
+// RqAuthMiddleware rejects requests which do not present a configured API key or bearer token, with a 401 if none
+// is presented and a 403 if it is not recognised. The name of the client's key and its tenant are added to the
+// request's context, to be recorded on the records it enqueues. The header used to authenticate is removed from the
+// request, so it is neither stored nor forwarded.
+func RqAuthMiddleware(next http.Handler) http.Handler {
+	authConfig := config.Config.Auth
+	if !authConfig.Enabled {
+		return next
+	}
+
+	apiKeyHeader := authConfig.ApiKeyHeader
+	if apiKeyHeader == "" {
+		apiKeyHeader = defaultApiKeyHeader
+	}
+
+	keys := []authKey{}
+	for _, key := range authConfig.Keys {
+		keys = append(keys, authKey{
+			name:   key.Name,
+			tenant: key.Tenant,
+			bearer: key.Type == "bearer",
+			hash:   sha256.Sum256([]byte(key.Key)),
+		})
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Resumable upload clients discover the server's capabilities before authenticating
+		if req.Method == http.MethodOptions {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		presented, bearer, header := presentedKey(req, apiKeyHeader)
+		if presented == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="rq"`)
+			ReturnHTTPErrorResponse(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		key, err := authenticate(keys, presented, bearer)
+		if err != nil {
+			slog.WarnContext(req.Context(), "request rejected", "remote_addr", req.RemoteAddr, "error", err)
+			ReturnHTTPErrorResponse(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		req.Header.Del(header)
+		ctx := context.WithValue(req.Context(), "rqclient", key.name)
+		ctx = context.WithValue(ctx, "rqtenant", key.tenant)
+		ctx = logging.WithTenant(ctx, key.tenant)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// presentedKey returns the API key or bearer token sent with the request, and the header it was sent in
+func presentedKey(req *http.Request, apiKeyHeader string) (key string, bearer bool, header string) {
+	if key := req.Header.Get(apiKeyHeader); key != "" {
+		return key, false, apiKeyHeader
+	}
+
+	scheme, token, found := strings.Cut(req.Header.Get("Authorization"), " ")
+	if found && strings.EqualFold(scheme, "bearer") && strings.TrimSpace(token) != "" {
+		return strings.TrimSpace(token), true, "Authorization"
+	}
+	return "", false, ""
+}
+
+// authenticate returns the configured key matching presented. Every key is compared, so the time taken does not
+// reveal which keys exist.
+func authenticate(keys []authKey, presented string, bearer bool) (authKey, error) {
+	presentedHash := sha256.Sum256([]byte(presented))
+
+	var matched authKey
+	for _, key := range keys {
+		if subtle.ConstantTimeCompare(key.hash[:], presentedHash[:]) == 1 && key.bearer == bearer {
+			matched = key
+		}
+	}
+
+	if matched.name == "" {
+		if bearer {
+			return matched, errors.New("invalid bearer token")
+		}
+		return matched, errors.New("invalid API key")
+	}
+	return matched, nil
+}
+
+// getRqClient returns the name of the authenticated client from the Request's Context, if any
+func getRqClient(req *http.Request) string {
+	if client, ok := req.Context().Value("rqclient").(string); ok {
+		return client
+	}
+	return ""
+}
+
+// getRqTenant returns the tenant of the authenticated client from the Request's Context, if any
+func getRqTenant(req *http.Request) string {
+	if tenant, ok := req.Context().Value("rqtenant").(string); ok {
+		return tenant
+	}
+	return ""
+}
+
+// checkAuthConfig returns an error if authentication is enabled without any usable keys, or a key belongs to a
+// tenant which is not configured
+func checkAuthConfig(authConfig config.RqAuthConfig, tenants map[string]config.RqTenantConfig) error {
+	if !authConfig.Enabled {
+		return nil
+	}
+	if len(authConfig.Keys) == 0 {
+		return errors.New("auth is enabled but no keys are configured")
+	}
+	for i, key := range authConfig.Keys {
+		if key.Name == "" || key.Key == "" {
+			return fmt.Errorf("auth key %v needs a name and key", i)
+		}
+		if key.Type != "api_key" && key.Type != "bearer" {
+			return fmt.Errorf("auth key %v has unknown type %v", key.Name, key.Type)
+		}
+		if _, ok := tenants[key.Tenant]; key.Tenant != "" && !ok {
+			return fmt.Errorf("auth key %v has unknown tenant %v", key.Name, key.Tenant)
+		}
+	}
+	return nil
+}
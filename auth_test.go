@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"rq/config"
+	"rq/files"
+	"rq/records"
+	"strings"
+	"testing"
+)
+
+func withAuthConfig(t *testing.T, authConfig config.RqAuthConfig) {
+	previous := config.Config.Auth
+	config.Config.Auth = authConfig
+	t.Cleanup(func() { config.Config.Auth = previous })
+}
+
+func TestRqAuthMiddleware(t *testing.T) {
+	withAuthConfig(t, config.RqAuthConfig{
+		Enabled: true,
+		Keys: []config.RqAuthKeyConfig{
+			{Name: "kiosk", Type: "api_key", Key: "kiosk-key", Tenant: "retail"},
+			{Name: "backend", Type: "bearer", Key: "backend-token"},
+		},
+	})
+
+	tests := []struct {
+		name       string
+		method     string
+		headers    map[string]string
+		wantCode   int
+		wantClient string
+		wantTenant string
+		wantError  string
+	}{
+		{name: "api key", headers: map[string]string{"X-Api-Key": "kiosk-key"}, wantCode: 200, wantClient: "kiosk", wantTenant: "retail"},
+		{name: "bearer token", headers: map[string]string{"Authorization": "Bearer backend-token"}, wantCode: 200, wantClient: "backend"},
+		{name: "lowercase bearer scheme", headers: map[string]string{"Authorization": "bearer backend-token"}, wantCode: 200, wantClient: "backend"},
+		{name: "no credentials", wantCode: http.StatusUnauthorized, wantError: "authentication required"},
+		{name: "basic auth is not accepted", headers: map[string]string{"Authorization": "Basic a2lvc2s6a2V5"}, wantCode: http.StatusUnauthorized, wantError: "authentication required"},
+		{name: "unknown api key", headers: map[string]string{"X-Api-Key": "guess"}, wantCode: http.StatusForbidden, wantError: "invalid API key"},
+		{name: "unknown bearer token", headers: map[string]string{"Authorization": "Bearer guess"}, wantCode: http.StatusForbidden, wantError: "invalid bearer token"},
+		{name: "api key sent as bearer token", headers: map[string]string{"Authorization": "Bearer kiosk-key"}, wantCode: http.StatusForbidden, wantError: "invalid bearer token"},
+		{name: "options is not authenticated", method: http.MethodOptions, wantCode: 200},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var gotClient, gotTenant string
+			var gotHeaders http.Header
+			next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				gotClient = getRqClient(req)
+				gotTenant = getRqTenant(req)
+				gotHeaders = req.Header
+			})
+
+			method := test.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			req := httptest.NewRequest(method, "/?url=https://www.imagination.com", nil)
+			for key, value := range test.headers {
+				req.Header.Set(key, value)
+			}
+
+			response := httptest.NewRecorder()
+			RqAuthMiddleware(next).ServeHTTP(response, req)
+
+			assert.Equal(t, test.wantCode, response.Code)
+			if test.wantError != "" {
+				errorResponse := ErrorResponse{}
+				json.Unmarshal(response.Body.Bytes(), &errorResponse)
+				assert.Equal(t, test.wantError, errorResponse.Error)
+				return
+			}
+			assert.Equal(t, test.wantClient, gotClient)
+			assert.Equal(t, test.wantTenant, gotTenant)
+			assert.Empty(t, gotHeaders.Get("X-Api-Key"))
+			assert.Empty(t, gotHeaders.Get("Authorization"))
+		})
+	}
+}
+
+func TestRqAuthMiddlewareDisabled(t *testing.T) {
+	withAuthConfig(t, config.RqAuthConfig{})
+
+	called := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { called = true })
+	RqAuthMiddleware(next).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.True(t, called)
+}
+
+func TestRqAuthMiddlewareRecordsClient(t *testing.T) {
+	withAuthConfig(t, config.RqAuthConfig{
+		Enabled:      true,
+		ApiKeyHeader: "X-Rq-Key",
+		Keys:         []config.RqAuthKeyConfig{{Name: "kiosk", Type: "api_key", Key: "kiosk-key"}},
+	})
+
+	store := &MockMemoryRecordStore{db: make(map[string]records.RqRecord)}
+	mfs, _ := files.NewInMemoryFileStore()
+	server := &RecordServer{Store: store, FileStore: mfs}
+
+	req := httptest.NewRequest(http.MethodPost, "/?url=https://www.imagination.com", strings.NewReader(`{"foo":"bar"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Rq-Key", "kiosk-key")
+	req.Header.Set("X-Forwarded", "yes")
+
+	response := httptest.NewRecorder()
+	RqHttpMiddleware(RqAuthMiddleware(server)).ServeHTTP(response, req)
+	assert.Equal(t, 200, response.Code)
+
+	record := store.db[response.Header().Get("RqId")]
+	assert.Equal(t, "kiosk", record.Client)
+	assert.NotContains(t, string(record.Headers), "kiosk-key")
+	assert.Contains(t, string(record.Headers), "X-Forwarded")
+}
+
+func TestCheckAuthConfig(t *testing.T) {
+	tenants := map[string]config.RqTenantConfig{"media": {MaxQueuedRecords: 10}}
+
+	tests := []struct {
+		name       string
+		authConfig config.RqAuthConfig
+		wantErr    bool
+	}{
+		{name: "disabled", authConfig: config.RqAuthConfig{}},
+		{name: "valid", authConfig: config.RqAuthConfig{Enabled: true, Keys: []config.RqAuthKeyConfig{{Name: "a", Type: "bearer", Key: "k"}}}},
+		{name: "no keys", authConfig: config.RqAuthConfig{Enabled: true}, wantErr: true},
+		{name: "empty key", authConfig: config.RqAuthConfig{Enabled: true, Keys: []config.RqAuthKeyConfig{{Name: "a", Type: "bearer"}}}, wantErr: true},
+		{name: "unknown type", authConfig: config.RqAuthConfig{Enabled: true, Keys: []config.RqAuthKeyConfig{{Name: "a", Type: "basic", Key: "k"}}}, wantErr: true},
+		{name: "configured tenant", authConfig: config.RqAuthConfig{Enabled: true, Keys: []config.RqAuthKeyConfig{{Name: "a", Type: "bearer", Key: "k", Tenant: "media"}}}},
+		{name: "unknown tenant", authConfig: config.RqAuthConfig{Enabled: true, Keys: []config.RqAuthKeyConfig{{Name: "a", Type: "bearer", Key: "k", Tenant: "retail"}}}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkAuthConfig(test.authConfig, tenants)
+			assert.Equal(t, test.wantErr, err != nil)
+		})
+	}
+}
@@ -13,8 +13,22 @@ import (
 var Config RqConfig
 
 type RqServerConfig struct {
-	ExcludedHeaders     []string `json:"excluded_headers"`
-	AllowedContentTypes []string `json:"allowed_content_types"`
+	Listen              string      `json:"listen"`
+	ExcludedHeaders     []string    `json:"excluded_headers"`
+	AllowedContentTypes []string    `json:"allowed_content_types"`
+	TLS                 RqTLSConfig `json:"tls"`
+}
+
+// RqTLSConfig enables HTTPS when CertFile and KeyFile are set. Client certificates are verified against ClientCAFile,
+// and their subject, or the name it is mapped to in Identities, identifies the client. Certificates are reloaded
+// when their files change, checked every ReloadIntervalSeconds, or on SIGHUP.
+type RqTLSConfig struct {
+	CertFile              string            `json:"cert_file"`
+	KeyFile               string            `json:"key_file"`
+	ClientCAFile          string            `json:"client_ca_file"`
+	ClientAuth            string            `json:"client_auth"`
+	Identities            map[string]string `json:"identities"`
+	ReloadIntervalSeconds int               `json:"reload_interval_seconds"`
 }
 
 type RqDatabaseConfig struct {
@@ -22,11 +36,220 @@ type RqDatabaseConfig struct {
 	Filepath string `json:"filepath"`
 }
 
+// RqLimitsConfig sets the point at which RQ stops accepting new requests. A zero value disables that limit.
+type RqLimitsConfig struct {
+	MaxQueuedRecords  int64  `json:"max_queued_records"`
+	MaxStoredBytes    int64  `json:"max_stored_bytes"`
+	MinFreeDiskBytes  uint64 `json:"min_free_disk_bytes"`
+	RetryAfterSeconds int    `json:"retry_after_seconds"`
+}
+
+// RqS3Config holds the connection details for an S3-compatible bucket used to store uploaded files.
+type RqS3Config struct {
+	Endpoint        string `json:"endpoint"`
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	Prefix          string `json:"prefix"`
+	AccessKeyId     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+}
+
+// RqUploadsConfig limits the size of requests and the files within them. A zero value disables that limit.
+// Resumable uploads not attached to a request within ExpirySeconds of being created are removed.
+type RqUploadsConfig struct {
+	MaxMemoryBytes  int64 `json:"max_memory_bytes"`
+	MaxFileBytes    int64 `json:"max_file_bytes"`
+	MaxFiles        int   `json:"max_files"`
+	MaxRequestBytes int64 `json:"max_request_bytes"`
+	ExpirySeconds   int   `json:"expiry_seconds"`
+}
+
+// RqAuthKeyConfig is a key a client uses to authenticate with RQ. Type is "api_key", sent in the API key header, or
+// "bearer", sent as an Authorization bearer token. Name identifies the client on the records it enqueues.
+type RqAuthKeyConfig struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Key    string `json:"key"`
+	Tenant string `json:"tenant"`
+}
+
+// RqTenantConfig holds the quotas for a tenant, whose clients' API keys are mapped to it. Limits of 0 are unlimited.
+type RqTenantConfig struct {
+	MaxQueuedRecords int64 `json:"max_queued_records"`
+	MaxStoredBytes   int64 `json:"max_stored_bytes"`
+}
+
+// RqAuthConfig requires clients to authenticate before enqueuing requests or uploading files.
+type RqAuthConfig struct {
+	Enabled      bool              `json:"enabled"`
+	ApiKeyHeader string            `json:"api_key_header"`
+	Keys         []RqAuthKeyConfig `json:"keys"`
+}
+
+// RqUrlPolicyConfig restricts the URLs requests can be sent to. Hosts are hostnames, wildcards such as
+// "*.example.com", IP addresses or CIDR ranges. Private, loopback and link-local addresses are denied unless
+// AllowPrivateNetworks is set or they are in AllowedHosts.
+type RqUrlPolicyConfig struct {
+	AllowedSchemes       []string `json:"allowed_schemes"`
+	AllowedHosts         []string `json:"allowed_hosts"`
+	DeniedHosts          []string `json:"denied_hosts"`
+	AllowPrivateNetworks bool     `json:"allow_private_networks"`
+	MaxRedirects         int      `json:"max_redirects"`
+}
+
+// RqCompressionConfig enables compression of stored payloads and files. Files smaller than MinBytes are stored
+// uncompressed. Only the "gzip" algorithm is currently supported.
+type RqCompressionConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Algorithm string `json:"algorithm"`
+	MinBytes  int64  `json:"min_bytes"`
+}
+
+// RqEncryptionConfig enables encryption of stored headers, payloads and files. Keys are read from KeyFile if set,
+// otherwise from the KeyEnv environment variable.
+type RqEncryptionConfig struct {
+	Enabled bool   `json:"enabled"`
+	KeyFile string `json:"key_file"`
+	KeyEnv  string `json:"key_env"`
+}
+
+// RqCredentialConfig is a named credential injected into requests when they are sent, so secrets are not stored
+// with each record. Type is "bearer" (Token), "basic" (Username and Password) or "api_key" (Header and Value). The
+// credential is only sent to AllowedHosts, which are hostnames or "*." wildcard domains, and if Tenants is set, only
+// used for requests enqueued by those tenants.
+type RqCredentialConfig struct {
+	Type         string   `json:"type"`
+	Token        string   `json:"token"`
+	Username     string   `json:"username"`
+	Password     string   `json:"password"`
+	Header       string   `json:"header"`
+	Value        string   `json:"value"`
+	AllowedHosts []string `json:"allowed_hosts"`
+	Tenants      []string `json:"tenants"`
+}
+
+// RqTransformConfig configures a transform applied to uploaded files before they are sent to a destination.
+type RqTransformConfig struct {
+	Type      string `json:"type"`
+	MaxWidth  int    `json:"max_width"`
+	MaxHeight int    `json:"max_height"`
+	Quality   int    `json:"quality"`
+	MaxPixels int64  `json:"max_pixels"`
+}
+
+// RqOAuth2Config configures the OAuth2 client credentials grant used to fetch bearer tokens for a destination.
+type RqOAuth2Config struct {
+	TokenUrl     string   `json:"token_url"`
+	ClientId     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+}
+
+// RqSigningConfig configures the HMAC signature added to requests sent to a destination. Format is the canonical
+// string signed, with {method}, {host}, {path}, {query}, {timestamp} and {body_digest} replaced by their values.
+type RqSigningConfig struct {
+	Algorithm       string `json:"algorithm"`
+	Secret          string `json:"secret"`
+	Header          string `json:"header"`
+	TimestampHeader string `json:"timestamp_header"`
+	Format          string `json:"format"`
+	Encoding        string `json:"encoding"`
+}
+
+// RqTransportConfig holds the connection settings used when sending requests. CAFile is a PEM bundle trusted in
+// addition to the system's CAs, and CertFile and KeyFile a client certificate. Proxy is an http, https or socks5 URL.
+type RqTransportConfig struct {
+	CAFile                       string `json:"ca_file"`
+	CertFile                     string `json:"cert_file"`
+	KeyFile                      string `json:"key_file"`
+	MinTLSVersion                string `json:"min_tls_version"`
+	Proxy                        string `json:"proxy"`
+	ConnectTimeoutSeconds        int    `json:"connect_timeout_seconds"`
+	TLSHandshakeTimeoutSeconds   int    `json:"tls_handshake_timeout_seconds"`
+	ResponseHeaderTimeoutSeconds int    `json:"response_header_timeout_seconds"`
+	TimeoutSeconds               int    `json:"timeout_seconds"`
+}
+
+// RqDestinationConfig holds the settings used when sending requests to a destination host.
+type RqDestinationConfig struct {
+	Transforms []RqTransformConfig `json:"transforms"`
+	OAuth2     *RqOAuth2Config     `json:"oauth2"`
+	Signing    *RqSigningConfig    `json:"signing"`
+	Transport  *RqTransportConfig  `json:"transport"`
+}
+
+// RqDeliveryConfig enables sending queued records to their destinations, checking for records every IntervalSeconds
+// and sending up to BatchSize of them, oldest first, each time. A record whose destination can't be reached is tried
+// again after a backoff which doubles with each attempt up to MaxBackoffSeconds, and fails after MaxAttempts, if set.
+type RqDeliveryConfig struct {
+	Enabled           bool `json:"enabled"`
+	IntervalSeconds   int  `json:"interval_seconds"`
+	BatchSize         int  `json:"batch_size"`
+	MaxAttempts       int  `json:"max_attempts"`
+	MaxBackoffSeconds int  `json:"max_backoff_seconds"`
+}
+
+// RqLoggingConfig configures the logs. Level is debug, info, warn or error, and Format json or text. The values of
+// RedactHeaders are replaced when headers are logged, along with Authorization, Cookie and other credential headers.
+type RqLoggingConfig struct {
+	Level         string   `json:"level"`
+	Format        string   `json:"format"`
+	RedactHeaders []string `json:"redact_headers"`
+}
+
+// RqTracingConfig configures OpenTelemetry tracing. Exporter is otlp, which sends spans over HTTP to Endpoint, or
+// stdout or file, which write them as JSON to stdout or File. SampleRatio is the fraction of new traces recorded,
+// defaulting to all of them.
+type RqTracingConfig struct {
+	Enabled     bool              `json:"enabled"`
+	Exporter    string            `json:"exporter"`
+	Endpoint    string            `json:"endpoint"`
+	Headers     map[string]string `json:"headers"`
+	File        string            `json:"file"`
+	ServiceName string            `json:"service_name"`
+	SampleRatio float64           `json:"sample_ratio"`
+}
+
+// RqHealthConfig sets the queue backlog at which RQ reports it is not ready. MaxQueuedRecords defaults to the
+// max_queued_records limit, and a zero MaxFailedRecords does not check failed records.
+type RqHealthConfig struct {
+	MaxQueuedRecords int64 `json:"max_queued_records"`
+	MaxFailedRecords int64 `json:"max_failed_records"`
+}
+
+// RqAdminConfig enables the admin dashboard, served on its own Listen address without authentication, so it should
+// only be reachable by operators. Listen must be a loopback address unless Insecure is set, for when access to it is
+// restricted some other way.
+type RqAdminConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Listen   string `json:"listen"`
+	Insecure bool   `json:"insecure"`
+}
+
 type RqConfig struct {
-	PermittedFileExtensions string           `json:"permitted_file_extensions"`
-	UploadDirectory         string           `json:"upload_directory"`
-	Database                RqDatabaseConfig `json:"database"`
-	Server                  RqServerConfig   `json:"server"`
+	PermittedFileExtensions string                         `json:"permitted_file_extensions"`
+	PermittedMimeTypes      []string                       `json:"permitted_mime_types"`
+	UploadDirectory         string                         `json:"upload_directory"`
+	FileStore               string                         `json:"file_store"`
+	DeduplicateFiles        bool                           `json:"deduplicate_files"`
+	S3                      RqS3Config                     `json:"s3"`
+	Database                RqDatabaseConfig               `json:"database"`
+	Server                  RqServerConfig                 `json:"server"`
+	Limits                  RqLimitsConfig                 `json:"limits"`
+	Uploads                 RqUploadsConfig                `json:"uploads"`
+	Auth                    RqAuthConfig                   `json:"auth"`
+	Tenants                 map[string]RqTenantConfig      `json:"tenants"`
+	UrlPolicy               RqUrlPolicyConfig              `json:"url_policy"`
+	Compression             RqCompressionConfig            `json:"compression"`
+	Encryption              RqEncryptionConfig             `json:"encryption"`
+	Credentials             map[string]RqCredentialConfig  `json:"credentials"`
+	Transport               RqTransportConfig              `json:"transport"`
+	Destinations            map[string]RqDestinationConfig `json:"destinations"`
+	Delivery                RqDeliveryConfig               `json:"delivery"`
+	Logging                 RqLoggingConfig                `json:"logging"`
+	Tracing                 RqTracingConfig                `json:"tracing"`
+	Health                  RqHealthConfig                 `json:"health"`
+	Admin                   RqAdminConfig                  `json:"admin"`
 }
 
 func LoadConfigFile(profile string) error {
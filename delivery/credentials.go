@@ -0,0 +1,123 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"rq/config"
+	"rq/helpers"
+	"strings"
+)
+
+// ErrUnknownCredential is returned when a record refers to a credential profile which is not configured
+var ErrUnknownCredential = errors.New("unknown credential")
+
+// ErrCredentialNotAllowed is returned when a credential profile would be sent to a host, or used by a tenant, it is
+// not configured for
+var ErrCredentialNotAllowed = errors.New("credential not allowed")
+
+// credentialKey is the context key of the credential profile a request is sent with
+type credentialKey struct{}
+
+// credentialUse is the credential profile a request is sent with, and the tenant it is sent for
+type credentialUse struct {
+	name   string
+	tenant string
+}
+
+// CheckCredential returns an error if name is not a valid credential profile in config.
+func CheckCredential(name string) error {
+	credential, ok := config.Config.Credentials[name]
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrUnknownCredential, name)
+	}
+
+	switch credential.Type {
+	case "bearer":
+		if credential.Token == "" {
+			return fmt.Errorf("credential %v has no token", name)
+		}
+	case "basic":
+		if credential.Username == "" {
+			return fmt.Errorf("credential %v has no username", name)
+		}
+	case "api_key":
+		if credential.Header == "" || credential.Value == "" {
+			return fmt.Errorf("credential %v needs a header and value", name)
+		}
+	default:
+		return fmt.Errorf("credential %v has unknown type %v", name, credential.Type)
+	}
+
+	if len(credential.AllowedHosts) == 0 {
+		return fmt.Errorf("credential %v has no allowed_hosts", name)
+	}
+	if _, err := parseHostRules(credential.AllowedHosts); err != nil {
+		return fmt.Errorf("credential %v: %w", name, err)
+	}
+	return nil
+}
+
+// CheckCredentialUse returns an error if name is not a valid credential profile, or may not be sent to host on behalf
+// of tenant.
+func CheckCredentialUse(name string, host string, tenant string) error {
+	if err := CheckCredential(name); err != nil {
+		return err
+	}
+
+	credential := config.Config.Credentials[name]
+	rules, _ := parseHostRules(credential.AllowedHosts)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	allowed := rules.matchesHostname(host)
+	if addr, err := netip.ParseAddr(host); err == nil {
+		allowed = rules.matchesAddr(addr.Unmap())
+	}
+	if !allowed {
+		return fmt.Errorf("%w: credential %v may not be sent to %v", ErrCredentialNotAllowed, name, host)
+	}
+
+	if len(credential.Tenants) > 0 && !helpers.Contains(&credential.Tenants, tenant) {
+		return fmt.Errorf("%w: credential %v may not be used by tenant %v", ErrCredentialNotAllowed, name, tenant)
+	}
+	return nil
+}
+
+// withCredential returns ctx carrying the credential profile a request is sent with, so it is checked and applied
+// again for every redirect followed
+func withCredential(ctx context.Context, name string, tenant string) context.Context {
+	return context.WithValue(ctx, credentialKey{}, credentialUse{name: name, tenant: tenant})
+}
+
+// ApplyCredential sets the header for the credential profile name on req, replacing any the caller supplied, once
+// the profile is checked as allowed for the host req is sent to and for tenant.
+func ApplyCredential(req *http.Request, name string, tenant string) error {
+	if err := CheckCredentialUse(name, req.URL.Hostname(), tenant); err != nil {
+		return err
+	}
+
+	credential := config.Config.Credentials[name]
+	switch credential.Type {
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+credential.Token)
+	case "basic":
+		req.SetBasicAuth(credential.Username, credential.Password)
+	case "api_key":
+		req.Header.Set(credential.Header, credential.Value)
+	}
+	return nil
+}
+
+// checkRedirectCredential checks the credential req was first sent with, if any, may be sent to the host it is
+// redirected to, and applies it again, as net/http only keeps some credential headers across redirects.
+func checkRedirectCredential(req *http.Request) error {
+	use, ok := req.Context().Value(credentialKey{}).(credentialUse)
+	if !ok {
+		return nil
+	}
+	if err := ApplyCredential(req, use.name, use.tenant); err != nil {
+		return fmt.Errorf("redirect to %v: %w", req.URL.Redacted(), err)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"rq/config"
+	"rq/files"
+	"rq/records"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildRequestAppliesCredential(t *testing.T) {
+	config.Config.Credentials = map[string]config.RqCredentialConfig{
+		"bearer":       {Type: "bearer", Token: "secret-token", AllowedHosts: []string{"api.example.com"}},
+		"basic":        {Type: "basic", Username: "user", Password: "pass", AllowedHosts: []string{"*.example.com"}},
+		"api_key":      {Type: "api_key", Header: "X-Api-Key", Value: "secret-key", AllowedHosts: []string{"api.example.com"}},
+		"invalid":      {Type: "bearer", AllowedHosts: []string{"api.example.com"}},
+		"no_hosts":     {Type: "bearer", Token: "secret-token"},
+		"other_host":   {Type: "bearer", Token: "secret-token", AllowedHosts: []string{"other.example.com"}},
+		"other_tenant": {Type: "bearer", Token: "secret-token", AllowedHosts: []string{"api.example.com"}, Tenants: []string{"field-app"}},
+	}
+	defer func() { config.Config.Credentials = nil }()
+
+	store, _ := files.NewInMemoryFileStore()
+	sender, _ := NewSender(store)
+
+	tests := []struct {
+		name       string
+		credential string
+		wantHeader string
+		wantValue  string
+		wantErr    error
+	}{
+		{name: "bearer token", credential: "bearer", wantHeader: "Authorization", wantValue: "Bearer secret-token"},
+		{name: "basic auth", credential: "basic", wantHeader: "Authorization", wantValue: "Basic dXNlcjpwYXNz"},
+		{name: "api key header", credential: "api_key", wantHeader: "X-Api-Key", wantValue: "secret-key"},
+		{name: "no credential keeps stored header", wantHeader: "Authorization", wantValue: "Bearer stored"},
+		{name: "credential removed from config", credential: "removed", wantErr: ErrUnknownCredential},
+		{name: "misconfigured credential", credential: "invalid", wantErr: errors.New("credential invalid has no token")},
+		{name: "credential without allowed hosts", credential: "no_hosts", wantErr: errors.New("credential no_hosts has no allowed_hosts")},
+		{name: "credential for another host", credential: "other_host", wantErr: ErrCredentialNotAllowed},
+		{name: "credential for another tenant", credential: "other_tenant", wantErr: ErrCredentialNotAllowed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record := records.RqRecord{
+				Id:          "rqid",
+				Method:      "POST",
+				ContentType: "application/json",
+				Url:         "https://api.example.com",
+				Headers:     []byte(`{"Authorization":["Bearer stored"]}`),
+				Credential:  test.credential,
+			}
+
+			req, err := sender.BuildRequest(context.Background(), record)
+			if test.wantErr != nil {
+				if err == nil || (!errors.Is(err, test.wantErr) && err.Error() != "record rqid: "+test.wantErr.Error()) {
+					t.Errorf("BuildRequest() error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("BuildRequest() error = %v", err)
+			}
+			if got := req.Header.Get(test.wantHeader); got != test.wantValue {
+				t.Errorf("%v header = %v, want %v", test.wantHeader, got, test.wantValue)
+			}
+		})
+	}
+}
+
+func TestSendRefusesCredentialOnRedirectToOtherHost(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.UrlPolicy = config.RqUrlPolicyConfig{AllowedHosts: []string{"127.0.0.1/32"}}
+	config.Config.Credentials = map[string]config.RqCredentialConfig{
+		"api_key": {Type: "api_key", Header: "X-Api-Key", Value: "secret-key", AllowedHosts: []string{"127.0.0.1"}},
+	}
+
+	offHost := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("request with credential followed redirect to another host, X-Api-Key = %q", req.Header.Get("X-Api-Key"))
+	}))
+	defer offHost.Close()
+	offHostUrl := strings.Replace(offHost.URL, "127.0.0.1", "localhost", 1)
+
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/same-host":
+			http.Redirect(w, req, "/ok", http.StatusFound)
+		case "/other-host":
+			http.Redirect(w, req, offHostUrl, http.StatusFound)
+		default:
+			if req.Header.Get("X-Api-Key") != "secret-key" {
+				t.Errorf("X-Api-Key = %q after redirect, want the credential", req.Header.Get("X-Api-Key"))
+			}
+		}
+	}))
+	defer destination.Close()
+
+	store, _ := files.NewInMemoryFileStore()
+	sender, _ := NewSender(store)
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr error
+	}{
+		{name: "redirect to same host", path: "/same-host"},
+		{name: "redirect to another host", path: "/other-host", wantErr: ErrCredentialNotAllowed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record := records.RqRecord{Id: "rqid", Method: "GET", Url: destination.URL + test.path, Credential: "api_key"}
+			resp, err := sender.Send(context.Background(), record)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Errorf("Send() error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Send() error = %v", err)
+			}
+			resp.Body.Close()
+		})
+	}
+}
+
+// closeTrackingFileStore signals on opened and closed as each file is opened and closed
+type closeTrackingFileStore struct {
+	files.FileStore
+	opened chan string
+	closed chan string
+}
+
+type trackedFile struct {
+	io.ReadCloser
+	filename string
+	closed   chan string
+}
+
+func (tf *trackedFile) Close() error {
+	tf.closed <- tf.filename
+	return tf.ReadCloser.Close()
+}
+
+func (cs *closeTrackingFileStore) Open(filename string) (io.ReadCloser, error) {
+	file, err := cs.FileStore.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	cs.opened <- filename
+	return &trackedFile{ReadCloser: file, filename: filename, closed: cs.closed}, nil
+}
+
+func TestBuildRequestCredentialErrorClosesFiles(t *testing.T) {
+	memoryStore, _ := files.NewInMemoryFileStore()
+	store := &closeTrackingFileStore{FileStore: memoryStore, opened: make(chan string, 1), closed: make(chan string, 1)}
+	sender, _ := NewSender(store)
+
+	record := records.RqRecord{Id: "rqid", Method: "POST", Url: "https://api.example.com", FileKeys: `["file"]`, Credential: "removed"}
+	record.SetFiles(map[string]records.RqFile{"file": storeFile(t, memoryStore, "rqid-file.mp4", []byte("a video"), "video/mp4")})
+
+	if _, err := sender.BuildRequest(context.Background(), record); !errors.Is(err, ErrUnknownCredential) {
+		t.Fatalf("BuildRequest() error = %v, want %v", err, ErrUnknownCredential)
+	}
+
+	for _, events := range []chan string{store.opened, store.closed} {
+		select {
+		case <-events:
+		case <-time.After(5 * time.Second):
+			t.Fatal("file streamed into the body was not closed after the request failed")
+		}
+	}
+}
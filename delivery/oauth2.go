@@ -0,0 +1,119 @@
+package delivery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"rq/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenExpiryMargin is how long before a token expires that it is refreshed, so it does not expire in flight
+const tokenExpiryMargin = 30 * time.Second
+
+// defaultTokenLifetime is assumed when a token endpoint does not say when its tokens expire
+const defaultTokenLifetime = 5 * time.Minute
+
+// tokenSource fetches and caches bearer tokens for a destination using the OAuth2 client credentials grant.
+type tokenSource struct {
+	config config.RqOAuth2Config
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// tokenResponse is the successful response from a token endpoint
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func newTokenSource(oauth2Config config.RqOAuth2Config) (*tokenSource, error) {
+	if oauth2Config.TokenUrl == "" || oauth2Config.ClientId == "" {
+		return nil, errors.New("oauth2 needs a token_url and client_id")
+	}
+	return &tokenSource{config: oauth2Config}, nil
+}
+
+// Token returns the cached token, fetching a new one with client if there is none or it is about to expire.
+func (ts *tokenSource) Token(ctx context.Context, client *http.Client) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token != "" && time.Now().Before(ts.expiry) {
+		return ts.token, nil
+	}
+
+	token, lifetime, err := ts.fetch(ctx, client)
+	if err != nil {
+		return "", err
+	}
+
+	ts.token = token
+	ts.expiry = time.Now().Add(max(lifetime-tokenExpiryMargin, 0))
+	return ts.token, nil
+}
+
+// Invalidate discards token if it is still cached, after a destination has rejected it. Tokens fetched since are kept.
+func (ts *tokenSource) Invalidate(token string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token == token {
+		ts.token = ""
+	}
+}
+
+func (ts *tokenSource) fetch(ctx context.Context, client *http.Client) (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(ts.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(ts.config.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ts.config.TokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(ts.config.ClientId), url.QueryEscape(ts.config.ClientSecret))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("error fetching oauth2 token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", 0, fmt.Errorf("error fetching oauth2 token: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("error fetching oauth2 token: token endpoint returned %v: %s", resp.Status, body)
+	}
+
+	token := tokenResponse{}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", 0, fmt.Errorf("error fetching oauth2 token: invalid response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return "", 0, errors.New("error fetching oauth2 token: response has no access_token")
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("error fetching oauth2 token: unsupported token type %v", token.TokenType)
+	}
+
+	lifetime := defaultTokenLifetime
+	if token.ExpiresIn > 0 {
+		lifetime = time.Duration(token.ExpiresIn) * time.Second
+	}
+	return token.AccessToken, lifetime, nil
+}
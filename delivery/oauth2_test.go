@@ -0,0 +1,142 @@
+package delivery
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"rq/config"
+	"rq/files"
+	"rq/records"
+	"sync/atomic"
+	"testing"
+)
+
+// newTokenServer returns a token endpoint issuing numbered tokens, counting how many it has issued
+func newTokenServer(t *testing.T, issued *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clientId, clientSecret, _ := req.BasicAuth()
+		if clientId != "rq" || clientSecret != "client-secret" || req.FormValue("grant_type") != "client_credentials" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		if req.FormValue("scope") != "send read" {
+			t.Errorf("token request scope = %v, want %v", req.FormValue("scope"), "send read")
+		}
+		n := atomic.AddInt32(issued, 1)
+		fmt.Fprintf(w, `{"access_token":"token-%v","token_type":"Bearer","expires_in":3600}`, n)
+	}))
+}
+
+func TestSendWithOAuth2(t *testing.T) {
+	var issued int32
+	tokenServer := newTokenServer(t, &issued)
+	defer tokenServer.Close()
+
+	// The destination rejects the first token issued, as if it had been revoked
+	var received []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received = append(received, req.Header.Get("Authorization"))
+		if req.Header.Get("Authorization") == "Bearer token-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer api.Close()
+
+	withUrlPolicy(t, config.RqUrlPolicyConfig{AllowedHosts: []string{"127.0.0.1/32"}})
+	config.Config.Destinations = map[string]config.RqDestinationConfig{
+		"127.0.0.1": {OAuth2: &config.RqOAuth2Config{
+			TokenUrl:     tokenServer.URL,
+			ClientId:     "rq",
+			ClientSecret: "client-secret",
+			Scopes:       []string{"send", "read"},
+		}},
+	}
+	defer func() { config.Config.Destinations = nil }()
+
+	store, _ := files.NewInMemoryFileStore()
+	sender, err := NewSender(store)
+	if err != nil {
+		t.Fatalf("NewSender() error = %v", err)
+	}
+
+	record := records.RqRecord{Id: "rqid", Method: "POST", ContentType: "application/json", Url: api.URL, Payload: []byte(`{}`)}
+
+	resp, err := sender.Send(context.Background(), record)
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Send() status = %v, want 200 after retrying with a new token", resp.StatusCode)
+	}
+
+	// The refreshed token is cached for later requests
+	resp, _ = sender.Send(context.Background(), record)
+	resp.Body.Close()
+
+	want := []string{"Bearer token-1", "Bearer token-2", "Bearer token-2"}
+	if fmt.Sprint(received) != fmt.Sprint(want) {
+		t.Errorf("destination received %v, want %v", received, want)
+	}
+	if issued != 2 {
+		t.Errorf("token endpoint issued %v tokens, want 2", issued)
+	}
+}
+
+func TestSendWithOAuth2RetriesOnce(t *testing.T) {
+	var issued int32
+	tokenServer := newTokenServer(t, &issued)
+	defer tokenServer.Close()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer api.Close()
+
+	withUrlPolicy(t, config.RqUrlPolicyConfig{AllowedHosts: []string{"127.0.0.1/32"}})
+	config.Config.Destinations = map[string]config.RqDestinationConfig{
+		"127.0.0.1": {OAuth2: &config.RqOAuth2Config{
+			TokenUrl: tokenServer.URL, ClientId: "rq", ClientSecret: "client-secret", Scopes: []string{"send", "read"},
+		}},
+	}
+	defer func() { config.Config.Destinations = nil }()
+
+	store, _ := files.NewInMemoryFileStore()
+	sender, _ := NewSender(store)
+
+	resp, err := sender.Send(context.Background(), records.RqRecord{Method: "GET", Url: api.URL})
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || issued != 2 {
+		t.Errorf("Send() status = %v after %v tokens, want 401 after 2", resp.StatusCode, issued)
+	}
+}
+
+func TestSendWithOAuth2TokenError(t *testing.T) {
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+	}))
+	defer tokenServer.Close()
+
+	config.Config.Destinations = map[string]config.RqDestinationConfig{
+		"api.example.com": {OAuth2: &config.RqOAuth2Config{TokenUrl: tokenServer.URL, ClientId: "rq"}},
+	}
+	defer func() { config.Config.Destinations = nil }()
+
+	store, _ := files.NewInMemoryFileStore()
+	sender, _ := NewSender(store)
+
+	if _, err := sender.BuildRequest(context.Background(), records.RqRecord{Method: "GET", Url: "https://api.example.com"}); err == nil {
+		t.Error("BuildRequest() returned no error when the token could not be fetched")
+	}
+
+	config.Config.Destinations["api.example.com"] = config.RqDestinationConfig{OAuth2: &config.RqOAuth2Config{}}
+	if _, err := NewSender(store); err == nil {
+		t.Error("NewSender() with no token_url returned no error")
+	}
+}
@@ -0,0 +1,444 @@
+package delivery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"rq/config"
+	"rq/files"
+	"rq/records"
+	"rq/tracing"
+	"sort"
+	"strings"
+	"time"
+)
+
+// otherHost labels the delivery metrics of hosts which are not named in config, so clients can't create new series
+const otherHost = "other"
+
+var (
+	deliveryAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rq_delivery_attempts_total",
+		Help: "Requests sent to destinations, by configured host and outcome, the class of the response status or error.",
+	}, []string{"host", "outcome"})
+	deliveryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "rq_delivery_duration_seconds",
+		Help: "Time taken to send requests to destinations, by configured host, until the response headers are received.",
+		// Destinations can be slow to respond, so the default buckets are extended up to a minute
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"host"})
+)
+
+// Sender builds and sends the onward HTTP request for a stored record, reading any uploaded files back from the
+// FileStore and applying the transforms configured for the destination host. Requests are sent with a Client which
+// enforces the UrlPolicy on every connection and redirect, while OAuth2 tokens, whose endpoints come from config,
+// are fetched with TokenClient. Destinations with their own transport config have their own clients.
+type Sender struct {
+	FileStore    files.FileStore
+	Client       *http.Client
+	TokenClient  *http.Client
+	policy       *UrlPolicy
+	clients      map[string]*http.Client
+	tokenClients map[string]*http.Client
+	transforms   map[string]*files.TransformPipeline
+	tokens       map[string]*tokenSource
+	signers      map[string]*signer
+	metricHosts  map[string]bool
+}
+
+// NewSender returns a Sender for the destinations in config.
+func NewSender(fileStore files.FileStore) (*Sender, error) {
+	policy, err := NewUrlPolicy(config.Config.UrlPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	sender := &Sender{
+		FileStore:    fileStore,
+		policy:       policy,
+		clients:      map[string]*http.Client{},
+		tokenClients: map[string]*http.Client{},
+		transforms:   map[string]*files.TransformPipeline{},
+		tokens:       map[string]*tokenSource{},
+		signers:      map[string]*signer{},
+		metricHosts:  map[string]bool{},
+	}
+	if sender.Client, err = newClient(policy, config.Config.Transport); err != nil {
+		return nil, fmt.Errorf("transport: %w", err)
+	}
+	if sender.TokenClient, err = newClient(nil, config.Config.Transport); err != nil {
+		return nil, fmt.Errorf("transport: %w", err)
+	}
+
+	// Only hosts named in the allow-list, rather than matched by a wildcard or range, are labelled in the metrics
+	for _, host := range config.Config.UrlPolicy.AllowedHosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" && !strings.HasPrefix(host, "*.") && !strings.Contains(host, "/") {
+			sender.metricHosts[host] = true
+		}
+	}
+
+	for host, destination := range config.Config.Destinations {
+		host = strings.ToLower(host)
+		sender.metricHosts[host] = true
+		if destination.Transport != nil {
+			if sender.clients[host], err = newClient(policy, *destination.Transport); err != nil {
+				return nil, fmt.Errorf("destination %v: %w", host, err)
+			}
+			if sender.tokenClients[host], err = newClient(nil, *destination.Transport); err != nil {
+				return nil, fmt.Errorf("destination %v: %w", host, err)
+			}
+		}
+
+		pipeline, err := files.NewTransformPipeline(destination.Transforms)
+		if err != nil {
+			return nil, fmt.Errorf("destination %v: %w", host, err)
+		}
+		sender.transforms[host] = pipeline
+
+		if destination.OAuth2 != nil {
+			tokens, err := newTokenSource(*destination.OAuth2)
+			if err != nil {
+				return nil, fmt.Errorf("destination %v: %w", host, err)
+			}
+			sender.tokens[host] = tokens
+		}
+
+		if destination.Signing != nil {
+			signer, err := newSigner(*destination.Signing)
+			if err != nil {
+				return nil, fmt.Errorf("destination %v: %w", host, err)
+			}
+			sender.signers[host] = signer
+		}
+	}
+
+	return sender, nil
+}
+
+// Send makes the onward request for record. If the destination uses OAuth2 and rejects the token with a 401, the
+// request is retried once with a new token. The send is traced in a span linked to the span the record was enqueued
+// in, and its trace context is sent to the destination.
+func (s *Sender) Send(ctx context.Context, record records.RqRecord) (resp *http.Response, err error) {
+	options := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("rq.id", record.Id), attribute.String("http.request.method", record.Method)),
+	}
+	if enqueued := tracing.SpanContext(record.TraceParent); enqueued.IsValid() {
+		options = append(options, trace.WithLinks(trace.Link{SpanContext: enqueued}))
+	}
+	ctx, span := tracing.Tracer().Start(ctx, "Send", options...)
+	defer func() {
+		if resp != nil {
+			span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		}
+		tracing.End(span, err)
+	}()
+
+	req, err := s.BuildRequest(ctx, record)
+	if err != nil {
+		return nil, err
+	}
+	host := strings.ToLower(req.URL.Hostname())
+	span.SetAttributes(attribute.String("server.address", host))
+	resp, err = s.do(host, req)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := s.tokens[host]
+	if resp.StatusCode != http.StatusUnauthorized || tokens == nil {
+		return resp, nil
+	}
+
+	resp.Body.Close()
+	tokens.Invalidate(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+
+	// The body may have been streamed, so the request is built again rather than replayed
+	req, err = s.BuildRequest(ctx, record)
+	if err != nil {
+		return nil, err
+	}
+	return s.do(host, req)
+}
+
+// do sends req to host, recording the attempt and its duration
+func (s *Sender) do(host string, req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := s.clientFor(host).Do(req)
+	deliveryDuration.WithLabelValues(s.metricHost(host)).Observe(time.Since(start).Seconds())
+
+	outcome := "error"
+	if err == nil {
+		outcome = fmt.Sprintf("%dxx", resp.StatusCode/100)
+	}
+	deliveryAttempts.WithLabelValues(s.metricHost(host), outcome).Inc()
+	return resp, err
+}
+
+// metricHost returns the label host is recorded under in the delivery metrics. Hosts come from the urls clients
+// enqueue, so only those configured as destinations or in the allow-list are labelled, and the rest share otherHost.
+func (s *Sender) metricHost(host string) string {
+	if s.metricHosts[host] {
+		return host
+	}
+	return otherHost
+}
+
+// clientFor returns the client used to send requests to host
+func (s *Sender) clientFor(host string) *http.Client {
+	if client, ok := s.clients[host]; ok {
+		return client
+	}
+	return s.Client
+}
+
+// tokenClientFor returns the client used to fetch OAuth2 tokens for host
+func (s *Sender) tokenClientFor(host string) *http.Client {
+	if client, ok := s.tokenClients[host]; ok {
+		return client
+	}
+	return s.TokenClient
+}
+
+// BuildRequest returns the onward request for record. The payload is sent as the querystring for GET requests,
+// unaltered for JSON, and otherwise as a form, with any files streamed from the FileStore as multipart/form-data.
+func (s *Sender) BuildRequest(ctx context.Context, record records.RqRecord) (_ *http.Request, err error) {
+	dst, err := url.Parse(record.Url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url %v: %w", record.Url, err)
+	}
+	if err := s.policy.CheckUrl(dst); err != nil {
+		return nil, err
+	}
+
+	storedFiles, err := record.GetFiles()
+	if err != nil {
+		return nil, fmt.Errorf("invalid files for record %v: %w", record.Id, err)
+	}
+
+	var body io.Reader
+	contentType := ""
+
+	// A streamed body is closed if the request can't be built, which stops it being written and closes its files
+	defer func() {
+		if closer, ok := body.(io.Closer); ok && err != nil {
+			closer.Close()
+		}
+	}()
+
+	switch {
+	case record.ContentType == "application/json":
+		body = bytes.NewReader(record.Payload)
+		contentType = record.ContentType
+	case record.Method == http.MethodGet:
+		values, err := formValues(record.Payload)
+		if err != nil {
+			return nil, err
+		}
+		query := dst.Query()
+		for key, vals := range values {
+			for _, val := range vals {
+				query.Add(key, val)
+			}
+		}
+		dst.RawQuery = query.Encode()
+	case len(storedFiles) > 0:
+		values, err := formValues(record.Payload)
+		if err != nil {
+			return nil, err
+		}
+		body, contentType = s.multipartBody(dst.Hostname(), values, fileKeys(record, storedFiles), storedFiles)
+	default:
+		values, err := formValues(record.Payload)
+		if err != nil {
+			return nil, err
+		}
+		body = strings.NewReader(values.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	}
+
+	if record.Credential != "" {
+		ctx = withCredential(ctx, record.Credential, record.Tenant)
+	}
+	req, err := http.NewRequestWithContext(ctx, record.Method, dst.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(record.Headers) > 0 {
+		headers := http.Header{}
+		if err := json.Unmarshal(record.Headers, &headers); err != nil {
+			return nil, fmt.Errorf("invalid headers for record %v: %w", record.Id, err)
+		}
+		for key, values := range headers {
+			for _, value := range values {
+				req.Header.Add(key, value)
+			}
+		}
+	}
+
+	// The body is rebuilt for the onward request, so its original length and type no longer apply
+	req.Header.Del("Content-Length")
+	req.Header.Del("Content-Type")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	// The destination continues the trace of the send, rather than any the device sent
+	tracing.Inject(ctx, req.Header)
+
+	// Secrets are only added now, so they are never stored with the record
+	if record.Credential != "" {
+		if err := ApplyCredential(req, record.Credential, record.Tenant); err != nil {
+			return nil, fmt.Errorf("record %v: %w", record.Id, err)
+		}
+	}
+	if tokens := s.tokens[strings.ToLower(dst.Hostname())]; tokens != nil {
+		token, err := tokens.Token(ctx, s.tokenClientFor(strings.ToLower(dst.Hostname())))
+		if err != nil {
+			return nil, fmt.Errorf("record %v: %w", record.Id, err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	// Signing is last, as the body must be complete before it can be digested
+	if signer := s.signers[strings.ToLower(dst.Hostname())]; signer != nil {
+		if err := signer.Sign(req); err != nil {
+			return nil, fmt.Errorf("record %v: %w", record.Id, err)
+		}
+	}
+
+	return req, nil
+}
+
+// Transforms returns the TransformPipeline configured for host, or nil if files are sent to it unaltered.
+func (s *Sender) Transforms(host string) *files.TransformPipeline {
+	return s.transforms[strings.ToLower(host)]
+}
+
+// multipartBody streams the form values and stored files as multipart/form-data, returning the body and its
+// Content-Type. Each file's checksum is verified as it is read, and an error stops the body part way through.
+func (s *Sender) multipartBody(host string, values url.Values, keys []string, storedFiles map[string]records.RqFile) (io.Reader, string) {
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+
+	go func() {
+		err := func() error {
+			for key, vals := range values {
+				for _, val := range vals {
+					if err := writer.WriteField(key, val); err != nil {
+						return err
+					}
+				}
+			}
+			for _, key := range keys {
+				if err := s.writeFile(writer, host, key, storedFiles[key]); err != nil {
+					return err
+				}
+			}
+			return writer.Close()
+		}()
+		pw.CloseWithError(err)
+	}()
+
+	return pr, writer.FormDataContentType()
+}
+
+// writeFile copies a stored file into writer under key, after applying the transforms for host
+func (s *Sender) writeFile(writer *multipart.Writer, host string, key string, storedFile records.RqFile) error {
+	file, err := s.FileStore.Open(storedFile.Filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var contents io.Reader = file
+	var verifier *files.ChecksumReader
+	if storedFile.Checksum != "" {
+		verifier = files.NewChecksumReader(file, storedFile.Filename, storedFile.Checksum)
+		contents = verifier
+	}
+
+	contentType := storedFile.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	contentType, contents, err = s.Transforms(host).Apply(contentType, contents)
+	if err != nil {
+		return fmt.Errorf("error transforming %v: %w", storedFile.Filename, err)
+	}
+
+	// Files stored before the original name was kept are sent under the name they are stored as
+	filename := storedFile.OriginalFilename
+	if filename == "" {
+		filename = storedFile.Filename
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%v"; filename="%v"`,
+		escapeQuotes(key), escapeQuotes(filename)))
+	header.Set("Content-Type", contentType)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, contents); err != nil {
+		return err
+	}
+
+	if verifier != nil {
+		return verifier.Verify()
+	}
+	return nil
+}
+
+// fileKeys returns the record's file keys in the order they were uploaded, followed by any others in storedFiles
+func fileKeys(record records.RqRecord, storedFiles map[string]records.RqFile) []string {
+	keys := []string{}
+	json.Unmarshal([]byte(record.FileKeys), &keys)
+
+	ordered := []string{}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if _, ok := storedFiles[key]; ok && !seen[key] {
+			ordered = append(ordered, key)
+			seen[key] = true
+		}
+	}
+	remaining := []string{}
+	for key := range storedFiles {
+		if !seen[key] {
+			remaining = append(remaining, key)
+		}
+	}
+	sort.Strings(remaining)
+	return append(ordered, remaining...)
+}
+
+// formValues unmarshals a form or querystring payload
+func formValues(payload json.RawMessage) (url.Values, error) {
+	values := url.Values{}
+	if len(payload) == 0 {
+		return values, nil
+	}
+	if err := json.Unmarshal(payload, &values); err != nil {
+		return nil, fmt.Errorf("invalid form payload: %w", err)
+	}
+	return values, nil
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(s)
+}
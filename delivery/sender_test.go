@@ -0,0 +1,289 @@
+package delivery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"rq/config"
+	"rq/files"
+	"rq/records"
+	"rq/tracing"
+	"strings"
+	"testing"
+)
+
+func storeFile(t *testing.T, store files.FileStore, filename string, contents []byte, contentType string) records.RqFile {
+	checksum, err := store.Save(filename, bytes.NewReader(contents))
+	if err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	return records.RqFile{Filename: filename, Size: int64(len(contents)), Checksum: checksum, ContentType: contentType}
+}
+
+func readParts(t *testing.T, body io.Reader, contentType string) map[string][]byte {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatalf("invalid Content-Type %v: %v", contentType, err)
+	}
+	parts := map[string][]byte{}
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatalf("error reading multipart body: %v", err)
+		}
+		parts[part.FormName()], _ = io.ReadAll(part)
+	}
+}
+
+func TestBuildRequestAppliesDestinationTransforms(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 800, 600))
+	for i := range img.Pix {
+		img.Pix[i] = 200
+	}
+	img.Set(0, 0, color.Black)
+	large := &bytes.Buffer{}
+	jpeg.Encode(large, img, nil)
+
+	config.Config.Destinations = map[string]config.RqDestinationConfig{
+		"api.example.com": {Transforms: []config.RqTransformConfig{{Type: "image_resize", MaxWidth: 400, MaxHeight: 400}}},
+	}
+	defer func() { config.Config.Destinations = nil }()
+
+	store, _ := files.NewInMemoryFileStore()
+	sender, err := NewSender(store)
+	if err != nil {
+		t.Fatalf("NewSender() error = %v", err)
+	}
+
+	record := records.RqRecord{Id: "rqid", Method: "POST", ContentType: "multipart/form-data", FileKeys: `["photo"]`}
+	record.SetFiles(map[string]records.RqFile{"photo": storeFile(t, store, "rqid-photo.jpg", large.Bytes(), "image/jpeg")})
+	record.Payload, _ = json.Marshal(map[string][]string{"caption": {"a photo"}})
+
+	tests := []struct {
+		name      string
+		url       string
+		wantWidth int
+	}{
+		{name: "configured destination", url: "https://api.example.com/upload", wantWidth: 400},
+		{name: "configured destination with different case", url: "https://API.example.com/upload", wantWidth: 400},
+		{name: "other destination", url: "https://other.example.com/upload", wantWidth: 800},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record.Url = test.url
+			req, err := sender.BuildRequest(context.Background(), record)
+			if err != nil {
+				t.Fatalf("BuildRequest() error = %v", err)
+			}
+
+			parts := readParts(t, req.Body, req.Header.Get("Content-Type"))
+			if string(parts["caption"]) != "a photo" {
+				t.Errorf("caption = %q, want %q", parts["caption"], "a photo")
+			}
+			sent, _, err := image.Decode(bytes.NewReader(parts["photo"]))
+			if err != nil {
+				t.Fatalf("sent photo could not be decoded: %v", err)
+			}
+			if sent.Bounds().Dx() != test.wantWidth {
+				t.Errorf("sent photo width = %v, want %v", sent.Bounds().Dx(), test.wantWidth)
+			}
+		})
+	}
+}
+
+func TestBuildRequestSendsOriginalFilename(t *testing.T) {
+	store, _ := files.NewInMemoryFileStore()
+	sender, _ := NewSender(store)
+
+	photo := storeFile(t, store, "rqid-photo.jpg", []byte("a photo"), "image/jpeg")
+	photo.OriginalFilename = "holiday.jpg"
+	record := records.RqRecord{Id: "rqid", Method: "POST", Url: "https://api.example.com", FileKeys: `["photo","video"]`}
+	record.SetFiles(map[string]records.RqFile{
+		"photo": photo,
+		"video": storeFile(t, store, "rqid-video.mp4", []byte("a video"), "video/mp4"),
+	})
+
+	req, err := sender.BuildRequest(context.Background(), record)
+	if err != nil {
+		t.Fatalf("BuildRequest() error = %v", err)
+	}
+	_, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	reader := multipart.NewReader(req.Body, params["boundary"])
+
+	want := map[string]string{"photo": "holiday.jpg", "video": "rqid-video.mp4"}
+	for part, err := reader.NextPart(); err == nil; part, err = reader.NextPart() {
+		if part.FileName() != want[part.FormName()] {
+			t.Errorf("%v sent as %q, want %q", part.FormName(), part.FileName(), want[part.FormName()])
+		}
+	}
+}
+
+func TestBuildRequestChecksumMismatch(t *testing.T) {
+	store, _ := files.NewInMemoryFileStore()
+	sender, _ := NewSender(store)
+
+	storedFile := storeFile(t, store, "rqid-file.mp4", []byte("a video"), "video/mp4")
+	storedFile.Checksum = strings.Repeat("0", 64)
+
+	record := records.RqRecord{Id: "rqid", Method: "POST", Url: "https://api.example.com", FileKeys: `["file"]`}
+	record.SetFiles(map[string]records.RqFile{"file": storedFile})
+
+	req, err := sender.BuildRequest(context.Background(), record)
+	if err != nil {
+		t.Fatalf("BuildRequest() error = %v", err)
+	}
+	if _, err := io.ReadAll(req.Body); !errors.Is(err, files.ErrChecksumMismatch) {
+		t.Errorf("reading body error = %v, want %v", err, files.ErrChecksumMismatch)
+	}
+}
+
+func TestBuildRequestPayloads(t *testing.T) {
+	store, _ := files.NewInMemoryFileStore()
+	sender, _ := NewSender(store)
+
+	tests := []struct {
+		name            string
+		record          records.RqRecord
+		wantUrl         string
+		wantContentType string
+		wantBody        string
+	}{
+		{
+			name:            "json",
+			record:          records.RqRecord{Method: "POST", ContentType: "application/json", Url: "https://api.example.com", Payload: []byte(`{"a":1}`)},
+			wantUrl:         "https://api.example.com",
+			wantContentType: "application/json",
+			wantBody:        `{"a":1}`,
+		},
+		{
+			name:            "form",
+			record:          records.RqRecord{Method: "POST", ContentType: "application/x-www-form-urlencoded", Url: "https://api.example.com", Payload: []byte(`{"a":["1"]}`)},
+			wantUrl:         "https://api.example.com",
+			wantContentType: "application/x-www-form-urlencoded",
+			wantBody:        "a=1",
+		},
+		{
+			name:     "querystring",
+			record:   records.RqRecord{Method: "GET", Url: "https://api.example.com/?b=2", Payload: []byte(`{"a":["1"]}`)},
+			wantUrl:  "https://api.example.com/?a=1&b=2",
+			wantBody: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.record.Headers = []byte(`{"X-Test":["yes"],"Content-Type":["text/plain"]}`)
+			req, err := sender.BuildRequest(context.Background(), test.record)
+			if err != nil {
+				t.Fatalf("BuildRequest() error = %v", err)
+			}
+			if req.URL.String() != test.wantUrl {
+				t.Errorf("URL = %v, want %v", req.URL, test.wantUrl)
+			}
+			if req.Header.Get("Content-Type") != test.wantContentType {
+				t.Errorf("Content-Type = %v, want %v", req.Header.Get("Content-Type"), test.wantContentType)
+			}
+			if req.Header.Get("X-Test") != "yes" {
+				t.Errorf("X-Test header = %v, want yes", req.Header.Get("X-Test"))
+			}
+			body := []byte{}
+			if req.Body != nil {
+				body, _ = io.ReadAll(req.Body)
+			}
+			if string(body) != test.wantBody {
+				t.Errorf("body = %q, want %q", body, test.wantBody)
+			}
+		})
+	}
+}
+
+func TestSendRecordsMetrics(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer api.Close()
+	withUrlPolicy(t, config.RqUrlPolicyConfig{AllowedHosts: []string{"127.0.0.1", "127.0.0.0/8"}})
+
+	store, _ := files.NewInMemoryFileStore()
+	sender, _ := NewSender(store)
+	resp, err := sender.Send(context.Background(), records.RqRecord{Method: "GET", Url: api.URL})
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	resp.Body.Close()
+	sender.Send(context.Background(), records.RqRecord{Method: "GET", Url: "http://127.0.0.1:1/closed"})
+	// Only allowed by a range, so its attempts are not labelled with the host
+	sender.Send(context.Background(), records.RqRecord{Method: "GET", Url: "http://127.0.0.2:1/closed"})
+
+	out := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(out, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, sample := range []string{
+		`rq_delivery_attempts_total{host="127.0.0.1",outcome="2xx"}`,
+		`rq_delivery_attempts_total{host="127.0.0.1",outcome="error"}`,
+		`rq_delivery_duration_seconds_count{host="127.0.0.1"}`,
+		`rq_delivery_attempts_total{host="other",outcome="error"}`,
+	} {
+		if !strings.Contains(out.Body.String(), sample+" ") {
+			t.Errorf("metrics missing %v", sample)
+		}
+	}
+	if strings.Contains(out.Body.String(), `host="127.0.0.2"`) {
+		t.Errorf("metrics labelled with a host which is not configured")
+	}
+}
+
+func TestSendTracing(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	var gotTraceParent string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotTraceParent = req.Header.Get("Traceparent")
+	}))
+	defer api.Close()
+	withUrlPolicy(t, config.RqUrlPolicyConfig{AllowedHosts: []string{"127.0.0.1/32"}})
+
+	// The record was enqueued in another trace, and kept the traceparent the device sent
+	const enqueued = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	headers, _ := json.Marshal(http.Header{"Traceparent": {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}})
+
+	store, _ := files.NewInMemoryFileStore()
+	sender, _ := NewSender(store)
+	resp, err := sender.Send(context.Background(), records.RqRecord{Id: "rq-1", Method: "GET", Url: api.URL, Headers: headers, TraceParent: enqueued})
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	resp.Body.Close()
+
+	ended := spans.Ended()
+	if len(ended) != 1 || ended[0].Name() != "Send" {
+		t.Fatalf("spans = %v, want a single Send span", ended)
+	}
+	send := ended[0]
+	if links := send.Links(); len(links) != 1 || links[0].SpanContext.TraceID() != tracing.SpanContext(enqueued).TraceID() {
+		t.Errorf("Send span links = %+v, want a link to the enqueue span", links)
+	}
+	if got := tracing.SpanContext(gotTraceParent); got.SpanID() != send.SpanContext().SpanID() {
+		t.Errorf("destination got traceparent %q, want the Send span %v", gotTraceParent, send.SpanContext().SpanID())
+	}
+}
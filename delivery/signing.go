@@ -0,0 +1,156 @@
+package delivery
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"rq/config"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSignatureHeader = "X-Rq-Signature"
+	defaultTimestampHeader = "X-Rq-Timestamp"
+	defaultSigningFormat   = "{method}\n{path}\n{timestamp}\n{body_digest}"
+)
+
+// now returns the time requests are signed at, and is replaced in tests
+var now = time.Now
+
+// signer adds an HMAC signature over the method, path, timestamp and body digest of a request, so the destination
+// can verify it came from RQ.
+type signer struct {
+	config   config.RqSigningConfig
+	hash     func() hash.Hash
+	encoding func([]byte) string
+}
+
+func newSigner(signingConfig config.RqSigningConfig) (*signer, error) {
+	if signingConfig.Secret == "" {
+		return nil, errors.New("signing needs a secret")
+	}
+	if signingConfig.Header == "" {
+		signingConfig.Header = defaultSignatureHeader
+	}
+	if signingConfig.TimestampHeader == "" {
+		signingConfig.TimestampHeader = defaultTimestampHeader
+	}
+	if signingConfig.Format == "" {
+		signingConfig.Format = defaultSigningFormat
+	}
+
+	s := &signer{config: signingConfig}
+
+	switch strings.ToLower(signingConfig.Algorithm) {
+	case "", "sha256", "hmac-sha256":
+		s.hash = sha256.New
+	case "sha512", "hmac-sha512":
+		s.hash = sha512.New
+	default:
+		return nil, fmt.Errorf("unknown signing algorithm: %v", signingConfig.Algorithm)
+	}
+
+	switch strings.ToLower(signingConfig.Encoding) {
+	case "", "hex":
+		s.encoding = hex.EncodeToString
+	case "base64":
+		s.encoding = base64.StdEncoding.EncodeToString
+	default:
+		return nil, fmt.Errorf("unknown signature encoding: %v", signingConfig.Encoding)
+	}
+
+	return s, nil
+}
+
+// Sign sets the timestamp and signature headers on req. A streamed body is spooled to a temporary file, as the
+// digest must be known before it is sent.
+func (s *signer) Sign(req *http.Request) error {
+	digest, err := s.bodyDigest(req)
+	if err != nil {
+		return fmt.Errorf("error signing request: %w", err)
+	}
+
+	timestamp := strconv.FormatInt(now().Unix(), 10)
+	canonical := strings.NewReplacer(
+		"{method}", req.Method,
+		"{host}", req.URL.Host,
+		"{path}", req.URL.EscapedPath(),
+		"{query}", req.URL.RawQuery,
+		"{timestamp}", timestamp,
+		"{body_digest}", digest,
+	).Replace(s.config.Format)
+
+	mac := hmac.New(s.hash, []byte(s.config.Secret))
+	mac.Write([]byte(canonical))
+
+	req.Header.Set(s.config.TimestampHeader, timestamp)
+	req.Header.Set(s.config.Header, s.encoding(mac.Sum(nil)))
+	return nil
+}
+
+// bodyDigest returns the hex digest of the request body, using the signing algorithm
+func (s *signer) bodyDigest(req *http.Request) (string, error) {
+	digest := s.hash()
+
+	switch {
+	case req.Body == nil || req.Body == http.NoBody:
+	case req.GetBody != nil:
+		body, err := req.GetBody()
+		if err != nil {
+			return "", err
+		}
+		defer body.Close()
+		if _, err := io.Copy(digest, body); err != nil {
+			return "", err
+		}
+	default:
+		spooled, size, err := spool(req.Body, digest)
+		if err != nil {
+			return "", err
+		}
+		req.Body = spooled
+		req.ContentLength = size
+	}
+
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// spool copies body to a temporary file, which is removed when the returned body is closed
+func spool(body io.ReadCloser, digest io.Writer) (io.ReadCloser, int64, error) {
+	defer body.Close()
+
+	tmp, err := os.CreateTemp("", "rq-sign-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(io.MultiWriter(tmp, digest), body)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, 0, err
+	}
+	return &spooledBody{File: tmp}, size, nil
+}
+
+type spooledBody struct {
+	*os.File
+}
+
+func (sb *spooledBody) Close() error {
+	err := sb.File.Close()
+	os.Remove(sb.File.Name())
+	return err
+}
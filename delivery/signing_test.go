@@ -0,0 +1,137 @@
+package delivery
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"rq/config"
+	"rq/files"
+	"rq/records"
+	"strings"
+	"testing"
+	"time"
+)
+
+func expectedSignature(hashFunc func() hash.Hash, secret string, canonical string) []byte {
+	mac := hmac.New(hashFunc, []byte(secret))
+	mac.Write([]byte(canonical))
+	return mac.Sum(nil)
+}
+
+func digest(hashFunc func() hash.Hash, body string) string {
+	h := hashFunc()
+	h.Write([]byte(body))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func TestBuildRequestSigning(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Unix(1700000000, 0) }
+	defer func() { config.Config.Destinations = nil }()
+
+	store, _ := files.NewInMemoryFileStore()
+	storedFile := storeFile(t, store, "rqid-file.mp4", []byte("a video"), "video/mp4")
+
+	jsonRecord := records.RqRecord{Id: "rqid", Method: "POST", ContentType: "application/json", Url: "https://api.example.com/hooks/in?x=1", Payload: []byte(`{"a":1}`)}
+	multipartRecord := records.RqRecord{Id: "rqid", Method: "POST", ContentType: "multipart/form-data", Url: "https://api.example.com/upload", FileKeys: `["file"]`}
+	multipartRecord.SetFiles(map[string]records.RqFile{"file": storedFile})
+
+	tests := []struct {
+		name          string
+		signing       config.RqSigningConfig
+		record        records.RqRecord
+		wantHeader    string
+		wantCanonical func(body string) string
+		hash          func() hash.Hash
+		encode        func([]byte) string
+	}{
+		{
+			name:       "defaults",
+			signing:    config.RqSigningConfig{Secret: "shh"},
+			record:     jsonRecord,
+			wantHeader: "X-Rq-Signature",
+			wantCanonical: func(body string) string {
+				return "POST\n/hooks/in\n1700000000\n" + digest(sha256.New, body)
+			},
+			hash:   sha256.New,
+			encode: hex.EncodeToString,
+		},
+		{
+			name: "custom format, sha512 and base64",
+			signing: config.RqSigningConfig{
+				Secret: "shh", Algorithm: "sha512", Encoding: "base64", Header: "Signature",
+				Format: "{timestamp}.{method}.{host}{path}?{query}.{body_digest}",
+			},
+			record:     jsonRecord,
+			wantHeader: "Signature",
+			wantCanonical: func(body string) string {
+				return "1700000000.POST.api.example.com/hooks/in?x=1." + digest(sha512.New, body)
+			},
+			hash:   sha512.New,
+			encode: base64.StdEncoding.EncodeToString,
+		},
+		{
+			name:       "streamed multipart body",
+			signing:    config.RqSigningConfig{Secret: "shh"},
+			record:     multipartRecord,
+			wantHeader: "X-Rq-Signature",
+			wantCanonical: func(body string) string {
+				return "POST\n/upload\n1700000000\n" + digest(sha256.New, body)
+			},
+			hash:   sha256.New,
+			encode: hex.EncodeToString,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config.Config.Destinations = map[string]config.RqDestinationConfig{
+				"api.example.com": {Signing: &test.signing},
+			}
+			sender, err := NewSender(store)
+			if err != nil {
+				t.Fatalf("NewSender() error = %v", err)
+			}
+
+			req, err := sender.BuildRequest(context.Background(), test.record)
+			if err != nil {
+				t.Fatalf("BuildRequest() error = %v", err)
+			}
+			body, _ := io.ReadAll(req.Body)
+			req.Body.Close()
+
+			if req.ContentLength != int64(len(body)) {
+				t.Errorf("ContentLength = %v, want %v", req.ContentLength, len(body))
+			}
+			if got := req.Header.Get("X-Rq-Timestamp"); got != "1700000000" {
+				t.Errorf("timestamp header = %v, want 1700000000", got)
+			}
+			want := test.encode(expectedSignature(test.hash, "shh", test.wantCanonical(string(body))))
+			if got := req.Header.Get(test.wantHeader); got != want {
+				t.Errorf("%v header = %v, want %v", test.wantHeader, got, want)
+			}
+		})
+	}
+}
+
+func TestNewSignerInvalidConfig(t *testing.T) {
+	tests := []config.RqSigningConfig{
+		{},
+		{Secret: "shh", Algorithm: "md5"},
+		{Secret: "shh", Encoding: "base32"},
+	}
+	for _, signing := range tests {
+		if _, err := newSigner(signing); err == nil {
+			t.Errorf("newSigner(%+v) returned no error", signing)
+		}
+	}
+
+	if s, _ := newSigner(config.RqSigningConfig{Secret: "shh"}); !strings.Contains(s.config.Format, "{body_digest}") {
+		t.Errorf("default format = %q, want it to include the body digest", s.config.Format)
+	}
+}
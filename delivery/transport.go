@@ -0,0 +1,155 @@
+package delivery
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"rq/config"
+	"time"
+)
+
+// Requests are always limited, so a destination which accepts a connection and never responds can't hold up delivery
+const (
+	defaultConnectTimeout        = 30 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultResponseHeaderTimeout = 30 * time.Second
+	defaultTimeout               = 5 * time.Minute
+)
+
+// newClient returns an http.Client using the CA bundle, client certificate, proxy and timeouts in transportConfig.
+// If policy is set, every connection and redirect is checked against it. Without a proxy, the addresses a host
+// resolves to are checked as they are connected to. Through a proxy, which connects to the destination itself, each
+// request is checked against the addresses its host resolves to locally, if it can be resolved.
+func newClient(policy *UrlPolicy, transportConfig config.RqTransportConfig) (*http.Client, error) {
+	tlsConfig, err := clientTLSConfig(transportConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   secondsOrDefault(transportConfig.ConnectTimeoutSeconds, defaultConnectTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.TLSHandshakeTimeout = secondsOrDefault(transportConfig.TLSHandshakeTimeoutSeconds, defaultTLSHandshakeTimeout)
+	transport.ResponseHeaderTimeout = secondsOrDefault(transportConfig.ResponseHeaderTimeoutSeconds, defaultResponseHeaderTimeout)
+	transport.DialContext = dialer.DialContext
+
+	// Proxies from the environment are not used, as the policy would check the proxy's address, not the destination's
+	transport.Proxy = nil
+	if transportConfig.Proxy != "" {
+		proxyUrl, err := url.Parse(transportConfig.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		switch proxyUrl.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme: %v", proxyUrl.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	client := &http.Client{
+		Transport:     transport,
+		Timeout:       secondsOrDefault(transportConfig.TimeoutSeconds, defaultTimeout),
+		CheckRedirect: checkRedirect(policy),
+	}
+	if policy == nil {
+		return client, nil
+	}
+
+	if transport.Proxy == nil {
+		transport.DialContext = policy.DialContext(dialer)
+	} else {
+		client.Transport = &proxiedTransport{policy: policy, next: transport}
+	}
+	return client, nil
+}
+
+// checkRedirect returns the CheckRedirect for a client, which checks each redirect against policy, if set, and that
+// any credential the request is sent with may be sent to the host it is redirected to
+func checkRedirect(policy *UrlPolicy) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if policy != nil {
+			if err := policy.CheckRedirect(req, via); err != nil {
+				return err
+			}
+		} else if len(via) >= defaultMaxRedirects {
+			return fmt.Errorf("stopped after %v redirects", defaultMaxRedirects)
+		}
+		return checkRedirectCredential(req)
+	}
+}
+
+// proxiedTransport checks each request sent through a proxy, including redirects, before it is sent
+type proxiedTransport struct {
+	policy *UrlPolicy
+	next   http.RoundTripper
+}
+
+func (pt *proxiedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := pt.policy.CheckResolved(req.Context(), req.URL); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return pt.next.RoundTrip(req)
+}
+
+// clientTLSConfig returns the TLS config for connecting to destinations
+func clientTLSConfig(transportConfig config.RqTransportConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	switch transportConfig.MinTLSVersion {
+	case "", "1.2":
+		tlsConfig.MinVersion = tls.VersionTLS12
+	case "1.3":
+		tlsConfig.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported min_tls_version: %v", transportConfig.MinTLSVersion)
+	}
+
+	if transportConfig.CAFile != "" {
+		pem, err := os.ReadFile(transportConfig.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading CA bundle: %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", transportConfig.CAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	if (transportConfig.CertFile == "") != (transportConfig.KeyFile == "") {
+		return nil, errors.New("a client certificate needs both cert_file and key_file")
+	}
+	if transportConfig.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(transportConfig.CertFile, transportConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func secondsOrDefault(seconds int, defaultDuration time.Duration) time.Duration {
+	if seconds <= 0 {
+		return defaultDuration
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,187 @@
+package delivery
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"rq/config"
+	"rq/files"
+	"rq/records"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes a self-signed certificate for commonName and its key to dir, returning their paths
+func writeKeyPair(t *testing.T, dir string, commonName string) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certFile, keyFile := filepath.Join(dir, commonName+".crt"), filepath.Join(dir, commonName+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestSendDestinationTLS(t *testing.T) {
+	var gotClientCert string
+	api := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotClientCert = ""
+		if len(req.TLS.PeerCertificates) > 0 {
+			gotClientCert = req.TLS.PeerCertificates[0].Subject.CommonName
+		}
+	}))
+	api.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	api.StartTLS()
+	defer api.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: api.Certificate().Raw}), 0600)
+	certFile, keyFile := writeKeyPair(t, dir, "rq-device")
+
+	withUrlPolicy(t, config.RqUrlPolicyConfig{AllowedHosts: []string{"127.0.0.1/32"}})
+	defer func() { config.Config.Destinations = nil }()
+	store, _ := files.NewInMemoryFileStore()
+
+	tests := []struct {
+		name           string
+		transport      *config.RqTransportConfig
+		wantErr        bool
+		wantClientCert string
+	}{
+		{name: "untrusted private CA", wantErr: true},
+		{name: "private CA", transport: &config.RqTransportConfig{CAFile: caFile}},
+		{name: "client certificate", transport: &config.RqTransportConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, wantClientCert: "rq-device"},
+		{name: "tls 1.3", transport: &config.RqTransportConfig{CAFile: caFile, MinTLSVersion: "1.3"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config.Config.Destinations = map[string]config.RqDestinationConfig{"127.0.0.1": {Transport: test.transport}}
+			sender, err := NewSender(store)
+			if err != nil {
+				t.Fatalf("NewSender() error = %v", err)
+			}
+
+			resp, err := sender.Send(context.Background(), records.RqRecord{Method: "GET", Url: api.URL})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Send() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			resp.Body.Close()
+			if gotClientCert != test.wantClientCert {
+				t.Errorf("client certificate = %q, want %q", gotClientCert, test.wantClientCert)
+			}
+		})
+	}
+}
+
+func TestSendThroughProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proxied = append(proxied, req.URL.String())
+		if req.URL.Path == "/redirect" {
+			http.Redirect(w, req, "http://localhost/admin", http.StatusFound)
+		}
+	}))
+	defer proxy.Close()
+
+	previous := config.Config.Transport
+	config.Config.Transport = config.RqTransportConfig{Proxy: proxy.URL}
+	defer func() { config.Config.Transport = previous }()
+	// Hosts the proxy resolves must be named, as they may not resolve locally
+	withUrlPolicy(t, config.RqUrlPolicyConfig{AllowedHosts: []string{"api.example.com", "localhost"}})
+
+	store, _ := files.NewInMemoryFileStore()
+	sender, err := NewSender(store)
+	if err != nil {
+		t.Fatalf("NewSender() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		url         string
+		wantErr     bool
+		wantProxied []string
+	}{
+		{name: "sent through the proxy", url: "http://api.example.com/hooks", wantProxied: []string{"http://api.example.com/hooks"}},
+		{name: "host resolving to loopback", url: "http://localhost:8080/admin", wantErr: true},
+		{name: "host not named in the allowed hosts", url: "http://hooks.example.org/", wantErr: true},
+		{name: "redirect to loopback", url: "http://api.example.com/redirect", wantErr: true, wantProxied: []string{"http://api.example.com/redirect"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxied = nil
+			resp, err := sender.Send(context.Background(), records.RqRecord{Method: "GET", Url: test.url})
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Send() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrUrlNotAllowed) {
+				t.Errorf("Send() error = %v, want ErrUrlNotAllowed", err)
+			}
+			if len(proxied) != len(test.wantProxied) || (len(proxied) > 0 && proxied[0] != test.wantProxied[0]) {
+				t.Errorf("proxied %v, want %v", proxied, test.wantProxied)
+			}
+		})
+	}
+}
+
+func TestNewClientDefaultTimeouts(t *testing.T) {
+	client, err := newClient(nil, config.RqTransportConfig{})
+	if err != nil {
+		t.Fatalf("newClient() error = %v", err)
+	}
+	transport := client.Transport.(*http.Transport)
+
+	if client.Timeout != defaultTimeout {
+		t.Errorf("newClient() timeout = %v, want %v", client.Timeout, defaultTimeout)
+	}
+	if transport.ResponseHeaderTimeout != defaultResponseHeaderTimeout {
+		t.Errorf("newClient() response header timeout = %v, want %v", transport.ResponseHeaderTimeout, defaultResponseHeaderTimeout)
+	}
+	if transport.TLSHandshakeTimeout != defaultTLSHandshakeTimeout {
+		t.Errorf("newClient() TLS handshake timeout = %v, want %v", transport.TLSHandshakeTimeout, defaultTLSHandshakeTimeout)
+	}
+}
+
+func TestNewClientInvalidConfig(t *testing.T) {
+	tests := []config.RqTransportConfig{
+		{MinTLSVersion: "1.0"},
+		{Proxy: "ftp://proxy.example.com"},
+		{CAFile: "/does/not/exist.pem"},
+		{CertFile: "client.crt"},
+	}
+	for _, transportConfig := range tests {
+		if _, err := newClient(nil, transportConfig); err == nil {
+			t.Errorf("newClient(%+v) returned no error", transportConfig)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"rq/config"
+	"strings"
+	"time"
+)
+
+// defaultMaxRedirects is the number of redirects followed if none is configured, matching net/http
+const defaultMaxRedirects = 10
+
+// lookupTimeout limits how long a URL's host is resolved for where it is not resolved to connect to it, when a
+// request is enqueued while the device may be offline, or sent through a proxy
+const lookupTimeout = 2 * time.Second
+
+// ErrUrlNotAllowed is returned when a URL or the address it resolves to is not permitted by the UrlPolicy
+var ErrUrlNotAllowed = errors.New("url not allowed")
+
+// privateRanges are the address ranges which are denied by default, as they reach the device or its local network
+// rather than the internet. NAT64 ranges are included, as they can embed any IPv4 address, including private ones.
+var privateRanges = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// hostRules matches hosts against hostnames, wildcard domains and address ranges
+type hostRules struct {
+	hostnames map[string]bool
+	wildcards []string
+	prefixes  []netip.Prefix
+}
+
+// UrlPolicy checks the URLs requests are sent to against the schemes and hosts allowed in config. URLs are checked
+// when a request is enqueued, and again when it is sent, where every address a host resolves to is checked before
+// connecting, and every redirect is checked before it is followed.
+type UrlPolicy struct {
+	schemes      map[string]bool
+	allowed      hostRules
+	denied       hostRules
+	allowPrivate bool
+	maxRedirects int
+	resolver     *net.Resolver
+}
+
+// NewUrlPolicy returns a UrlPolicy from its config.
+func NewUrlPolicy(policyConfig config.RqUrlPolicyConfig) (*UrlPolicy, error) {
+	schemes := policyConfig.AllowedSchemes
+	if len(schemes) == 0 {
+		schemes = []string{"https", "http"}
+	}
+
+	policy := &UrlPolicy{
+		schemes:      map[string]bool{},
+		allowPrivate: policyConfig.AllowPrivateNetworks,
+		maxRedirects: policyConfig.MaxRedirects,
+		resolver:     net.DefaultResolver,
+	}
+	for _, scheme := range schemes {
+		scheme = strings.ToLower(scheme)
+		if scheme != "https" && scheme != "http" {
+			return nil, fmt.Errorf("unsupported scheme in url policy: %v", scheme)
+		}
+		policy.schemes[scheme] = true
+	}
+	if policy.maxRedirects == 0 {
+		policy.maxRedirects = defaultMaxRedirects
+	}
+
+	var err error
+	if policy.allowed, err = parseHostRules(policyConfig.AllowedHosts); err != nil {
+		return nil, err
+	}
+	if policy.denied, err = parseHostRules(policyConfig.DeniedHosts); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// CheckEnqueue checks rawUrl when a request is enqueued. The host is resolved if possible, but as the device may be
+// offline, a failed lookup is not an error; the host is checked again when the request is sent.
+func (p *UrlPolicy) CheckEnqueue(ctx context.Context, rawUrl string) error {
+	dst, err := url.Parse(rawUrl)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUrlNotAllowed, err)
+	}
+	if err := p.CheckUrl(dst); err != nil {
+		return err
+	}
+
+	addrs, err := p.lookup(ctx, dst.Hostname())
+	if err != nil {
+		return nil
+	}
+	return p.checkAddrs(dst.Hostname(), addrs)
+}
+
+// CheckResolved checks dst, and the addresses its host resolves to. It is used where the connection is made
+// elsewhere, such as by a proxy. A host which cannot be resolved locally is refused, as where it leads cannot be
+// checked, unless it is named in the allowed hosts.
+func (p *UrlPolicy) CheckResolved(ctx context.Context, dst *url.URL) error {
+	if err := p.CheckUrl(dst); err != nil {
+		return err
+	}
+
+	host := dst.Hostname()
+	addrs, err := p.lookup(ctx, host)
+	if err != nil {
+		if p.allowed.matchesHostname(strings.ToLower(strings.TrimSuffix(host, "."))) {
+			return nil
+		}
+		return fmt.Errorf("%w: host %v could not be resolved: %v", ErrUrlNotAllowed, host, err)
+	}
+	return p.checkAddrs(host, addrs)
+}
+
+// lookup resolves host, or returns its address if it is an IP address
+func (p *UrlPolicy) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+	return p.resolver.LookupNetIP(ctx, "ip", host)
+}
+
+// CheckUrl checks the scheme and host of dst, without resolving the host.
+func (p *UrlPolicy) CheckUrl(dst *url.URL) error {
+	if !p.schemes[strings.ToLower(dst.Scheme)] {
+		return fmt.Errorf("%w: scheme %q is not allowed", ErrUrlNotAllowed, dst.Scheme)
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(dst.Hostname(), "."))
+	if host == "" {
+		return fmt.Errorf("%w: no host", ErrUrlNotAllowed)
+	}
+	if dst.User != nil {
+		return fmt.Errorf("%w: credentials in url", ErrUrlNotAllowed)
+	}
+	if p.denied.matchesHostname(host) {
+		return fmt.Errorf("%w: host %v is denied", ErrUrlNotAllowed, host)
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return p.checkAddrs(host, []netip.Addr{addr})
+	}
+
+	// Hosts not allowed by name can only be allowed by the range they resolve to
+	if p.allowed.any() && !p.allowed.matchesHostname(host) && len(p.allowed.prefixes) == 0 {
+		return fmt.Errorf("%w: host %v is not in the allowed hosts", ErrUrlNotAllowed, host)
+	}
+	return nil
+}
+
+// CheckRedirect checks each redirect before it is followed, for use as an http.Client's CheckRedirect.
+func (p *UrlPolicy) CheckRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= p.maxRedirects {
+		return fmt.Errorf("stopped after %v redirects", p.maxRedirects)
+	}
+	if err := p.CheckUrl(req.URL); err != nil {
+		return fmt.Errorf("redirect to %v: %w", req.URL.Redacted(), err)
+	}
+	return nil
+}
+
+// DialContext returns a dial function which resolves the host itself and only connects to permitted addresses, so a
+// host cannot pass the check and then resolve somewhere else when connected to.
+func (p *UrlPolicy) DialContext(dialer *net.Dialer) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		addrs := []netip.Addr{}
+		if addr, err := netip.ParseAddr(host); err == nil {
+			addrs = append(addrs, addr)
+		} else if addrs, err = p.resolver.LookupNetIP(ctx, "ip", host); err != nil {
+			return nil, err
+		}
+		if err := p.checkAddrs(host, addrs); err != nil {
+			return nil, err
+		}
+
+		var dialErr error
+		for _, addr := range addrs {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			dialErr = err
+		}
+		return nil, dialErr
+	}
+}
+
+// checkAddrs checks every address host resolves to is permitted
+func (p *UrlPolicy) checkAddrs(host string, addrs []netip.Addr) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if len(addrs) == 0 {
+		return fmt.Errorf("%w: host %v has no addresses", ErrUrlNotAllowed, host)
+	}
+
+	allowedByName := p.allowed.matchesHostname(host)
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if p.denied.matchesAddr(addr) {
+			return fmt.Errorf("%w: %v resolves to denied address %v", ErrUrlNotAllowed, host, addr)
+		}
+
+		allowedByAddr := p.allowed.matchesAddr(addr)
+		if p.allowed.any() && !allowedByName && !allowedByAddr {
+			return fmt.Errorf("%w: host %v is not in the allowed hosts", ErrUrlNotAllowed, host)
+		}
+		if isPrivate(addr) && !p.allowPrivate && !allowedByAddr {
+			return fmt.Errorf("%w: %v resolves to private address %v", ErrUrlNotAllowed, host, addr)
+		}
+	}
+	return nil
+}
+
+func isPrivate(addr netip.Addr) bool {
+	for _, prefix := range privateRanges {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseHostRules(hosts []string) (hostRules, error) {
+	rules := hostRules{hostnames: map[string]bool{}}
+	for _, host := range hosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		switch {
+		case host == "":
+		case strings.HasPrefix(host, "*."):
+			rules.wildcards = append(rules.wildcards, host[1:])
+		case strings.Contains(host, "/"):
+			prefix, err := netip.ParsePrefix(host)
+			if err != nil {
+				return hostRules{}, fmt.Errorf("invalid range in url policy: %w", err)
+			}
+			rules.prefixes = append(rules.prefixes, prefix.Masked())
+		default:
+			if addr, err := netip.ParseAddr(host); err == nil {
+				rules.prefixes = append(rules.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			} else {
+				rules.hostnames[host] = true
+			}
+		}
+	}
+	return rules, nil
+}
+
+func (hr hostRules) any() bool {
+	return len(hr.hostnames) > 0 || len(hr.wildcards) > 0 || len(hr.prefixes) > 0
+}
+
+func (hr hostRules) matchesHostname(host string) bool {
+	if hr.hostnames[host] {
+		return true
+	}
+	for _, suffix := range hr.wildcards {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (hr hostRules) matchesAddr(addr netip.Addr) bool {
+	for _, prefix := range hr.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"rq/config"
+	"rq/delivery"
+	"rq/logging"
+	"rq/records"
+	"time"
+)
+
+const (
+	defaultDeliveryInterval   = 10 * time.Second
+	defaultDeliveryBatchSize  = 100
+	defaultDeliveryMaxBackoff = time.Hour
+)
+
+// Dispatcher sends queued records to their destinations, oldest first. Records which are delivered are removed with
+// their files, and records which are rejected are marked as failed, so they are kept until retried or cancelled.
+// Records which can't be sent for now, because the destination can't be reached, are left queued to be tried again
+// after a backoff.
+type Dispatcher struct {
+	Records *RecordServer
+	Sender  *delivery.Sender
+}
+
+// Run sends queued records every delivery interval until ctx is cancelled. A pass which sends a full batch is followed
+// straight away by another, so a backlog is cleared without waiting for each interval.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(deliveryInterval())
+	defer ticker.Stop()
+
+	for {
+		sent, err := d.Dispatch(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "error reading queued records", "error", err)
+		}
+		if err == nil && sent >= deliveryBatchSize() {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Dispatch makes a single pass over the queue, attempting up to a batch of the records due to be sent, and returns
+// the number of records taken off the queue, either because they were delivered or because they failed. Once a
+// destination is found to be unavailable, its remaining records are left until the next pass, and the queue is read
+// past them, so they don't hold up records for other destinations.
+func (d *Dispatcher) Dispatch(ctx context.Context) (int, error) {
+	batchSize := deliveryBatchSize()
+	dispatched, attempted := 0, 0
+	seen := map[string]bool{}
+	unavailable := map[string]bool{}
+	skipHosts := []string{}
+
+	for attempted < batchSize && ctx.Err() == nil {
+		ids, err := d.Records.Store.QueuedIds(time.Now(), skipHosts, batchSize-attempted)
+		if err != nil {
+			return dispatched, err
+		}
+
+		read := 0
+		for _, id := range ids {
+			if ctx.Err() != nil {
+				break
+			}
+			// Records stored without a host are not left out of the next read, so are only read once a pass
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			read++
+
+			record, err := d.Records.Store.Get(id)
+			if errors.Is(err, records.ErrNotFound) {
+				// Cancelled since the queue was read
+				continue
+			}
+			if err != nil {
+				slog.ErrorContext(ctx, "error reading queued record", "rqid", id, "error", err)
+				d.fail(ctx, id, err.Error())
+				dispatched++
+				continue
+			}
+
+			host := urlHost(record.Url)
+			if unavailable[host] {
+				continue
+			}
+			attempted++
+			recordCtx := logging.WithTenant(logging.WithRequest(ctx, record.Id, record.Method, host), record.Tenant)
+			switch d.send(recordCtx, *record) {
+			case deliveryDelivered, deliveryFailed:
+				dispatched++
+			case deliveryDeferred:
+				unavailable[host] = true
+				skipHosts = append(skipHosts, host)
+			}
+		}
+		if read == 0 {
+			break
+		}
+	}
+	return dispatched, nil
+}
+
+// deliveryOutcome is the result of attempting to send a record
+type deliveryOutcome int
+
+const (
+	deliveryDelivered deliveryOutcome = iota
+	deliveryFailed
+	deliveryDeferred
+)
+
+// send makes the onward request for record, removing it if it is delivered, leaving it to be retried if the
+// destination can't be reached, and otherwise marking it as failed
+func (d *Dispatcher) send(ctx context.Context, record records.RqRecord) deliveryOutcome {
+	resp, err := d.Sender.Send(ctx, record)
+	if err != nil {
+		if ctx.Err() != nil {
+			// Stopped rather than failed, so the attempt isn't counted
+			return deliveryDeferred
+		}
+		if retryableDeliveryError(err) {
+			slog.WarnContext(ctx, "destination unavailable, record left queued", "error", err)
+			return d.retry(ctx, record, err.Error())
+		}
+		slog.WarnContext(ctx, "record could not be sent", "error", err)
+		d.fail(ctx, record.Id, err.Error())
+		return deliveryFailed
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		d.remove(ctx, record)
+		return deliveryDelivered
+	case retryableStatus(resp.StatusCode):
+		slog.WarnContext(ctx, "destination unavailable, record left queued", "status", resp.StatusCode)
+		return d.retry(ctx, record, resp.Status)
+	default:
+		slog.WarnContext(ctx, "record rejected by destination", "status", resp.StatusCode)
+		d.fail(ctx, record.Id, resp.Status)
+		return deliveryFailed
+	}
+}
+
+// retry leaves record queued, to be sent again once a backoff which doubles with each attempt has passed, unless it
+// has been attempted max_attempts times, when it is failed. Either way its destination is unavailable, so the outcome
+// is deferred.
+func (d *Dispatcher) retry(ctx context.Context, record records.RqRecord, reason string) deliveryOutcome {
+	attempts := record.Attempts + 1
+	if maxAttempts := config.Config.Delivery.MaxAttempts; maxAttempts > 0 && attempts >= maxAttempts {
+		d.fail(ctx, record.Id, fmt.Sprintf("gave up after %v attempts: %v", attempts, reason))
+		return deliveryDeferred
+	}
+
+	if err := d.Records.Store.Defer(record.Id, time.Now().Add(retryBackoff(attempts))); err != nil && !errors.Is(err, records.ErrNotFound) {
+		slog.ErrorContext(ctx, "error deferring record", "error", err)
+	}
+	return deliveryDeferred
+}
+
+// remove deletes a delivered record, and then the files uploaded with it
+func (d *Dispatcher) remove(ctx context.Context, record records.RqRecord) {
+	if err := d.Records.Store.Delete(record.Id); err != nil && !errors.Is(err, records.ErrNotFound) {
+		slog.ErrorContext(ctx, "error removing delivered record", "error", err)
+		return
+	}
+	storedFiles, _ := record.GetFiles()
+	for _, storedFile := range storedFiles {
+		if err := d.Records.FileStore.Delete(storedFile.Filename); err != nil {
+			slog.ErrorContext(ctx, "error removing file of delivered record", "file", storedFile.Filename, "error", err)
+		}
+	}
+	slog.InfoContext(ctx, "record delivered")
+}
+
+// fail records why a record could not be sent, so it is kept for the admin dashboard rather than sent again
+func (d *Dispatcher) fail(ctx context.Context, id string, reason string) {
+	if err := d.Records.Store.Fail(id, reason); err != nil && !errors.Is(err, records.ErrNotFound) {
+		slog.ErrorContext(ctx, "error marking record as failed", "rqid", id, "error", err)
+	}
+}
+
+// retryableDeliveryError reports whether err means the destination could not be reached for now, because connecting
+// to it failed or timed out, rather than that the record can't be sent as it is. Anything else, such as a file which
+// is missing or can't be transformed, would fail again however often it was retried.
+func retryableDeliveryError(err error) bool {
+	// The client wraps every error in a url.Error, which is itself a net.Error, so only the error it wraps is checked
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	if errors.Is(err, delivery.ErrUrlNotAllowed) {
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryableStatus reports whether a response with status means the destination is unavailable for now
+func retryableStatus(status int) bool {
+	return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+}
+
+// retryBackoff returns how long a record is left before it is sent again, after it has been attempted attempts times
+func retryBackoff(attempts int) time.Duration {
+	maxBackoff := time.Duration(config.Config.Delivery.MaxBackoffSeconds) * time.Second
+	if maxBackoff <= 0 {
+		maxBackoff = defaultDeliveryMaxBackoff
+	}
+
+	backoff := deliveryInterval()
+	for i := 1; i < attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff)
+}
+
+// deliveryInterval returns how often the queue is checked for records to send
+func deliveryInterval() time.Duration {
+	if interval := time.Duration(config.Config.Delivery.IntervalSeconds) * time.Second; interval > 0 {
+		return interval
+	}
+	return defaultDeliveryInterval
+}
+
+// deliveryBatchSize returns the most records sent in a single pass
+func deliveryBatchSize() int {
+	if size := config.Config.Delivery.BatchSize; size > 0 {
+		return size
+	}
+	return defaultDeliveryBatchSize
+}
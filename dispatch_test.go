@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"rq/config"
+	"rq/delivery"
+	"rq/files"
+	"rq/records"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDispatcher_Dispatch(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.UrlPolicy = config.RqUrlPolicyConfig{AllowedHosts: []string{"127.0.0.1/32"}}
+	config.Config.Delivery = config.RqDeliveryConfig{BatchSize: 10}
+
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/ok":
+			w.WriteHeader(http.StatusOK)
+		case "/rejected":
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer destination.Close()
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	tests := []struct {
+		name         string
+		url          string
+		credential   string
+		payload      string
+		withFile     bool
+		attempts     int
+		maxAttempts  int
+		wantStatus   string
+		wantError    string
+		wantAttempts int
+	}{
+		{name: "delivered", url: destination.URL + "/ok", withFile: true},
+		{name: "rejected", url: destination.URL + "/rejected", wantStatus: records.StatusFailed, wantError: "400 Bad Request"},
+		{name: "unavailable", url: destination.URL + "/unavailable", wantStatus: records.StatusQueued, wantAttempts: 1},
+		{name: "unreachable", url: unreachable.URL, wantStatus: records.StatusQueued, wantAttempts: 1},
+		{name: "unavailable after max attempts", url: destination.URL + "/unavailable", attempts: 2, maxAttempts: 3, wantStatus: records.StatusFailed, wantError: "gave up after 3 attempts", wantAttempts: 2},
+		{name: "unknown credential", url: destination.URL + "/ok", credential: "missing", wantStatus: records.StatusFailed, wantError: "unknown credential"},
+		{name: "missing file", url: destination.URL + "/ok", withFile: true, wantStatus: records.StatusFailed, wantError: "file not found"},
+		{name: "invalid payload", url: destination.URL + "/ok", payload: "not json", wantStatus: records.StatusFailed, wantError: "invalid character"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config.Config.Delivery.MaxAttempts = test.maxAttempts
+			store := &MockMemoryRecordStore{db: make(map[string]records.RqRecord)}
+			fileStore, _ := files.NewInMemoryFileStore()
+			sender, err := delivery.NewSender(fileStore)
+			if err != nil {
+				t.Fatalf("NewSender() error = %v", err)
+			}
+
+			record := records.RqRecord{
+				Id:         "record",
+				Method:     http.MethodPost,
+				Url:        test.url,
+				Host:       urlHost(test.url),
+				Credential: test.credential,
+				Attempts:   test.attempts,
+				CreatedAt:  time.Now(),
+			}
+			if test.payload != "" {
+				record.Payload = json.RawMessage(test.payload)
+			}
+			if test.withFile {
+				record.SetFiles(map[string]records.RqFile{"photo": {Filename: "photo.jpg", Size: 4}})
+				if test.wantError == "" {
+					fileStore.Save("photo.jpg", strings.NewReader("jpeg"))
+				}
+			}
+			store.Add(record)
+
+			dispatcher := &Dispatcher{Records: &RecordServer{Store: store, FileStore: fileStore}, Sender: sender}
+			if _, err := dispatcher.Dispatch(context.Background()); err != nil {
+				t.Fatalf("Dispatch() error = %v", err)
+			}
+
+			stored, err := store.Get(record.Id)
+			if test.wantStatus == "" {
+				if err == nil {
+					t.Errorf("Dispatch() kept delivered record")
+				}
+				if _, err := fileStore.Stat("photo.jpg"); err == nil {
+					t.Errorf("Dispatch() kept file of delivered record")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Dispatch() removed record, want status %v", test.wantStatus)
+			}
+			if stored.Status() != test.wantStatus {
+				t.Errorf("Dispatch() status = %v, want %v", stored.Status(), test.wantStatus)
+			}
+			if !strings.Contains(stored.Error, test.wantError) {
+				t.Errorf("Dispatch() error = %q, want it to contain %q", stored.Error, test.wantError)
+			}
+			if stored.Attempts != test.wantAttempts {
+				t.Errorf("Dispatch() attempts = %v, want %v", stored.Attempts, test.wantAttempts)
+			}
+			if test.wantStatus == records.StatusQueued && !stored.NextAttemptAt.After(time.Now()) {
+				t.Errorf("Dispatch() next attempt = %v, want it backed off", stored.NextAttemptAt)
+			}
+		})
+	}
+}
+
+func TestDispatcher_DispatchSkipsUnavailableHosts(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.UrlPolicy = config.RqUrlPolicyConfig{AllowedHosts: []string{"127.0.0.1/32", "::1/128"}}
+	config.Config.Delivery = config.RqDeliveryConfig{BatchSize: 2}
+
+	attempts := 0
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer unavailable.Close()
+	available := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer available.Close()
+	// Reached by another name, so it is a different host to the unavailable destination
+	availableUrl := strings.Replace(available.URL, "127.0.0.1", "localhost", 1)
+
+	store := &MockMemoryRecordStore{db: make(map[string]records.RqRecord)}
+	fileStore, _ := files.NewInMemoryFileStore()
+	sender, _ := delivery.NewSender(fileStore)
+	now := time.Now()
+	for i, id := range []string{"first", "second", "third", "available"} {
+		url := unavailable.URL
+		if id == "available" {
+			url = availableUrl
+		}
+		store.Add(records.RqRecord{Id: id, Method: http.MethodPost, Url: url, Host: urlHost(url), CreatedAt: now.Add(time.Duration(i) * time.Second)})
+	}
+
+	dispatcher := &Dispatcher{Records: &RecordServer{Store: store, FileStore: fileStore}, Sender: sender}
+	dispatched, err := dispatcher.Dispatch(context.Background())
+	if err != nil {
+		t.Fatalf("Dispatch() error = %v", err)
+	}
+	if dispatched != 1 || attempts != 1 {
+		t.Errorf("Dispatch() dispatched = %v with %v attempts, want 1 with 1", dispatched, attempts)
+	}
+	if _, err := store.Get("available"); err == nil {
+		t.Errorf("Dispatch() did not send the record queued behind the unavailable destination")
+	}
+	if count, _ := store.Count(); count != 3 {
+		t.Errorf("Dispatch() left %v records, want 3", count)
+	}
+
+	// The record attempted is backed off, so the next pass tries the destination with the next record
+	if _, err := dispatcher.Dispatch(context.Background()); err != nil {
+		t.Fatalf("Dispatch() error = %v", err)
+	}
+	first, _ := store.Get("first")
+	second, _ := store.Get("second")
+	if first.Attempts != 1 || second.Attempts != 1 || attempts != 2 {
+		t.Errorf("Dispatch() attempts = %v and %v, with %v sent, want 1 and 1 with 2", first.Attempts, second.Attempts, attempts)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.Delivery = config.RqDeliveryConfig{IntervalSeconds: 10, MaxBackoffSeconds: 60}
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: 10 * time.Second},
+		{attempts: 2, want: 20 * time.Second},
+		{attempts: 3, want: 40 * time.Second},
+		{attempts: 4, want: time.Minute},
+		{attempts: 100, want: time.Minute},
+	}
+
+	for _, test := range tests {
+		if got := retryBackoff(test.attempts); got != test.want {
+			t.Errorf("retryBackoff(%v) = %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
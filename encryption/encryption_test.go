@@ -0,0 +1,159 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"rq/config"
+	"strings"
+	"testing"
+)
+
+func testKey(t *testing.T, id string) string {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(key)
+}
+
+func TestParseKeyring(t *testing.T) {
+	short := "short:" + base64.StdEncoding.EncodeToString([]byte("too short"))
+
+	tests := []struct {
+		name          string
+		spec          string
+		wantCurrentId string
+		wantErr       bool
+	}{
+		{name: "single key", spec: testKey(t, "k1"), wantCurrentId: "k1"},
+		{name: "comma separated, first is current", spec: testKey(t, "k2") + "," + testKey(t, "k1"), wantCurrentId: "k2"},
+		{name: "lines with comments", spec: "# rotated 2026-10\n" + testKey(t, "k2") + "\n" + testKey(t, "k1") + "\n", wantCurrentId: "k2"},
+		{name: "empty", spec: "", wantErr: true},
+		{name: "missing id", spec: "bm90IGEga2V5", wantErr: true},
+		{name: "invalid base64", spec: "k1:not base64!", wantErr: true},
+		{name: "wrong key size", spec: short, wantErr: true},
+		{name: "duplicate id", spec: testKey(t, "k1") + "," + testKey(t, "k1"), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keyring, err := ParseKeyring(test.spec)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseKeyring() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err == nil && keyring.CurrentKeyId() != test.wantCurrentId {
+				t.Errorf("CurrentKeyId() = %v, want %v", keyring.CurrentKeyId(), test.wantCurrentId)
+			}
+		})
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(keyFile, []byte(testKey(t, "file-key")), 0600)
+	t.Setenv("RQ_TEST_KEYS", testKey(t, "env-key"))
+
+	keyring, err := LoadKeyring(config.RqEncryptionConfig{KeyFile: keyFile, KeyEnv: "RQ_TEST_KEYS"})
+	if err != nil || keyring.CurrentKeyId() != "file-key" {
+		t.Errorf("LoadKeyring() with a key file = %v, %v, want file-key", keyring, err)
+	}
+
+	keyring, err = LoadKeyring(config.RqEncryptionConfig{KeyEnv: "RQ_TEST_KEYS"})
+	if err != nil || keyring.CurrentKeyId() != "env-key" {
+		t.Errorf("LoadKeyring() with an env var = %v, %v, want env-key", keyring, err)
+	}
+
+	if _, err := LoadKeyring(config.RqEncryptionConfig{KeyEnv: "RQ_TEST_KEYS_UNSET"}); err == nil {
+		t.Error("LoadKeyring() with an unset env var returned no error")
+	}
+}
+
+func TestDataKeyRotation(t *testing.T) {
+	oldKey := testKey(t, "k1")
+	oldKeyring, _ := ParseKeyring(oldKey)
+	dataKey, keyId, wrapped, err := oldKeyring.NewDataKey()
+	if err != nil || keyId != "k1" {
+		t.Fatalf("NewDataKey() = %v, %v", keyId, err)
+	}
+
+	rotated, _ := ParseKeyring(testKey(t, "k2") + "," + oldKey)
+	unwrapped, err := rotated.UnwrapDataKey(keyId, wrapped)
+	if err != nil || !bytes.Equal(unwrapped, dataKey) {
+		t.Errorf("UnwrapDataKey() with the old key kept = %v", err)
+	}
+
+	removed, _ := ParseKeyring(testKey(t, "k2"))
+	if _, err := removed.UnwrapDataKey(keyId, wrapped); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("UnwrapDataKey() with the old key removed error = %v, want %v", err, ErrUnknownKey)
+	}
+
+	ciphertext, _ := Seal(dataKey, []byte("secret"))
+	ciphertext[len(ciphertext)-1] ^= 1
+	if _, err := Open(dataKey, ciphertext); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Open() of tampered ciphertext error = %v, want %v", err, ErrDecryptionFailed)
+	}
+}
+
+func TestStream(t *testing.T) {
+	keyring, _ := ParseKeyring(testKey(t, "k1"))
+
+	sizes := []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 100}
+	for _, size := range sizes {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		encrypted := &bytes.Buffer{}
+		writer, err := keyring.NewEncryptWriter(encrypted)
+		if err != nil {
+			t.Fatalf("NewEncryptWriter() error = %v", err)
+		}
+		writer.Write(plaintext)
+		writer.Close()
+
+		if bytes.Contains(encrypted.Bytes(), plaintext) && size > 0 {
+			t.Errorf("size %v: encrypted stream contains the plaintext", size)
+		}
+
+		header, isEncrypted, err := ReadHeader(bytes.NewReader(encrypted.Bytes()))
+		if err != nil || !isEncrypted || header.KeyId != "k1" {
+			t.Errorf("size %v: ReadHeader() = %+v, %v, %v", size, header, isEncrypted, err)
+		}
+		if got := PlaintextSize(header, int64(encrypted.Len())); got != int64(size) {
+			t.Errorf("size %v: PlaintextSize() = %v", size, got)
+		}
+
+		reader, keyId, err := keyring.NewDecryptReader(bytes.NewReader(encrypted.Bytes()))
+		if err != nil || keyId != "k1" {
+			t.Fatalf("size %v: NewDecryptReader() = %v, %v", size, keyId, err)
+		}
+		if decrypted, err := io.ReadAll(reader); err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("size %v: decrypted stream does not match, error = %v", size, err)
+		}
+
+		// Dropping the final chunk must be detected
+		if size > chunkSize {
+			truncated := encrypted.Bytes()[:encrypted.Len()-(size%chunkSize+gcmOverhead)]
+			reader, _, _ := keyring.NewDecryptReader(bytes.NewReader(truncated))
+			if _, err := io.ReadAll(reader); !errors.Is(err, ErrDecryptionFailed) {
+				t.Errorf("size %v: reading truncated stream error = %v, want %v", size, err, ErrDecryptionFailed)
+			}
+		}
+	}
+}
+
+func TestStreamUnencrypted(t *testing.T) {
+	keyring, _ := ParseKeyring(testKey(t, "k1"))
+
+	reader, keyId, err := keyring.NewDecryptReader(strings.NewReader("saved before encryption"))
+	if err != nil || keyId != "" {
+		t.Fatalf("NewDecryptReader() = %v, %v", keyId, err)
+	}
+	if contents, _ := io.ReadAll(reader); string(contents) != "saved before encryption" {
+		t.Errorf("NewDecryptReader() contents = %q", contents)
+	}
+}
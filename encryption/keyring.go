@@ -0,0 +1,163 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"rq/config"
+	"strings"
+)
+
+// KeySize is the size in bytes of master and data keys, for AES-256
+const KeySize = 32
+
+// DefaultKeyEnv is the environment variable keys are read from when neither a key file nor variable is configured
+const DefaultKeyEnv = "RQ_ENCRYPTION_KEYS"
+
+var (
+	// ErrUnknownKey is returned when data was encrypted with a key which is not in the Keyring
+	ErrUnknownKey = errors.New("unknown encryption key")
+	// ErrDecryptionFailed is returned when encrypted data cannot be decrypted, as it is corrupt or the key is wrong
+	ErrDecryptionFailed = errors.New("decryption failed")
+)
+
+// Keyring holds the master keys which encrypt the data key of each record and file. The first key is used to
+// encrypt new data, and the others are kept to decrypt data encrypted before a key rotation.
+type Keyring struct {
+	currentId string
+	keys      map[string][]byte
+}
+
+// LoadKeyring reads the Keyring from the configured key file, or otherwise the configured environment variable.
+func LoadKeyring(encryptionConfig config.RqEncryptionConfig) (*Keyring, error) {
+	if encryptionConfig.KeyFile != "" {
+		contents, err := os.ReadFile(encryptionConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading key file: %w", err)
+		}
+		return ParseKeyring(string(contents))
+	}
+
+	keyEnv := encryptionConfig.KeyEnv
+	if keyEnv == "" {
+		keyEnv = DefaultKeyEnv
+	}
+	spec, ok := os.LookupEnv(keyEnv)
+	if !ok {
+		return nil, fmt.Errorf("no encryption key file configured and %v is not set", keyEnv)
+	}
+	return ParseKeyring(spec)
+}
+
+// ParseKeyring returns a Keyring from a list of "{id}:{base64 key}" entries separated by commas or new lines. Each
+// key must be 32 bytes. The first entry is the current key.
+func ParseKeyring(spec string) (*Keyring, error) {
+	keyring := &Keyring{keys: map[string][]byte{}}
+
+	entries := strings.FieldsFunc(spec, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	})
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		id, encoded, found := strings.Cut(entry, ":")
+		if !found || id == "" || len(id) > 255 {
+			return nil, errors.New("keys must be in the form {id}:{base64 key}, with an id of up to 255 characters")
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %v is not valid base64: %w", id, err)
+		}
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("key %v is %v bytes, must be %v", id, len(key), KeySize)
+		}
+		if _, exists := keyring.keys[id]; exists {
+			return nil, fmt.Errorf("key %v is listed more than once", id)
+		}
+
+		keyring.keys[id] = key
+		if keyring.currentId == "" {
+			keyring.currentId = id
+		}
+	}
+
+	if keyring.currentId == "" {
+		return nil, errors.New("no encryption keys found")
+	}
+	return keyring, nil
+}
+
+// CurrentKeyId returns the id of the key used to encrypt new data
+func (k *Keyring) CurrentKeyId() string {
+	return k.currentId
+}
+
+// NewDataKey generates a random data key, returning it along with the id of the current master key and the data key
+// encrypted with it, to be stored alongside the data.
+func (k *Keyring) NewDataKey() (dataKey []byte, keyId string, wrapped []byte, err error) {
+	dataKey = make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, "", nil, err
+	}
+
+	wrapped, err = Seal(k.keys[k.currentId], dataKey)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return dataKey, k.currentId, wrapped, nil
+}
+
+// UnwrapDataKey decrypts a data key encrypted with the master key keyId
+func (k *Keyring) UnwrapDataKey(keyId string, wrapped []byte) ([]byte, error) {
+	key, ok := k.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownKey, keyId)
+	}
+	return Open(key, wrapped)
+}
+
+// Seal encrypts plaintext with AES-GCM, returning a random nonce followed by the ciphertext
+func Seal(key []byte, plaintext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Open decrypts ciphertext produced by Seal
+func Open(key []byte, ciphertext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrDecryptionFailed
+	}
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,234 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// chunkSize is the amount of plaintext sealed in each chunk of an encrypted stream, so large files can be encrypted
+// and decrypted without holding them in memory
+const chunkSize = 64 * 1024
+
+// gcmOverhead is the size of the authentication tag added to each sealed chunk
+const gcmOverhead = 16
+
+// streamMagic begins every encrypted stream, to distinguish it from files saved before encryption was enabled
+var streamMagic = []byte("RQE1")
+
+// StreamHeader is written before the encrypted chunks of a stream, identifying the key needed to decrypt it.
+type StreamHeader struct {
+	KeyId      string
+	WrappedKey []byte
+	Length     int64
+}
+
+// NewEncryptWriter writes a stream header to w and returns a writer which encrypts to w with a new data key. The
+// writer must be closed to write the final chunk, without which the stream will not decrypt.
+func (k *Keyring) NewEncryptWriter(w io.Writer) (io.WriteCloser, error) {
+	dataKey, keyId, wrapped, err := k.NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header := &bytes.Buffer{}
+	header.Write(streamMagic)
+	header.WriteByte(byte(len(keyId)))
+	header.WriteString(keyId)
+	binary.Write(header, binary.BigEndian, uint16(len(wrapped)))
+	header.Write(wrapped)
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{w: w, aead: aead, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+// NewDecryptReader reads the stream header from r and returns a reader of the decrypted contents, along with the id
+// of the key the stream was encrypted with. A stream without a header is assumed to have been saved before
+// encryption was enabled, and is returned unaltered with an empty key id.
+func (k *Keyring) NewDecryptReader(r io.Reader) (plaintext io.Reader, keyId string, err error) {
+	buffered := bufio.NewReader(r)
+	header, encrypted, err := readHeader(buffered)
+	if err != nil || !encrypted {
+		return buffered, "", err
+	}
+
+	dataKey, err := k.UnwrapDataKey(header.KeyId, header.WrappedKey)
+	if err != nil {
+		return nil, "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &decryptReader{r: buffered, aead: aead}, header.KeyId, nil
+}
+
+// ReadHeader reads the header of an encrypted stream. If r is not encrypted, encrypted is false.
+func ReadHeader(r io.Reader) (header StreamHeader, encrypted bool, err error) {
+	return readHeader(bufio.NewReader(r))
+}
+
+// PlaintextSize returns the size of the decrypted contents of an encrypted stream of storedSize bytes
+func PlaintextSize(header StreamHeader, storedSize int64) int64 {
+	sealed := storedSize - header.Length
+	sealedChunkSize := int64(chunkSize + gcmOverhead)
+	chunks := max(1, (sealed+sealedChunkSize-1)/sealedChunkSize)
+	return max(0, sealed-chunks*gcmOverhead)
+}
+
+func readHeader(r *bufio.Reader) (StreamHeader, bool, error) {
+	magic, err := r.Peek(len(streamMagic))
+	if err != nil && err != io.EOF {
+		return StreamHeader{}, false, err
+	}
+	if !bytes.Equal(magic, streamMagic) {
+		return StreamHeader{}, false, nil
+	}
+	r.Discard(len(streamMagic))
+
+	keyIdLength, err := r.ReadByte()
+	if err != nil {
+		return StreamHeader{}, true, invalidHeader(err)
+	}
+	keyId := make([]byte, keyIdLength)
+	if _, err := io.ReadFull(r, keyId); err != nil {
+		return StreamHeader{}, true, invalidHeader(err)
+	}
+	var wrappedLength uint16
+	if err := binary.Read(r, binary.BigEndian, &wrappedLength); err != nil {
+		return StreamHeader{}, true, invalidHeader(err)
+	}
+	wrapped := make([]byte, wrappedLength)
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		return StreamHeader{}, true, invalidHeader(err)
+	}
+
+	return StreamHeader{
+		KeyId:      string(keyId),
+		WrappedKey: wrapped,
+		Length:     int64(len(streamMagic) + 1 + len(keyId) + 2 + len(wrapped)),
+	}, true, nil
+}
+
+func invalidHeader(err error) error {
+	return fmt.Errorf("%w: invalid stream header: %v", ErrDecryptionFailed, err)
+}
+
+// chunkNonce returns the nonce for a chunk. As every stream has its own data key, nonces only need to be unique
+// within a stream. The last byte marks the final chunk, so a truncated stream fails to decrypt.
+func chunkNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptWriter seals its input in chunks of chunkSize
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	if ew.closed {
+		return 0, errors.New("write to closed encrypt writer")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only written once more data arrives, as the last chunk must be marked final on Close
+		if len(ew.buf) == chunkSize {
+			if err := ew.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(ew.buf[len(ew.buf):chunkSize], p)
+		ew.buf = ew.buf[:len(ew.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (ew *encryptWriter) Close() error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+	return ew.flush(true)
+}
+
+func (ew *encryptWriter) flush(final bool) error {
+	sealed := ew.aead.Seal(nil, chunkNonce(ew.counter, final), ew.buf, nil)
+	ew.counter++
+	ew.buf = ew.buf[:0]
+	_, err := ew.w.Write(sealed)
+	return err
+}
+
+// decryptReader opens the chunks written by an encryptWriter
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	counter uint64
+	plain   []byte
+	done    bool
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.plain) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		if err := dr.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, dr.plain)
+	dr.plain = dr.plain[n:]
+	return n, nil
+}
+
+func (dr *decryptReader) readChunk() error {
+	sealed := make([]byte, chunkSize+dr.aead.Overhead())
+	n, err := io.ReadFull(dr.r, sealed)
+
+	final := false
+	switch err {
+	case nil:
+		_, peekErr := dr.r.Peek(1)
+		final = peekErr == io.EOF
+	case io.ErrUnexpectedEOF:
+		final = true
+	case io.EOF:
+		return fmt.Errorf("%w: stream is truncated", ErrDecryptionFailed)
+	default:
+		return err
+	}
+
+	plain, err := dr.aead.Open(nil, chunkNonce(dr.counter, final), sealed[:n], nil)
+	if err != nil {
+		return ErrDecryptionFailed
+	}
+	dr.counter++
+	dr.plain = plain
+	dr.done = final
+	return nil
+}
@@ -0,0 +1,209 @@
+package files
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"rq/helpers"
+	"sort"
+	"strings"
+)
+
+// compressedSuffix is appended to the name of files stored compressed by a CompressedFileStore
+const compressedSuffix = ".rqz"
+
+// compressedHeaderLength is the size of the header before the compressed contents, holding the uncompressed size
+const compressedHeaderLength = 8
+
+// CompressedFileStore is a FileStore which gzips files of at least minBytes before saving them to an underlying
+// FileStore. Compressed files are stored with a ".rqz" suffix after an 8 byte header holding their uncompressed
+// size, so files saved before compression was enabled, or below the threshold, are read back unchanged.
+type CompressedFileStore struct {
+	store    FileStore
+	minBytes int64
+}
+
+// NewCompressedFileStore returns a CompressedFileStore which saves files to store, compressing those of at least
+// minBytes with algorithm.
+func NewCompressedFileStore(store FileStore, algorithm string, minBytes int64) (*CompressedFileStore, error) {
+	if algorithm != helpers.CompressionGzip {
+		return nil, fmt.Errorf("%w: %v", helpers.ErrUnsupportedCompression, algorithm)
+	}
+	return &CompressedFileStore{store: store, minBytes: minBytes}, nil
+}
+
+// Save stores contents, compressed if it is at least minBytes long, and returns the checksum of the uncompressed
+// contents.
+func (cfs *CompressedFileStore) Save(filename string, contents io.Reader) (string, error) {
+	hash := sha256.New()
+	contents = io.TeeReader(contents, hash)
+
+	head, err := io.ReadAll(io.LimitReader(contents, cfs.minBytes))
+	if err != nil {
+		return "", fmt.Errorf("error writing file %v: %w", filename, err)
+	}
+
+	if int64(len(head)) < cfs.minBytes {
+		if _, err := cfs.store.Save(filename, bytes.NewReader(head)); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(hash.Sum(nil)), cfs.deleteIfExists(filename + compressedSuffix)
+	}
+
+	// The uncompressed size is written before the compressed contents, so they are spooled to a temporary file first
+	tmp, err := createTempFile()
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	counter := &countingReader{reader: io.MultiReader(bytes.NewReader(head), contents)}
+	writer, _ := helpers.NewCompressWriter(helpers.CompressionGzip, tmp)
+	if _, err := io.Copy(writer, counter); err != nil {
+		return "", fmt.Errorf("error writing file %v: %w", filename, err)
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	header := make([]byte, compressedHeaderLength)
+	binary.BigEndian.PutUint64(header, uint64(counter.count))
+	if _, err := cfs.store.Save(filename+compressedSuffix, io.MultiReader(bytes.NewReader(header), tmp)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), cfs.deleteIfExists(filename)
+}
+
+// Open returns a reader for the uncompressed contents of filename
+func (cfs *CompressedFileStore) Open(filename string) (io.ReadCloser, error) {
+	file, err := cfs.store.Open(filename + compressedSuffix)
+	if errors.Is(err, ErrFileNotFound) {
+		return cfs.store.Open(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(file, make([]byte, compressedHeaderLength)); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error reading compressed file %v: %w", filename, err)
+	}
+	reader, err := helpers.NewDecompressReader(helpers.CompressionGzip, file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error reading compressed file %v: %w", filename, err)
+	}
+	return &decompressedFile{ReadCloser: reader, file: file}, nil
+}
+
+// Delete removes filename, whether or not it was stored compressed
+func (cfs *CompressedFileStore) Delete(filename string) error {
+	err := cfs.store.Delete(filename + compressedSuffix)
+	if errors.Is(err, ErrFileNotFound) {
+		return cfs.store.Delete(filename)
+	}
+	if err != nil {
+		return err
+	}
+	return cfs.deleteIfExists(filename)
+}
+
+// Stat returns the uncompressed size and modified time of filename
+func (cfs *CompressedFileStore) Stat(filename string) (FileInfo, error) {
+	info, err := cfs.store.Stat(filename + compressedSuffix)
+	if errors.Is(err, ErrFileNotFound) {
+		return cfs.store.Stat(filename)
+	}
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return cfs.uncompressedInfo(info)
+}
+
+// List returns the files beginning with prefix, sorted by name, with their uncompressed sizes
+func (cfs *CompressedFileStore) List(prefix string) ([]FileInfo, error) {
+	stored, err := cfs.store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfos := []FileInfo{}
+	for _, info := range stored {
+		if strings.HasSuffix(info.Name, compressedSuffix) {
+			if info, err = cfs.uncompressedInfo(info); err != nil {
+				return nil, err
+			}
+		}
+		fileInfos = append(fileInfos, info)
+	}
+	sort.Slice(fileInfos, func(i, j int) bool {
+		return fileInfos[i].Name < fileInfos[j].Name
+	})
+	return fileInfos, nil
+}
+
+// Usage returns the total size in bytes of the files as stored, after compression
+func (cfs *CompressedFileStore) Usage() (int64, error) {
+	return cfs.store.Usage()
+}
+
+// uncompressedInfo reads the uncompressed size from the header of a compressed file
+func (cfs *CompressedFileStore) uncompressedInfo(info FileInfo) (FileInfo, error) {
+	file, err := cfs.store.Open(info.Name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer file.Close()
+
+	header := make([]byte, compressedHeaderLength)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return FileInfo{}, fmt.Errorf("error reading compressed file %v: %w", info.Name, err)
+	}
+
+	info.Name = strings.TrimSuffix(info.Name, compressedSuffix)
+	info.Size = int64(binary.BigEndian.Uint64(header))
+	return info, nil
+}
+
+// deleteIfExists removes a stale copy of a file saved with different compression
+func (cfs *CompressedFileStore) deleteIfExists(filename string) error {
+	if err := cfs.store.Delete(filename); err != nil && !errors.Is(err, ErrFileNotFound) {
+		return err
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.reader.Read(p)
+	cr.count += int64(n)
+	return n, err
+}
+
+// decompressedFile closes both the decompressing reader and the underlying file
+type decompressedFile struct {
+	io.ReadCloser
+	file io.Closer
+}
+
+func (df *decompressedFile) Close() error {
+	err := df.ReadCloser.Close()
+	if fileErr := df.file.Close(); err == nil {
+		err = fileErr
+	}
+	return err
+}
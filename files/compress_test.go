@@ -0,0 +1,115 @@
+package files
+
+import (
+	"errors"
+	"io"
+	"rq/helpers"
+	"strings"
+	"testing"
+)
+
+func TestCompressedFileStore(t *testing.T) {
+	backing, _ := NewInMemoryFileStore()
+	store, err := NewCompressedFileStore(backing, helpers.CompressionGzip, 64)
+	if err != nil {
+		t.Fatalf("NewCompressedFileStore() error = %v", err)
+	}
+
+	large := strings.Repeat("compressible contents ", 100)
+	small := "small contents"
+
+	tests := []struct {
+		name           string
+		filename       string
+		contents       string
+		wantCompressed bool
+	}{
+		{name: "above threshold is compressed", filename: "rqid-large.txt", contents: large, wantCompressed: true},
+		{name: "below threshold is not compressed", filename: "rqid-small.txt", contents: small},
+		{name: "empty file is not compressed", filename: "rqid-empty.txt", contents: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checksum, err := store.Save(test.filename, strings.NewReader(test.contents))
+			if err != nil {
+				t.Fatalf("Save() error = %v", err)
+			}
+			if err := VerifyChecksum(store, test.filename, checksum); err != nil {
+				t.Errorf("checksum is not of the uncompressed contents: %v", err)
+			}
+
+			_, compressedErr := backing.Stat(test.filename + compressedSuffix)
+			if compressed := compressedErr == nil; compressed != test.wantCompressed {
+				t.Errorf("stored compressed = %v, want %v", compressed, test.wantCompressed)
+			}
+
+			file, err := store.Open(test.filename)
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			contents, _ := io.ReadAll(file)
+			file.Close()
+			if string(contents) != test.contents {
+				t.Errorf("Open() contents = %q, want %q", contents, test.contents)
+			}
+
+			info, err := store.Stat(test.filename)
+			if err != nil || info.Name != test.filename || info.Size != int64(len(test.contents)) {
+				t.Errorf("Stat() = %+v, %v, want name %v and size %v", info, err, test.filename, len(test.contents))
+			}
+		})
+	}
+
+	list, err := store.List("rqid-")
+	if err != nil || len(list) != 3 {
+		t.Fatalf("List() = %+v, %v, want 3 files", list, err)
+	}
+	if list[1].Name != "rqid-large.txt" || list[1].Size != int64(len(large)) {
+		t.Errorf("List() = %+v, want rqid-large.txt with its uncompressed size", list[1])
+	}
+
+	usage, _ := store.Usage()
+	if usage >= int64(len(large)) {
+		t.Errorf("Usage() = %v, want less than the uncompressed size %v", usage, len(large))
+	}
+
+	// Replacing a compressed file with a small one leaves no stale compressed copy
+	if _, err := store.Save("rqid-large.txt", strings.NewReader(small)); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if _, err := backing.Stat("rqid-large.txt" + compressedSuffix); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("compressed copy still exists after replacing the file, Stat() error = %v", err)
+	}
+
+	for _, filename := range []string{"rqid-large.txt", "rqid-small.txt", "rqid-empty.txt"} {
+		if err := store.Delete(filename); err != nil {
+			t.Errorf("Delete(%v) error = %v", filename, err)
+		}
+	}
+	if err := store.Delete("rqid-large.txt"); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("Delete() of a missing file error = %v, want %v", err, ErrFileNotFound)
+	}
+}
+
+func TestCompressedFileStoreReadsUncompressedFiles(t *testing.T) {
+	backing, _ := NewInMemoryFileStore()
+	backing.Save("rqid-old.txt", strings.NewReader(strings.Repeat("saved before compression ", 10)))
+
+	store, _ := NewCompressedFileStore(backing, helpers.CompressionGzip, 1)
+	file, err := store.Open("rqid-old.txt")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer file.Close()
+	if contents, _ := io.ReadAll(file); !strings.HasPrefix(string(contents), "saved before compression") {
+		t.Errorf("Open() contents = %q", contents)
+	}
+}
+
+func TestNewCompressedFileStoreUnsupportedAlgorithm(t *testing.T) {
+	backing, _ := NewInMemoryFileStore()
+	if _, err := NewCompressedFileStore(backing, "zstd", 0); !errors.Is(err, helpers.ErrUnsupportedCompression) {
+		t.Errorf("NewCompressedFileStore() error = %v, want %v", err, helpers.ErrUnsupportedCompression)
+	}
+}
@@ -0,0 +1,238 @@
+package files
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// blobPrefix is prepended to the checksum to name each blob in the underlying FileStore
+const blobPrefix = "blob-"
+
+// BlobIndex records which blob each filename in a ContentAddressedFileStore refers to.
+type BlobIndex interface {
+	// AddReference points filename at the blob with the given checksum, replacing any existing reference, and
+	// returns the checksum previously referenced by filename, if any.
+	AddReference(filename string, checksum string) (previous string, err error)
+	// RemoveReference removes filename from the index and returns the checksum it referenced.
+	RemoveReference(filename string) (checksum string, err error)
+	// Lookup returns the checksum of the blob referenced by filename.
+	Lookup(filename string) (checksum string, err error)
+	// References returns the number of filenames referencing the blob with the given checksum.
+	References(checksum string) (int64, error)
+	// List returns the filenames in the index beginning with prefix.
+	List(prefix string) ([]string, error)
+}
+
+// ContentAddressedFileStore is a FileStore which stores each unique file once in an underlying FileStore, named by
+// its SHA-256 checksum. Files saved under different names with the same contents share a blob, and a blob is only
+// deleted once no filename refers to it.
+type ContentAddressedFileStore struct {
+	store FileStore
+	index BlobIndex
+	mu    sync.Mutex
+}
+
+// InMemoryBlobIndex is a BlobIndex held in memory
+type InMemoryBlobIndex struct {
+	mu         sync.RWMutex
+	references map[string]string
+}
+
+// NewContentAddressedFileStore returns a ContentAddressedFileStore which saves blobs to store and tracks references
+// to them in index.
+func NewContentAddressedFileStore(store FileStore, index BlobIndex) (*ContentAddressedFileStore, error) {
+	return &ContentAddressedFileStore{
+		store: store,
+		index: index,
+	}, nil
+}
+
+// Save stores contents as a blob, if an identical blob is not already stored, and points filename at it.
+func (cas *ContentAddressedFileStore) Save(filename string, contents io.Reader) (string, error) {
+	// The checksum is needed to name the blob, so contents are spooled to a temporary file first
+	tmp, err := createTempFile()
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), contents); err != nil {
+		return "", fmt.Errorf("error writing file %v: %w", filename, err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+
+	cas.mu.Lock()
+	defer cas.mu.Unlock()
+
+	if _, err := cas.store.Stat(blobPrefix + checksum); err != nil {
+		if !errors.Is(err, ErrFileNotFound) {
+			return "", err
+		}
+		if _, err := cas.store.Save(blobPrefix+checksum, tmp); err != nil {
+			return "", err
+		}
+	}
+
+	previous, err := cas.index.AddReference(filename, checksum)
+	if err != nil {
+		return "", err
+	}
+	if previous != "" && previous != checksum {
+		if err := cas.releaseBlob(previous); err != nil {
+			return "", err
+		}
+	}
+
+	return checksum, nil
+}
+
+// Open returns a reader for the blob referenced by filename
+func (cas *ContentAddressedFileStore) Open(filename string) (io.ReadCloser, error) {
+	checksum, err := cas.index.Lookup(filename)
+	if err != nil {
+		return nil, err
+	}
+	return cas.store.Open(blobPrefix + checksum)
+}
+
+// Delete removes filename, and the blob it references if no other filename refers to it
+func (cas *ContentAddressedFileStore) Delete(filename string) error {
+	cas.mu.Lock()
+	defer cas.mu.Unlock()
+
+	checksum, err := cas.index.RemoveReference(filename)
+	if err != nil {
+		return err
+	}
+	return cas.releaseBlob(checksum)
+}
+
+// Stat returns the size and modified time of the blob referenced by filename
+func (cas *ContentAddressedFileStore) Stat(filename string) (FileInfo, error) {
+	checksum, err := cas.index.Lookup(filename)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	info, err := cas.store.Stat(blobPrefix + checksum)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info.Name = filename
+	return info, nil
+}
+
+// List returns the filenames beginning with prefix, sorted by name, with the details of the blobs they reference
+func (cas *ContentAddressedFileStore) List(prefix string) ([]FileInfo, error) {
+	filenames, err := cas.index.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfos := []FileInfo{}
+	for _, filename := range filenames {
+		info, err := cas.Stat(filename)
+		if err != nil {
+			return nil, err
+		}
+		fileInfos = append(fileInfos, info)
+	}
+	return fileInfos, nil
+}
+
+// Usage returns the total size in bytes of all blobs, with each shared blob counted once
+func (cas *ContentAddressedFileStore) Usage() (int64, error) {
+	return cas.store.Usage()
+}
+
+// releaseBlob deletes the blob with the given checksum if it is no longer referenced
+func (cas *ContentAddressedFileStore) releaseBlob(checksum string) error {
+	references, err := cas.index.References(checksum)
+	if err != nil {
+		return err
+	}
+	if references > 0 {
+		return nil
+	}
+
+	if err := cas.store.Delete(blobPrefix + checksum); err != nil && !errors.Is(err, ErrFileNotFound) {
+		return err
+	}
+	return nil
+}
+
+// NewInMemoryBlobIndex returns an empty InMemoryBlobIndex
+func NewInMemoryBlobIndex() *InMemoryBlobIndex {
+	return &InMemoryBlobIndex{references: map[string]string{}}
+}
+
+func (mbi *InMemoryBlobIndex) AddReference(filename string, checksum string) (string, error) {
+	mbi.mu.Lock()
+	defer mbi.mu.Unlock()
+
+	previous := mbi.references[filename]
+	mbi.references[filename] = checksum
+	return previous, nil
+}
+
+func (mbi *InMemoryBlobIndex) RemoveReference(filename string) (string, error) {
+	mbi.mu.Lock()
+	defer mbi.mu.Unlock()
+
+	checksum, exists := mbi.references[filename]
+	if !exists {
+		return "", fmt.Errorf("%w: %v", ErrFileNotFound, filename)
+	}
+	delete(mbi.references, filename)
+	return checksum, nil
+}
+
+func (mbi *InMemoryBlobIndex) Lookup(filename string) (string, error) {
+	mbi.mu.RLock()
+	defer mbi.mu.RUnlock()
+
+	checksum, exists := mbi.references[filename]
+	if !exists {
+		return "", fmt.Errorf("%w: %v", ErrFileNotFound, filename)
+	}
+	return checksum, nil
+}
+
+func (mbi *InMemoryBlobIndex) References(checksum string) (int64, error) {
+	mbi.mu.RLock()
+	defer mbi.mu.RUnlock()
+
+	var count int64
+	for _, referenced := range mbi.references {
+		if referenced == checksum {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (mbi *InMemoryBlobIndex) List(prefix string) ([]string, error) {
+	mbi.mu.RLock()
+	defer mbi.mu.RUnlock()
+
+	filenames := []string{}
+	for filename := range mbi.references {
+		if strings.HasPrefix(filename, prefix) {
+			filenames = append(filenames, filename)
+		}
+	}
+	sort.Strings(filenames)
+	return filenames, nil
+}
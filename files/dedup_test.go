@@ -0,0 +1,80 @@
+package files
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestContentAddressedFileStore(t *testing.T) {
+	backing, _ := NewInMemoryFileStore()
+	store, _ := NewContentAddressedFileStore(backing, NewInMemoryBlobIndex())
+
+	first, err := store.Save("rqid1-file.jpg", strings.NewReader("an image"))
+	if err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	second, err := store.Save("rqid2-file.jpg", strings.NewReader("an image"))
+	if err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if first != second {
+		t.Errorf("Save() of identical contents returned checksums %v and %v", first, second)
+	}
+	if _, err := store.Save("rqid3-file.jpg", strings.NewReader("another image")); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	blobs, _ := backing.List(blobPrefix)
+	if len(blobs) != 2 {
+		t.Errorf("backing store holds %v blobs, want 2", len(blobs))
+	}
+
+	usage, _ := store.Usage()
+	if want := int64(len("an image") + len("another image")); usage != want {
+		t.Errorf("Usage() = %v, want %v", usage, want)
+	}
+
+	list, err := store.List("rqid")
+	if err != nil || len(list) != 3 || list[0].Name != "rqid1-file.jpg" {
+		t.Errorf("List() = %+v, %v", list, err)
+	}
+
+	// Deleting one reference to a shared blob leaves the blob in place for the other
+	if err := store.Delete("rqid1-file.jpg"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := store.Open("rqid1-file.jpg"); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("Open() of deleted file error = %v, want ErrFileNotFound", err)
+	}
+	reader, err := store.Open("rqid2-file.jpg")
+	if err != nil {
+		t.Fatalf("Open() of file sharing a deleted file's blob error = %v", err)
+	}
+	contents, _ := io.ReadAll(reader)
+	reader.Close()
+	if string(contents) != "an image" {
+		t.Errorf("Open() read %q, want %q", contents, "an image")
+	}
+
+	// Deleting the last reference removes the blob
+	if err := store.Delete("rqid2-file.jpg"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := backing.Stat(blobPrefix + first); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("blob still stored after last reference deleted, error = %v", err)
+	}
+	if err := store.Delete("rqid2-file.jpg"); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("Delete() of missing file error = %v, want ErrFileNotFound", err)
+	}
+
+	// Overwriting a file releases the blob it previously referenced
+	if _, err := store.Save("rqid3-file.jpg", strings.NewReader("a new image")); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	blobs, _ = backing.List(blobPrefix)
+	if len(blobs) != 1 {
+		t.Errorf("backing store holds %v blobs after overwrite, want 1", len(blobs))
+	}
+}
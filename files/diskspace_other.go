@@ -0,0 +1,10 @@
+//go:build !unix
+
+package files
+
+import "errors"
+
+// FreeSpace is not supported on this platform, so free disk space limits cannot be enforced
+func FreeSpace(path string) (uint64, error) {
+	return 0, errors.New("free disk space check not supported on this platform")
+}
@@ -0,0 +1,177 @@
+package files
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"rq/encryption"
+)
+
+// EncryptedFileStore is a FileStore which encrypts files with AES-GCM before saving them to an underlying FileStore.
+// Each file has its own data key, stored in the file's header encrypted with the keyring's current key. Files saved
+// before encryption was enabled are read back unaltered until the keys are rotated.
+type EncryptedFileStore struct {
+	store   FileStore
+	keyring *encryption.Keyring
+}
+
+// NewEncryptedFileStore returns an EncryptedFileStore which saves files to store, encrypted with keyring.
+func NewEncryptedFileStore(store FileStore, keyring *encryption.Keyring) (*EncryptedFileStore, error) {
+	return &EncryptedFileStore{store: store, keyring: keyring}, nil
+}
+
+// Save encrypts contents to the underlying FileStore and returns the checksum of the unencrypted contents.
+func (efs *EncryptedFileStore) Save(filename string, contents io.Reader) (string, error) {
+	hash := sha256.New()
+	pr, pw := io.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		writer, err := efs.keyring.NewEncryptWriter(pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(writer, io.TeeReader(contents, hash)); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(writer.Close())
+	}()
+
+	_, err := efs.store.Save(filename, pr)
+	// Stop the encryption if the underlying store gave up before reading everything
+	pr.CloseWithError(io.ErrClosedPipe)
+	<-done
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Open returns a reader for the decrypted contents of filename
+func (efs *EncryptedFileStore) Open(filename string) (io.ReadCloser, error) {
+	file, err := efs.store.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, _, err := efs.keyring.NewDecryptReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error decrypting file %v: %w", filename, err)
+	}
+	return &decryptedFile{Reader: plaintext, Closer: file}, nil
+}
+
+func (efs *EncryptedFileStore) Delete(filename string) error {
+	return efs.store.Delete(filename)
+}
+
+// Stat returns the decrypted size and modified time of filename
+func (efs *EncryptedFileStore) Stat(filename string) (FileInfo, error) {
+	info, err := efs.store.Stat(filename)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return efs.decryptedInfo(info)
+}
+
+// List returns the files beginning with prefix, sorted by name, with their decrypted sizes
+func (efs *EncryptedFileStore) List(prefix string) ([]FileInfo, error) {
+	stored, err := efs.store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfos := []FileInfo{}
+	for _, info := range stored {
+		if info, err = efs.decryptedInfo(info); err != nil {
+			return nil, err
+		}
+		fileInfos = append(fileInfos, info)
+	}
+	return fileInfos, nil
+}
+
+// Usage returns the total size in bytes of the files as stored, after encryption
+func (efs *EncryptedFileStore) Usage() (int64, error) {
+	return efs.store.Usage()
+}
+
+// RotateKeys re-encrypts every file not encrypted with the keyring's current key, including files saved before
+// encryption was enabled, and returns the number of files updated.
+func (efs *EncryptedFileStore) RotateKeys() (int, error) {
+	fileInfos, err := efs.store.List("")
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for _, info := range fileInfos {
+		header, encrypted, err := efs.readHeader(info.Name)
+		if err != nil {
+			return rotated, err
+		}
+		if encrypted && header.KeyId == efs.keyring.CurrentKeyId() {
+			continue
+		}
+
+		if err := efs.reencrypt(info.Name); err != nil {
+			return rotated, fmt.Errorf("error re-encrypting file %v: %w", info.Name, err)
+		}
+		rotated++
+	}
+	return rotated, nil
+}
+
+// reencrypt saves filename over itself, which FileStore implementations must allow, encrypting it with the current key
+func (efs *EncryptedFileStore) reencrypt(filename string) error {
+	file, err := efs.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := efs.Save(filename, file); err != nil {
+		return err
+	}
+	slog.Info("re-encrypted file", "file", filename)
+	return nil
+}
+
+// decryptedInfo calculates the size of a file's decrypted contents from its header
+func (efs *EncryptedFileStore) decryptedInfo(info FileInfo) (FileInfo, error) {
+	header, encrypted, err := efs.readHeader(info.Name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if encrypted {
+		info.Size = encryption.PlaintextSize(header, info.Size)
+	}
+	return info, nil
+}
+
+func (efs *EncryptedFileStore) readHeader(filename string) (encryption.StreamHeader, bool, error) {
+	file, err := efs.store.Open(filename)
+	if err != nil {
+		return encryption.StreamHeader{}, false, err
+	}
+	defer file.Close()
+
+	header, encrypted, err := encryption.ReadHeader(file)
+	if err != nil {
+		return encryption.StreamHeader{}, false, fmt.Errorf("error reading file %v: %w", filename, err)
+	}
+	return header, encrypted, nil
+}
+
+// decryptedFile reads decrypted contents and closes the underlying file
+type decryptedFile struct {
+	io.Reader
+	io.Closer
+}
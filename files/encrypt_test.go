@@ -0,0 +1,93 @@
+package files
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"rq/encryption"
+	"strings"
+	"testing"
+)
+
+func testKey(id string) string {
+	key := make([]byte, encryption.KeySize)
+	rand.Read(key)
+	return id + ":" + base64.StdEncoding.EncodeToString(key)
+}
+
+func testKeyring(t *testing.T, keys ...string) *encryption.Keyring {
+	keyring, err := encryption.ParseKeyring(strings.Join(keys, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestEncryptedFileStore(t *testing.T) {
+	backing, _ := NewInMemoryFileStore()
+	store, _ := NewEncryptedFileStore(backing, testKeyring(t, testKey("k1")))
+
+	contents := strings.Repeat("personal data ", 10000)
+	checksum, err := store.Save("rqid-file.txt", strings.NewReader(contents))
+	if err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if err := VerifyChecksum(store, "rqid-file.txt", checksum); err != nil {
+		t.Errorf("checksum is not of the unencrypted contents: %v", err)
+	}
+
+	stored, _ := backing.Open("rqid-file.txt")
+	raw, _ := io.ReadAll(stored)
+	if bytes.Contains(raw, []byte("personal data")) {
+		t.Error("file is stored unencrypted")
+	}
+
+	info, err := store.Stat("rqid-file.txt")
+	if err != nil || info.Size != int64(len(contents)) {
+		t.Errorf("Stat() = %+v, %v, want size %v", info, err, len(contents))
+	}
+	list, err := store.List("rqid")
+	if err != nil || len(list) != 1 || list[0].Size != int64(len(contents)) {
+		t.Errorf("List() = %+v, %v, want one file of size %v", list, err, len(contents))
+	}
+
+	if err := store.Delete("rqid-file.txt"); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+}
+
+func TestEncryptedFileStoreRotateKeys(t *testing.T) {
+	backing, _ := NewInMemoryFileStore()
+	oldKey := testKey("k1")
+	oldStore, _ := NewEncryptedFileStore(backing, testKeyring(t, oldKey))
+
+	backing.Save("rqid-plain.txt", strings.NewReader("saved before encryption"))
+	oldStore.Save("rqid-old.txt", strings.NewReader("saved with k1"))
+
+	// The new key is added to the start of the keyring, keeping the old key to decrypt existing files
+	store, _ := NewEncryptedFileStore(backing, testKeyring(t, testKey("k2"), oldKey))
+
+	rotated, err := store.RotateKeys()
+	if err != nil || rotated != 2 {
+		t.Fatalf("RotateKeys() = %v, %v, want 2 files", rotated, err)
+	}
+	if rotated, _ := store.RotateKeys(); rotated != 0 {
+		t.Errorf("second RotateKeys() = %v, want 0 files", rotated)
+	}
+
+	for filename, want := range map[string]string{"rqid-plain.txt": "saved before encryption", "rqid-old.txt": "saved with k1"} {
+		header, encrypted, _ := store.readHeader(filename)
+		if !encrypted || header.KeyId != "k2" {
+			t.Errorf("%v is encrypted = %v with key %v, want k2", filename, encrypted, header.KeyId)
+		}
+		file, err := store.Open(filename)
+		if err != nil {
+			t.Fatalf("Open() error = %v", err)
+		}
+		if contents, _ := io.ReadAll(file); string(contents) != want {
+			t.Errorf("%v contents = %q, want %q", filename, contents, want)
+		}
+		file.Close()
+	}
+}
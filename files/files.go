@@ -1,19 +1,52 @@
 package files
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
 	"os"
+	"path/filepath"
 	"regexp"
 	"rq/config"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
-// FileStore represents a repository capable of accepting a file and saving is.
+// ErrFileNotFound is returned by a FileStore when the requested file does not exist. Stores wrap it with the
+// filename, so callers should check for it using errors.Is.
+var ErrFileNotFound = errors.New("file not found")
+
+// ErrChecksumMismatch is returned by VerifyChecksum when a stored file no longer matches its recorded checksum
+var ErrChecksumMismatch = errors.New("file checksum mismatch")
+
+// tempFilePrefix is used to name files in the upload directory which are still being written
+const tempFilePrefix = ".rq-tmp-"
+
+// FileStore represents a repository capable of accepting a file and saving is. Saving a file must replace any existing
+// file with the same name, once contents have been read, as files are re-saved in place when encryption keys are
+// rotated.
 type FileStore interface {
-	Save(filename string, contents io.Reader) error
+	Save(filename string, contents io.Reader) (checksum string, err error)
+	Open(filename string) (io.ReadCloser, error)
+	Delete(filename string) error
+	Stat(filename string) (FileInfo, error)
+	List(prefix string) ([]FileInfo, error)
+	Usage() (int64, error)
+}
+
+// FileInfo describes a file held in a FileStore
+type FileInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
 }
 
 // DiskFileStore is a FileStore for persistant file storage
@@ -23,8 +56,35 @@ type DiskFileStore struct {
 
 // InMemoryFileStore is a FileStore for in-memory file storage.
 type InMemoryFileStore struct {
-	store FileStore
-	files map[string][]byte
+	store    FileStore
+	mu       sync.RWMutex
+	files    map[string][]byte
+	modTimes map[string]time.Time
+}
+
+// createTempFile creates a file in the upload directory for contents which are still being written, or spooled before
+// they are saved, so large files are held on the disk set aside for them rather than in the system's temporary
+// directory, which may be small or in memory. Files left by an interrupted save are removed by RemoveTempFiles.
+func createTempFile() (*os.File, error) {
+	return os.CreateTemp(config.Config.UploadDirectory, tempFilePrefix+"*")
+}
+
+// RemoveTempFiles removes the temporary files left in the upload directory by saves which were interrupted, such as
+// by a crash. It must only be called before any files are saved.
+func RemoveTempFiles() error {
+	if config.Config.UploadDirectory == "" {
+		return nil
+	}
+	tmpFiles, err := filepath.Glob(filepath.Join(config.Config.UploadDirectory, tempFilePrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, tmpFile := range tmpFiles {
+		if err := os.Remove(tmpFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
 }
 
 // NewDiskFileStore returns a DiskFileStore stuct, for use with persistant file storage.
@@ -32,20 +92,190 @@ func NewDiskFileStore() (*DiskFileStore, error) {
 	return &DiskFileStore{}, nil
 }
 
-// Save creates a file on disk named filename and copies contents into it
-func (dfs *DiskFileStore) Save(filename string, contents io.Reader) error {
+// Save streams contents into a temporary file in the upload directory, syncs it to disk and checks its size, before
+// renaming it to filename. As the rename is atomic, a failed or interrupted upload never leaves a partial file under
+// the final name. The SHA-256 checksum of the contents is returned, hex encoded.
+func (dfs *DiskFileStore) Save(filename string, contents io.Reader) (string, error) {
+	tmp, err := createTempFile()
+	if err != nil {
+		slog.Error("error creating temporary file", "error", err)
+		return "", err
+	}
+
+	saved := false
+	defer func() {
+		if !saved {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hash), contents)
+	if err != nil {
+		return "", fmt.Errorf("error writing file %v: %w", filename, err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return "", fmt.Errorf("error syncing file %v: %w", filename, err)
+	}
+
+	info, err := tmp.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Size() != written {
+		return "", fmt.Errorf("error writing file %v: wrote %v bytes but file is %v bytes", filename, written, info.Size())
+	}
+
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(tmp.Name(), dfs.path(filename)); err != nil {
+		return "", err
+	}
+	saved = true
+
+	// Sync the directory so the rename itself survives a power loss
+	if dir, err := os.Open(config.Config.UploadDirectory); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Open returns a reader for the file on disk named filename, which the caller must close
+func (dfs *DiskFileStore) Open(filename string) (io.ReadCloser, error) {
+	file, err := os.Open(dfs.path(filename))
+	if err != nil {
+		return nil, notFoundError(filename, err)
+	}
+	return file, nil
+}
+
+// Delete removes the file on disk named filename
+func (dfs *DiskFileStore) Delete(filename string) error {
+	return notFoundError(filename, os.Remove(dfs.path(filename)))
+}
+
+// Stat returns the size and modified time of the file on disk named filename
+func (dfs *DiskFileStore) Stat(filename string) (FileInfo, error) {
+	info, err := os.Stat(dfs.path(filename))
+	if err != nil {
+		return FileInfo{}, notFoundError(filename, err)
+	}
+	if info.IsDir() {
+		return FileInfo{}, fmt.Errorf("%w: %v", ErrFileNotFound, filename)
+	}
+	return FileInfo{Name: filename, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// List returns the files in the upload directory whose names begin with prefix, sorted by name
+func (dfs *DiskFileStore) List(prefix string) ([]FileInfo, error) {
+	entries, err := os.ReadDir(config.Config.UploadDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfos := []FileInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), prefix) || strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		fileInfos = append(fileInfos, FileInfo{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return fileInfos, nil
+}
+
+// path returns the location on disk of filename
+func (dfs *DiskFileStore) path(filename string) string {
+	return filepath.Join(config.Config.UploadDirectory, filepath.Base(filename))
+}
 
-	path := fmt.Sprintf("%v/%v", config.Config.UploadDirectory, filename)
-	out, err := os.Create(path)
+// notFoundError converts a missing file error from the os package into an ErrFileNotFound
+func notFoundError(filename string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %v", ErrFileNotFound, filename)
+	}
+	return err
+}
+
+// Usage returns the total size in bytes of all files in the upload directory
+func (dfs *DiskFileStore) Usage() (int64, error) {
+	var total int64
+	err := filepath.WalkDir(config.Config.UploadDirectory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+
+	return total, err
+}
+
+// VerifyChecksum reads filename from store and checks its SHA-256 checksum matches the one recorded when it was saved,
+// so a file is not sent onwards if it has been truncated or altered on disk.
+func VerifyChecksum(store FileStore, filename string, checksum string) error {
+	file, err := store.Open(filename)
 	if err != nil {
-		log.Println("File save error")
 		return err
 	}
+	defer file.Close()
 
-	io.Copy(out, contents)
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
 
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != checksum {
+		return fmt.Errorf("%w: %v has checksum %v, expected %v", ErrChecksumMismatch, filename, actual, checksum)
+	}
 	return nil
+}
+
+// ChecksumReader reads a stored file while calculating its checksum, so a file can be verified as it is sent
+// rather than read twice.
+type ChecksumReader struct {
+	reader   io.Reader
+	filename string
+	checksum string
+	hash     hash.Hash
+}
+
+// NewChecksumReader returns a ChecksumReader which expects contents to have the given sha256 checksum.
+func NewChecksumReader(contents io.Reader, filename string, checksum string) *ChecksumReader {
+	return &ChecksumReader{reader: contents, filename: filename, checksum: checksum, hash: sha256.New()}
+}
 
+func (cr *ChecksumReader) Read(p []byte) (int, error) {
+	n, err := cr.reader.Read(p)
+	cr.hash.Write(p[:n])
+	return n, err
+}
+
+// Verify reads any remaining contents and returns ErrChecksumMismatch if the checksum does not match
+func (cr *ChecksumReader) Verify() error {
+	if _, err := io.Copy(io.Discard, cr); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(cr.hash.Sum(nil)); actual != cr.checksum {
+		return fmt.Errorf("%w: %v has checksum %v, expected %v", ErrChecksumMismatch, cr.filename, actual, cr.checksum)
+	}
+	return nil
 }
 
 // CheckExtensionIsAllowed checks to see if the filename supplied is an acceptable format,
@@ -53,7 +283,7 @@ func (dfs *DiskFileStore) Save(filename string, contents io.Reader) error {
 func CheckExtensionIsAllowed(filename string, allowedExtensionsRegex string) (isOk bool, extension string) {
 	isOk = false
 	extension = ""
-	exp := fmt.Sprintf("(i?)%v", allowedExtensionsRegex)
+	exp := fmt.Sprintf("^(?i)(?:%v)$", allowedExtensionsRegex)
 	re := regexp.MustCompile(exp)
 
 	fileExtension := strings.ToLower(filename[strings.LastIndex(filename, ".")+1:])
@@ -63,19 +293,87 @@ func CheckExtensionIsAllowed(filename string, allowedExtensionsRegex string) (is
 
 func NewInMemoryFileStore() (*InMemoryFileStore, error) {
 	return &InMemoryFileStore{
-		files: make(map[string][]byte),
+		files:    make(map[string][]byte),
+		modTimes: make(map[string]time.Time),
 	}, nil
 }
 
-func (mfs *InMemoryFileStore) Save(filename string, contents io.Reader) error {
-	if _, exists := mfs.files[filename]; exists {
-		errMsg := fmt.Sprintf("file %s already exists", filename)
-		return errors.New(errMsg)
-	}
+// Save stores contents in memory, replacing any existing file named filename as the other stores do
+func (mfs *InMemoryFileStore) Save(filename string, contents io.Reader) (string, error) {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+
 	fileContents, err := io.ReadAll(contents)
 	if err != nil {
-		return errors.New("error reading file contents")
+		return "", errors.New("error reading file contents")
 	}
 	mfs.files[filename] = fileContents
+	mfs.modTimes[filename] = time.Now()
+
+	checksum := sha256.Sum256(fileContents)
+	return hex.EncodeToString(checksum[:]), nil
+}
+
+// Open returns a reader for the in-memory file named filename
+func (mfs *InMemoryFileStore) Open(filename string) (io.ReadCloser, error) {
+	mfs.mu.RLock()
+	defer mfs.mu.RUnlock()
+
+	contents, exists := mfs.files[filename]
+	if !exists {
+		return nil, fmt.Errorf("%w: %v", ErrFileNotFound, filename)
+	}
+	return io.NopCloser(bytes.NewReader(contents)), nil
+}
+
+// Delete removes the in-memory file named filename
+func (mfs *InMemoryFileStore) Delete(filename string) error {
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+
+	if _, exists := mfs.files[filename]; !exists {
+		return fmt.Errorf("%w: %v", ErrFileNotFound, filename)
+	}
+	delete(mfs.files, filename)
+	delete(mfs.modTimes, filename)
 	return nil
 }
+
+// Stat returns the size and modified time of the in-memory file named filename
+func (mfs *InMemoryFileStore) Stat(filename string) (FileInfo, error) {
+	mfs.mu.RLock()
+	defer mfs.mu.RUnlock()
+
+	contents, exists := mfs.files[filename]
+	if !exists {
+		return FileInfo{}, fmt.Errorf("%w: %v", ErrFileNotFound, filename)
+	}
+	return FileInfo{Name: filename, Size: int64(len(contents)), ModTime: mfs.modTimes[filename]}, nil
+}
+
+// List returns the in-memory files whose names begin with prefix, sorted by name
+func (mfs *InMemoryFileStore) List(prefix string) ([]FileInfo, error) {
+	mfs.mu.RLock()
+	defer mfs.mu.RUnlock()
+
+	fileInfos := []FileInfo{}
+	for filename, contents := range mfs.files {
+		if strings.HasPrefix(filename, prefix) {
+			fileInfos = append(fileInfos, FileInfo{Name: filename, Size: int64(len(contents)), ModTime: mfs.modTimes[filename]})
+		}
+	}
+	sort.Slice(fileInfos, func(i, j int) bool { return fileInfos[i].Name < fileInfos[j].Name })
+	return fileInfos, nil
+}
+
+// Usage returns the total size in bytes of all files held in memory
+func (mfs *InMemoryFileStore) Usage() (int64, error) {
+	mfs.mu.RLock()
+	defer mfs.mu.RUnlock()
+
+	var total int64
+	for _, contents := range mfs.files {
+		total += int64(len(contents))
+	}
+	return total, nil
+}
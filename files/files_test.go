@@ -1,9 +1,17 @@
 package files
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"rq/config"
+	"rq/helpers"
 	"rq/records"
+	"strings"
 	"testing"
 )
 
@@ -29,6 +37,9 @@ func TestCheckExtensionIsAllowed(t *testing.T) {
 		{"file.exe", false, "exe"},
 		{"file.sh", false, "sh"},
 		{"file", false, "file"},
+		{"FILE.JPG", true, "jpg"},
+		{"file.xmp4", false, "xmp4"},
+		{"file.mp4x", false, "mp4x"},
 	}
 
 	for _, tt := range tests {
@@ -43,3 +54,181 @@ func TestCheckExtensionIsAllowed(t *testing.T) {
 		})
 	}
 }
+
+func TestFileStores(t *testing.T) {
+	config.Config.UploadDirectory = t.TempDir()
+	diskFileStore, _ := NewDiskFileStore()
+	inMemoryFileStore, _ := NewInMemoryFileStore()
+
+	stores := map[string]FileStore{
+		"DiskFileStore":     diskFileStore,
+		"InMemoryFileStore": inMemoryFileStore,
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			if _, err := store.Save("rqid-file.jpg", strings.NewReader("an image")); err != nil {
+				t.Fatalf("Save() error = %v", err)
+			}
+			if _, err := store.Save("other-file.jpg", strings.NewReader("another image")); err != nil {
+				t.Fatalf("Save() error = %v", err)
+			}
+			if _, err := store.Save("other-file.jpg", strings.NewReader("a replaced image")); err != nil {
+				t.Fatalf("Save() over an existing file error = %v", err)
+			}
+			if reader, err := store.Open("other-file.jpg"); err != nil {
+				t.Errorf("Open() of replaced file error = %v", err)
+			} else {
+				contents, _ := io.ReadAll(reader)
+				reader.Close()
+				if string(contents) != "a replaced image" {
+					t.Errorf("Open() of replaced file read %q, want %q", contents, "a replaced image")
+				}
+			}
+
+			reader, err := store.Open("rqid-file.jpg")
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			contents, _ := io.ReadAll(reader)
+			reader.Close()
+			if string(contents) != "an image" {
+				t.Errorf("Open() read %q, want %q", contents, "an image")
+			}
+
+			info, err := store.Stat("rqid-file.jpg")
+			if err != nil {
+				t.Fatalf("Stat() error = %v", err)
+			}
+			if info.Size != int64(len("an image")) || info.ModTime.IsZero() {
+				t.Errorf("Stat() = %+v", info)
+			}
+
+			list, err := store.List("rqid-")
+			if err != nil {
+				t.Fatalf("List() error = %v", err)
+			}
+			if len(list) != 1 || list[0].Name != "rqid-file.jpg" {
+				t.Errorf("List() = %+v, want only rqid-file.jpg", list)
+			}
+
+			if err := store.Delete("rqid-file.jpg"); err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+
+			if _, err := store.Open("rqid-file.jpg"); !errors.Is(err, ErrFileNotFound) {
+				t.Errorf("Open() of missing file error = %v, want ErrFileNotFound", err)
+			}
+			if _, err := store.Stat("rqid-file.jpg"); !errors.Is(err, ErrFileNotFound) {
+				t.Errorf("Stat() of missing file error = %v, want ErrFileNotFound", err)
+			}
+			if err := store.Delete("rqid-file.jpg"); !errors.Is(err, ErrFileNotFound) {
+				t.Errorf("Delete() of missing file error = %v, want ErrFileNotFound", err)
+			}
+		})
+	}
+}
+
+// failingReader returns some data and then an error, as when a client disconnects part way through an upload
+type failingReader struct {
+	sent bool
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	if fr.sent {
+		return 0, io.ErrUnexpectedEOF
+	}
+	fr.sent = true
+	return copy(p, "partial"), nil
+}
+
+func TestDiskFileStore_Save(t *testing.T) {
+	config.Config.UploadDirectory = t.TempDir()
+	store, _ := NewDiskFileStore()
+
+	hash := sha256.Sum256([]byte("an image"))
+	wantChecksum := hex.EncodeToString(hash[:])
+
+	checksum, err := store.Save("rqid-file.jpg", strings.NewReader("an image"))
+	if err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if checksum != wantChecksum {
+		t.Errorf("Save() checksum = %v, want %v", checksum, wantChecksum)
+	}
+	if err := VerifyChecksum(store, "rqid-file.jpg", checksum); err != nil {
+		t.Errorf("VerifyChecksum() error = %v", err)
+	}
+	if err := VerifyChecksum(store, "rqid-file.jpg", "not-the-checksum"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("VerifyChecksum() error = %v, want ErrChecksumMismatch", err)
+	}
+
+	if _, err := store.Save("rqid-truncated.jpg", &failingReader{}); err == nil {
+		t.Fatalf("Save() of interrupted upload expected an error")
+	}
+	if _, err := store.Stat("rqid-truncated.jpg"); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("Stat() of interrupted upload error = %v, want ErrFileNotFound", err)
+	}
+
+	entries, _ := os.ReadDir(config.Config.UploadDirectory)
+	if len(entries) != 1 {
+		t.Errorf("upload directory contains %v entries, want only the completed file", len(entries))
+	}
+}
+
+// spoolCheckReader reports, once read to the end, the temporary files in the upload directory at that moment
+type spoolCheckReader struct {
+	reader   io.Reader
+	tmpFiles []string
+}
+
+func (r *spoolCheckReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err == io.EOF {
+		r.tmpFiles, _ = filepath.Glob(filepath.Join(config.Config.UploadDirectory, tempFilePrefix+"*"))
+	}
+	return n, err
+}
+
+func TestFileStoresSpoolToUploadDirectory(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.UploadDirectory = t.TempDir()
+
+	backing, _ := NewInMemoryFileStore()
+	compressed, _ := NewCompressedFileStore(backing, helpers.CompressionGzip, 1)
+	deduplicated, _ := NewContentAddressedFileStore(backing, NewInMemoryBlobIndex())
+	stores := map[string]FileStore{
+		"CompressedFileStore":       compressed,
+		"ContentAddressedFileStore": deduplicated,
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			contents := &spoolCheckReader{reader: strings.NewReader(strings.Repeat("a large file ", 100))}
+			if _, err := store.Save("rqid-file.mp4", contents); err != nil {
+				t.Fatalf("Save() error = %v", err)
+			}
+			if len(contents.tmpFiles) != 1 {
+				t.Errorf("upload directory held %v while saving, want the file spooled there", contents.tmpFiles)
+			}
+			if tmpFiles, _ := filepath.Glob(filepath.Join(config.Config.UploadDirectory, tempFilePrefix+"*")); len(tmpFiles) != 0 {
+				t.Errorf("upload directory holds %v after saving, want the spooled file removed", tmpFiles)
+			}
+		})
+	}
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.UploadDirectory = t.TempDir()
+	os.WriteFile(filepath.Join(config.Config.UploadDirectory, tempFilePrefix+"interrupted"), []byte("part of a file"), 0600)
+	os.WriteFile(filepath.Join(config.Config.UploadDirectory, "rqid-file.jpg"), []byte("an image"), 0600)
+
+	if err := RemoveTempFiles(); err != nil {
+		t.Fatalf("RemoveTempFiles() error = %v", err)
+	}
+	entries, _ := os.ReadDir(config.Config.UploadDirectory)
+	if len(entries) != 1 || entries[0].Name() != "rqid-file.jpg" {
+		t.Errorf("upload directory holds %v, want only the saved file", entries)
+	}
+}
@@ -0,0 +1,127 @@
+package files
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/image/draw"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"rq/config"
+)
+
+// defaultJpegQuality is used when re-encoding JPEGs if no quality is configured
+const defaultJpegQuality = 85
+
+// defaultMaxImagePixels is the largest image decoded if no limit is configured. Decoded images take 4 bytes a pixel
+// or more, so this keeps each to around 200MB.
+const defaultMaxImagePixels = 50_000_000
+
+// ErrImageTooLarge is returned when an image has more pixels than the transform will decode
+var ErrImageTooLarge = errors.New("image too large")
+
+// ImageResizeTransform is a Transform which shrinks JPEG and PNG images to fit within a maximum width and height,
+// keeping their aspect ratio, and re-encodes JPEGs at the configured quality. Other content types are passed through.
+// Images with more than MaxPixels are rejected before they are decoded.
+type ImageResizeTransform struct {
+	MaxWidth  int
+	MaxHeight int
+	Quality   int
+	MaxPixels int64
+}
+
+// NewImageResizeTransform returns an ImageResizeTransform from its config.
+func NewImageResizeTransform(transformConfig config.RqTransformConfig) (Transform, error) {
+	if transformConfig.MaxWidth < 0 || transformConfig.MaxHeight < 0 {
+		return nil, errors.New("max_width and max_height must not be negative")
+	}
+	if transformConfig.Quality < 0 || transformConfig.Quality > 100 {
+		return nil, errors.New("quality must be between 1 and 100")
+	}
+	if transformConfig.MaxPixels < 0 {
+		return nil, errors.New("max_pixels must not be negative")
+	}
+
+	quality := transformConfig.Quality
+	if quality == 0 {
+		quality = defaultJpegQuality
+	}
+	maxPixels := transformConfig.MaxPixels
+	if maxPixels == 0 {
+		maxPixels = defaultMaxImagePixels
+	}
+
+	return &ImageResizeTransform{
+		MaxWidth:  transformConfig.MaxWidth,
+		MaxHeight: transformConfig.MaxHeight,
+		Quality:   quality,
+		MaxPixels: maxPixels,
+	}, nil
+}
+
+func (irt *ImageResizeTransform) Apply(contentType string, contents io.Reader) (string, io.Reader, error) {
+	if contentType != "image/jpeg" && contentType != "image/png" {
+		return contentType, contents, nil
+	}
+
+	// The dimensions are read from the header first, so an image too large to decode is rejected before it is
+	header := &bytes.Buffer{}
+	imageConfig, _, err := image.DecodeConfig(io.TeeReader(contents, header))
+	if err != nil {
+		return "", nil, err
+	}
+	if pixels := int64(imageConfig.Width) * int64(imageConfig.Height); pixels > irt.MaxPixels {
+		return "", nil, fmt.Errorf("%w: %vx%v is over %v pixels", ErrImageTooLarge, imageConfig.Width, imageConfig.Height, irt.MaxPixels)
+	}
+
+	src, _, err := image.Decode(io.MultiReader(header, contents))
+	if err != nil {
+		return "", nil, err
+	}
+
+	dst := src
+	width, height := fitWithin(src.Bounds().Dx(), src.Bounds().Dy(), irt.MaxWidth, irt.MaxHeight)
+	if width != src.Bounds().Dx() || height != src.Bounds().Dy() {
+		dst = resize(src, width, height)
+	}
+
+	out := &bytes.Buffer{}
+	if contentType == "image/png" {
+		err = png.Encode(out, dst)
+	} else {
+		err = jpeg.Encode(out, dst, &jpeg.Options{Quality: irt.Quality})
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	return contentType, out, nil
+}
+
+// fitWithin scales width and height down to fit within maxWidth and maxHeight, keeping the aspect ratio. A zero
+// maximum does not constrain that dimension. Images are never scaled up.
+func fitWithin(width int, height int, maxWidth int, maxHeight int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && height > maxHeight {
+		if heightScale := float64(maxHeight) / float64(height); heightScale < scale {
+			scale = heightScale
+		}
+	}
+	if scale == 1.0 {
+		return width, height
+	}
+
+	return max(1, int(float64(width)*scale+0.5)), max(1, int(float64(height)*scale+0.5))
+}
+
+// resize scales src down to width by height, drawing it straight into the smaller image
+func resize(src image.Image, width int, height int) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+	return dst
+}
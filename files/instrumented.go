@@ -0,0 +1,53 @@
+package files
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"io"
+)
+
+var fileStoreDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "rq_file_store_operation_duration_seconds",
+	Help: "Time taken by file store operations. Saves include reading the file from the client.",
+}, []string{"operation"})
+
+// InstrumentedFileStore records the duration of each operation on a FileStore. Open is timed until the file is
+// opened, not until it has been read.
+type InstrumentedFileStore struct {
+	store FileStore
+}
+
+// NewInstrumentedFileStore returns a FileStore which times each operation on store.
+func NewInstrumentedFileStore(store FileStore) *InstrumentedFileStore {
+	return &InstrumentedFileStore{store: store}
+}
+
+func (is *InstrumentedFileStore) Save(filename string, contents io.Reader) (string, error) {
+	defer prometheus.NewTimer(fileStoreDuration.WithLabelValues("save")).ObserveDuration()
+	return is.store.Save(filename, contents)
+}
+
+func (is *InstrumentedFileStore) Open(filename string) (io.ReadCloser, error) {
+	defer prometheus.NewTimer(fileStoreDuration.WithLabelValues("open")).ObserveDuration()
+	return is.store.Open(filename)
+}
+
+func (is *InstrumentedFileStore) Delete(filename string) error {
+	defer prometheus.NewTimer(fileStoreDuration.WithLabelValues("delete")).ObserveDuration()
+	return is.store.Delete(filename)
+}
+
+func (is *InstrumentedFileStore) Stat(filename string) (FileInfo, error) {
+	defer prometheus.NewTimer(fileStoreDuration.WithLabelValues("stat")).ObserveDuration()
+	return is.store.Stat(filename)
+}
+
+func (is *InstrumentedFileStore) List(prefix string) ([]FileInfo, error) {
+	defer prometheus.NewTimer(fileStoreDuration.WithLabelValues("list")).ObserveDuration()
+	return is.store.List(prefix)
+}
+
+func (is *InstrumentedFileStore) Usage() (int64, error) {
+	defer prometheus.NewTimer(fileStoreDuration.WithLabelValues("usage")).ObserveDuration()
+	return is.store.Usage()
+}
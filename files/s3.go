@@ -0,0 +1,344 @@
+package files
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"rq/config"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3Service   = "s3"
+	s3Algorithm = "AWS4-HMAC-SHA256"
+	// SHA-256 of an empty body, used when signing requests with no payload
+	s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3FileStore is a FileStore which saves files to a bucket on an S3-compatible object store, such as AWS S3 or MinIO.
+// Objects are addressed path-style, as {endpoint}/{bucket}/{prefix}{filename}.
+type S3FileStore struct {
+	config config.RqS3Config
+	client *http.Client
+	now    func() time.Time
+}
+
+// listBucketResult is the subset of the ListObjectsV2 response used by the S3FileStore
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// NewS3FileStore returns an S3FileStore for the bucket described in s3Config.
+func NewS3FileStore(s3Config config.RqS3Config) (*S3FileStore, error) {
+	if s3Config.Endpoint == "" || s3Config.Bucket == "" {
+		return nil, errors.New("s3 file store requires an endpoint and bucket")
+	}
+	if s3Config.Region == "" {
+		s3Config.Region = "us-east-1"
+	}
+	s3Config.Endpoint = strings.TrimRight(s3Config.Endpoint, "/")
+
+	return &S3FileStore{
+		config: s3Config,
+		client: &http.Client{Timeout: 5 * time.Minute},
+		now:    time.Now,
+	}, nil
+}
+
+// Save uploads contents to the bucket as an object named filename, under the configured prefix, returning the
+// SHA-256 checksum of the contents. The checksum is signed as the payload hash, so the store rejects a corrupted upload.
+func (s3fs *S3FileStore) Save(filename string, contents io.Reader) (string, error) {
+	// S3 requires the Content-Length of an upload up front, so the file is spooled to disk
+	// rather than held in memory, as uploads may be large.
+	tmp, err := createTempFile()
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), contents)
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	checksum := hash.Sum(nil)
+
+	req, err := http.NewRequest(http.MethodPut, s3fs.objectUrl(filename), io.NopCloser(tmp))
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+
+	res, err := s3fs.do(req, hex.EncodeToString(checksum))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	return hex.EncodeToString(checksum), nil
+}
+
+// Open returns a reader for the object named filename, which the caller must close.
+func (s3fs *S3FileStore) Open(filename string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, s3fs.objectUrl(filename), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s3fs.do(req, s3EmptyPayloadHash)
+	if err != nil {
+		return nil, objectNotFoundError(filename, err)
+	}
+	return res.Body, nil
+}
+
+// Delete removes the object named filename. As S3 reports success when deleting a missing object, the object is
+// checked first so a missing file returns ErrFileNotFound, as with other FileStores.
+func (s3fs *S3FileStore) Delete(filename string) error {
+	if _, err := s3fs.Stat(filename); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, s3fs.objectUrl(filename), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := s3fs.do(req, s3EmptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Stat returns the size and modified time of the object named filename.
+func (s3fs *S3FileStore) Stat(filename string) (FileInfo, error) {
+	req, err := http.NewRequest(http.MethodHead, s3fs.objectUrl(filename), nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	res, err := s3fs.do(req, s3EmptyPayloadHash)
+	if err != nil {
+		return FileInfo{}, objectNotFoundError(filename, err)
+	}
+	res.Body.Close()
+
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return FileInfo{Name: filename, Size: res.ContentLength, ModTime: modTime}, nil
+}
+
+// List returns the objects under the configured prefix whose names begin with prefix, sorted by name.
+func (s3fs *S3FileStore) List(prefix string) ([]FileInfo, error) {
+	fileInfos := []FileInfo{}
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", s3fs.config.Prefix+prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, s3fs.bucketUrl()+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := s3fs.do(req, s3EmptyPayloadHash)
+		if err != nil {
+			return nil, err
+		}
+
+		var result listBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding s3 list response: %v", err)
+		}
+
+		for _, object := range result.Contents {
+			fileInfos = append(fileInfos, FileInfo{
+				Name:    strings.TrimPrefix(object.Key, s3fs.config.Prefix),
+				Size:    object.Size,
+				ModTime: object.LastModified,
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			sort.Slice(fileInfos, func(i, j int) bool { return fileInfos[i].Name < fileInfos[j].Name })
+			return fileInfos, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Usage returns the total size in bytes of all objects under the configured prefix.
+func (s3fs *S3FileStore) Usage() (int64, error) {
+	fileInfos, err := s3fs.List("")
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, info := range fileInfos {
+		total += info.Size
+	}
+	return total, nil
+}
+
+// bucketUrl returns the path-style URL of the configured bucket
+func (s3fs *S3FileStore) bucketUrl() string {
+	return fmt.Sprintf("%v/%v", s3fs.config.Endpoint, s3URIEncode(s3fs.config.Bucket, true))
+}
+
+// objectUrl returns the path-style URL of the object for filename
+func (s3fs *S3FileStore) objectUrl(filename string) string {
+	return fmt.Sprintf("%v/%v", s3fs.bucketUrl(), s3URIEncode(s3fs.config.Prefix+filename, false))
+}
+
+// do signs req and sends it, returning an error for any non-2xx response and ErrFileNotFound for a 404
+func (s3fs *S3FileStore) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	s3fs.sign(req, payloadHash)
+
+	res, err := s3fs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, ErrFileNotFound
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, fmt.Errorf("s3 %v %v returned %v: %s", req.Method, req.URL.Path, res.Status, body)
+	}
+
+	return res, nil
+}
+
+// sign adds AWS Signature Version 4 headers to req.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s3fs *S3FileStore) sign(req *http.Request, payloadHash string) {
+	now := s3fs.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	shortDate := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%v/%v/%v/aws4_request", shortDate, s3fs.config.Region, s3Service)
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{s3Algorithm, amzDate, scope, hex.EncodeToString(canonicalHash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s3fs.config.SecretAccessKey), shortDate)
+	key = hmacSHA256(key, s3fs.config.Region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%v Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		s3Algorithm, s3fs.config.AccessKeyId, scope, signedHeaders, signature))
+}
+
+// objectNotFoundError adds the filename to an ErrFileNotFound returned by do
+func objectNotFoundError(filename string, err error) error {
+	if err == ErrFileNotFound {
+		return fmt.Errorf("%w: %v", ErrFileNotFound, filename)
+	}
+	return err
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery returns the query string sorted and encoded as required for signing
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3URIEncode(key, true)+"="+s3URIEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3URIEncode percent-encodes s as described by the SigV4 specification, optionally leaving slashes intact
+func s3URIEncode(s string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			encoded.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			encoded.WriteByte(b)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
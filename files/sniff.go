@@ -0,0 +1,127 @@
+package files
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"rq/helpers"
+	"strings"
+)
+
+// sniffLength is the number of bytes read from the start of a file to detect its content type
+const sniffLength = 512
+
+// ErrContentTypeNotAllowed is returned by CheckContentType when a file's contents are not an allowed type, or do not
+// match its extension
+var ErrContentTypeNotAllowed = errors.New("content type not allowed")
+
+// extensionMimeTypes maps the file extensions commonly uploaded to RQ to their MIME types, as the mime package's
+// built in table is small and the system tables may not exist (e.g. in a scratch container).
+var extensionMimeTypes = map[string]string{
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+	"bmp":  "image/bmp",
+	"heic": "image/heic",
+	"mp4":  "video/mp4",
+	"m4v":  "video/mp4",
+	"mov":  "video/quicktime",
+	"webm": "video/webm",
+	"avi":  "video/avi",
+	"mp3":  "audio/mpeg",
+	"wav":  "audio/wave",
+	"ogg":  "application/ogg",
+	"pdf":  "application/pdf",
+	"zip":  "application/zip",
+	// Text formats have no magic bytes, so are only ever detected as plain text
+	"txt":  "text/plain",
+	"csv":  "text/plain",
+	"json": "text/plain",
+}
+
+// ftypBrands maps ISO base media file brands to MIME types, as http.DetectContentType only recognises some mp4 files
+var ftypBrands = map[string]string{
+	"mp41": "video/mp4",
+	"mp42": "video/mp4",
+	"qt  ": "video/quicktime",
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"mif1": "image/heic",
+	"M4V ": "video/mp4",
+	"isom": "video/mp4",
+	"iso2": "video/mp4",
+	"avc1": "video/mp4",
+}
+
+// SniffContentType detects the MIME type of contents from its leading bytes. As those bytes are consumed from
+// contents, a reader is returned which yields the complete contents, for saving.
+func SniffContentType(contents io.Reader) (mimeType string, replay io.Reader, err error) {
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(contents, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	head = head[:n]
+
+	return detectContentType(head), io.MultiReader(bytes.NewReader(head), contents), nil
+}
+
+// CheckContentType sniffs the MIME type of contents and checks it is in permittedMimeTypes and matches the type
+// expected for extension. The returned reader yields the complete contents.
+func CheckContentType(contents io.Reader, extension string, permittedMimeTypes []string) (mimeType string, replay io.Reader, err error) {
+	mimeType, replay, err = SniffContentType(contents)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if !helpers.Contains(&permittedMimeTypes, mimeType) {
+		return mimeType, nil, fmt.Errorf("%w: file contents are %v, permitted types are %v",
+			ErrContentTypeNotAllowed, mimeType, strings.Join(permittedMimeTypes, ", "))
+	}
+
+	expected := MimeTypeForExtension(extension)
+	if expected != mimeType {
+		return mimeType, nil, fmt.Errorf("%w: file contents are %v but extension %v is %v",
+			ErrContentTypeNotAllowed, mimeType, extension, expected)
+	}
+
+	return mimeType, replay, nil
+}
+
+// MimeTypeForExtension returns the MIME type, without parameters, expected for a file extension, or
+// application/octet-stream if it is unknown.
+func MimeTypeForExtension(extension string) string {
+	extension = strings.ToLower(strings.TrimPrefix(extension, "."))
+	if mimeType, ok := extensionMimeTypes[extension]; ok {
+		return mimeType
+	}
+
+	if mimeType := mime.TypeByExtension("." + extension); mimeType != "" {
+		if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+			return mediaType
+		}
+	}
+
+	return "application/octet-stream"
+}
+
+// detectContentType returns the MIME type of a file from its leading bytes, without parameters
+func detectContentType(head []byte) string {
+	// ISO base media files (mp4, mov, heic) start with a box size followed by "ftyp" and the major brand
+	if len(head) >= 12 && string(head[4:8]) == "ftyp" {
+		if mimeType, ok := ftypBrands[string(head[8:12])]; ok {
+			return mimeType
+		}
+	}
+
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mediaType
+}
@@ -0,0 +1,60 @@
+package files
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+var (
+	jpegHeader = []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x10, 'J', 'F', 'I', 'F', 0x00}
+	mp4Header  = []byte{0x00, 0x00, 0x00, 0x18, 'f', 't', 'y', 'p', 'm', 'p', '4', '2', 0x00, 0x00, 0x00, 0x00}
+	movHeader  = []byte{0x00, 0x00, 0x00, 0x14, 'f', 't', 'y', 'p', 'q', 't', ' ', ' ', 0x00, 0x00, 0x00, 0x00}
+	exeHeader  = []byte{'M', 'Z', 0x90, 0x00, 0x03, 0x00, 0x00, 0x00}
+)
+
+func TestCheckContentType(t *testing.T) {
+	permitted := []string{"image/jpeg", "video/mp4", "video/quicktime"}
+
+	tests := []struct {
+		name         string
+		contents     []byte
+		extension    string
+		wantMimeType string
+		wantErr      bool
+	}{
+		{name: "jpeg with jpg extension", contents: jpegHeader, extension: "jpg", wantMimeType: "image/jpeg"},
+		{name: "jpeg with uppercase extension", contents: jpegHeader, extension: "JPEG", wantMimeType: "image/jpeg"},
+		{name: "mp4 with mp4 extension", contents: mp4Header, extension: "mp4", wantMimeType: "video/mp4"},
+		{name: "quicktime with mov extension", contents: movHeader, extension: "mov", wantMimeType: "video/quicktime"},
+		{name: "jpeg renamed to mp4", contents: jpegHeader, extension: "mp4", wantMimeType: "image/jpeg", wantErr: true},
+		{name: "executable renamed to mp4", contents: exeHeader, extension: "mp4", wantMimeType: "application/octet-stream", wantErr: true},
+		{name: "text renamed to jpg", contents: []byte("test file contents"), extension: "jpg", wantMimeType: "text/plain", wantErr: true},
+		{name: "empty file", contents: []byte{}, extension: "jpg", wantMimeType: "text/plain", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mimeType, replay, err := CheckContentType(bytes.NewReader(test.contents), test.extension, permitted)
+			if mimeType != test.wantMimeType {
+				t.Errorf("CheckContentType() mimeType = %v, want %v", mimeType, test.wantMimeType)
+			}
+			if test.wantErr {
+				if !errors.Is(err, ErrContentTypeNotAllowed) {
+					t.Errorf("CheckContentType() error = %v, want ErrContentTypeNotAllowed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CheckContentType() unexpected error = %v", err)
+			}
+
+			// The sniffed bytes must not be lost from the contents to be saved
+			got, _ := io.ReadAll(replay)
+			if !bytes.Equal(got, test.contents) {
+				t.Errorf("CheckContentType() replayed %v, want %v", got, test.contents)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package files
+
+import (
+	"fmt"
+	"io"
+	"rq/config"
+	"sync"
+)
+
+// Transform alters a stored file before it is sent onwards, for example to resize an image the destination would
+// reject. A Transform which does not apply to a file's content type returns it unchanged.
+type Transform interface {
+	Apply(contentType string, contents io.Reader) (newContentType string, transformed io.Reader, err error)
+}
+
+// TransformFactory creates a Transform from its config
+type TransformFactory func(transformConfig config.RqTransformConfig) (Transform, error)
+
+// TransformPipeline applies a series of Transforms to a file, in order
+type TransformPipeline struct {
+	transforms []Transform
+}
+
+var (
+	transformsMu sync.RWMutex
+	transforms   = map[string]TransformFactory{
+		"image_resize": NewImageResizeTransform,
+	}
+)
+
+// RegisterTransform makes a Transform available to be configured by name, so additional transforms (such as video
+// transcoding) can be plugged in without changing the pipeline.
+func RegisterTransform(name string, factory TransformFactory) {
+	transformsMu.Lock()
+	defer transformsMu.Unlock()
+	transforms[name] = factory
+}
+
+// NewTransformPipeline returns a TransformPipeline built from the transforms in transformConfigs.
+func NewTransformPipeline(transformConfigs []config.RqTransformConfig) (*TransformPipeline, error) {
+	transformsMu.RLock()
+	defer transformsMu.RUnlock()
+
+	pipeline := &TransformPipeline{}
+	for _, transformConfig := range transformConfigs {
+		factory, ok := transforms[transformConfig.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform: %v", transformConfig.Type)
+		}
+		transform, err := factory(transformConfig)
+		if err != nil {
+			return nil, fmt.Errorf("error creating transform %v: %w", transformConfig.Type, err)
+		}
+		pipeline.transforms = append(pipeline.transforms, transform)
+	}
+	return pipeline, nil
+}
+
+// Apply runs contents through each Transform in the pipeline, returning the final content type and contents.
+func (tp *TransformPipeline) Apply(contentType string, contents io.Reader) (string, io.Reader, error) {
+	if tp == nil {
+		return contentType, contents, nil
+	}
+
+	var err error
+	for _, transform := range tp.transforms {
+		contentType, contents, err = transform.Apply(contentType, contents)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return contentType, contents, nil
+}
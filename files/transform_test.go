@@ -0,0 +1,146 @@
+package files
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"rq/config"
+	"strings"
+	"testing"
+)
+
+func testImage(width int, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+func TestImageResizeTransform(t *testing.T) {
+	jpegImage := &bytes.Buffer{}
+	jpeg.Encode(jpegImage, testImage(400, 200), nil)
+	pngImage := &bytes.Buffer{}
+	png.Encode(pngImage, testImage(100, 300))
+
+	tests := []struct {
+		name        string
+		contentType string
+		contents    []byte
+		maxWidth    int
+		maxHeight   int
+		wantWidth   int
+		wantHeight  int
+		wantFormat  string
+	}{
+		{name: "jpeg wider than max", contentType: "image/jpeg", contents: jpegImage.Bytes(), maxWidth: 100, maxHeight: 100, wantWidth: 100, wantHeight: 50, wantFormat: "jpeg"},
+		{name: "png taller than max", contentType: "image/png", contents: pngImage.Bytes(), maxWidth: 100, maxHeight: 150, wantWidth: 50, wantHeight: 150, wantFormat: "png"},
+		{name: "only width constrained", contentType: "image/jpeg", contents: jpegImage.Bytes(), maxWidth: 200, wantWidth: 200, wantHeight: 100, wantFormat: "jpeg"},
+		{name: "smaller than max is not enlarged", contentType: "image/png", contents: pngImage.Bytes(), maxWidth: 1000, maxHeight: 1000, wantWidth: 100, wantHeight: 300, wantFormat: "png"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transform, err := NewImageResizeTransform(config.RqTransformConfig{MaxWidth: test.maxWidth, MaxHeight: test.maxHeight})
+			if err != nil {
+				t.Fatalf("NewImageResizeTransform() error = %v", err)
+			}
+
+			contentType, out, err := transform.Apply(test.contentType, bytes.NewReader(test.contents))
+			if err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+			if contentType != test.contentType {
+				t.Errorf("Apply() content type = %v, want %v", contentType, test.contentType)
+			}
+
+			img, format, err := image.Decode(out)
+			if err != nil {
+				t.Fatalf("transformed image could not be decoded: %v", err)
+			}
+			if format != test.wantFormat {
+				t.Errorf("transformed image format = %v, want %v", format, test.wantFormat)
+			}
+			if img.Bounds().Dx() != test.wantWidth || img.Bounds().Dy() != test.wantHeight {
+				t.Errorf("transformed image is %vx%v, want %vx%v", img.Bounds().Dx(), img.Bounds().Dy(), test.wantWidth, test.wantHeight)
+			}
+		})
+	}
+}
+
+func TestImageResizeTransformPassesThroughOtherTypes(t *testing.T) {
+	transform, _ := NewImageResizeTransform(config.RqTransformConfig{MaxWidth: 10})
+
+	contentType, out, err := transform.Apply("video/mp4", strings.NewReader("a video"))
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	contents, _ := io.ReadAll(out)
+	if contentType != "video/mp4" || string(contents) != "a video" {
+		t.Errorf("Apply() = %v %q, want the file unchanged", contentType, contents)
+	}
+}
+
+func TestImageResizeTransformTooLarge(t *testing.T) {
+	pngImage := &bytes.Buffer{}
+	png.Encode(pngImage, testImage(100, 300))
+	transform, _ := NewImageResizeTransform(config.RqTransformConfig{MaxWidth: 10, MaxPixels: 100 * 299})
+
+	if _, _, err := transform.Apply("image/png", bytes.NewReader(pngImage.Bytes())); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("Apply() error = %v, want %v", err, ErrImageTooLarge)
+	}
+}
+
+func TestImageResizeTransformInvalidImage(t *testing.T) {
+	transform, _ := NewImageResizeTransform(config.RqTransformConfig{MaxWidth: 10})
+
+	if _, _, err := transform.Apply("image/jpeg", strings.NewReader("not an image")); err == nil {
+		t.Error("Apply() of an invalid image returned no error")
+	}
+}
+
+type upperCaseTransform struct{}
+
+func (upperCaseTransform) Apply(contentType string, contents io.Reader) (string, io.Reader, error) {
+	out, err := io.ReadAll(contents)
+	if err != nil {
+		return "", nil, err
+	}
+	return contentType, strings.NewReader(strings.ToUpper(string(out))), nil
+}
+
+func TestTransformPipeline(t *testing.T) {
+	RegisterTransform("test_upper", func(config.RqTransformConfig) (Transform, error) {
+		return upperCaseTransform{}, nil
+	})
+
+	pipeline, err := NewTransformPipeline([]config.RqTransformConfig{{Type: "test_upper"}, {Type: "image_resize", MaxWidth: 10}})
+	if err != nil {
+		t.Fatalf("NewTransformPipeline() error = %v", err)
+	}
+	_, out, err := pipeline.Apply("text/plain", strings.NewReader("contents"))
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if contents, _ := io.ReadAll(out); string(contents) != "CONTENTS" {
+		t.Errorf("Apply() = %q, want %q", contents, "CONTENTS")
+	}
+
+	if _, err := NewTransformPipeline([]config.RqTransformConfig{{Type: "unknown"}}); err == nil {
+		t.Error("NewTransformPipeline() with an unknown transform returned no error")
+	}
+	if _, err := NewTransformPipeline([]config.RqTransformConfig{{Type: "image_resize", Quality: 101}}); err == nil {
+		t.Error("NewTransformPipeline() with an invalid quality returned no error")
+	}
+
+	var none *TransformPipeline
+	if _, out, _ := none.Apply("text/plain", strings.NewReader("contents")); out == nil {
+		t.Error("Apply() on a nil pipeline did not return the contents")
+	}
+}
@@ -0,0 +1,73 @@
+package files
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// CachedUsageFileStore is a FileStore which caches the total returned by Usage, as reading it walks every file
+// held. The bytes of files saved since the total was read are added to it, so it does not fall behind while uploads
+// arrive, and it is read again from the underlying FileStore once it is older than ttl. Deleted files are only
+// reflected once it is read again, so the cached total errs on the high side.
+type CachedUsageFileStore struct {
+	store FileStore
+	ttl   time.Duration
+	mu    sync.Mutex
+	usage int64
+	read  time.Time
+}
+
+// NewCachedUsageFileStore returns a FileStore which reads the usage of store at most once every ttl.
+func NewCachedUsageFileStore(store FileStore, ttl time.Duration) *CachedUsageFileStore {
+	return &CachedUsageFileStore{store: store, ttl: ttl}
+}
+
+// Save saves contents to the underlying FileStore, adding the bytes saved to the cached usage
+func (cfs *CachedUsageFileStore) Save(filename string, contents io.Reader) (string, error) {
+	counter := &countingReader{reader: contents}
+	checksum, err := cfs.store.Save(filename, counter)
+	if err != nil {
+		return "", err
+	}
+
+	cfs.mu.Lock()
+	cfs.usage += counter.count
+	cfs.mu.Unlock()
+	return checksum, nil
+}
+
+func (cfs *CachedUsageFileStore) Open(filename string) (io.ReadCloser, error) {
+	return cfs.store.Open(filename)
+}
+
+func (cfs *CachedUsageFileStore) Delete(filename string) error {
+	return cfs.store.Delete(filename)
+}
+
+func (cfs *CachedUsageFileStore) Stat(filename string) (FileInfo, error) {
+	return cfs.store.Stat(filename)
+}
+
+func (cfs *CachedUsageFileStore) List(prefix string) ([]FileInfo, error) {
+	return cfs.store.List(prefix)
+}
+
+// Usage returns the cached total size in bytes of the files held, reading it from the underlying FileStore if it is
+// older than the ttl. Callers arriving while it is read wait for the result rather than reading it again.
+func (cfs *CachedUsageFileStore) Usage() (int64, error) {
+	cfs.mu.Lock()
+	defer cfs.mu.Unlock()
+
+	if !cfs.read.IsZero() && time.Since(cfs.read) < cfs.ttl {
+		return cfs.usage, nil
+	}
+
+	usage, err := cfs.store.Usage()
+	if err != nil {
+		return 0, err
+	}
+	cfs.usage = usage
+	cfs.read = time.Now()
+	return usage, nil
+}
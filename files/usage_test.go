@@ -0,0 +1,47 @@
+package files
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// usageCountingFileStore counts the calls made to Usage
+type usageCountingFileStore struct {
+	FileStore
+	calls int
+}
+
+func (ucs *usageCountingFileStore) Usage() (int64, error) {
+	ucs.calls++
+	return ucs.FileStore.Usage()
+}
+
+func TestCachedUsageFileStore(t *testing.T) {
+	backing, _ := NewInMemoryFileStore()
+	backing.Save("rqid-existing.txt", strings.NewReader("12345"))
+	counting := &usageCountingFileStore{FileStore: backing}
+	store := NewCachedUsageFileStore(counting, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if usage, err := store.Usage(); usage != 5 || err != nil {
+			t.Fatalf("Usage() = %v, %v, want 5", usage, err)
+		}
+	}
+	if counting.calls != 1 {
+		t.Errorf("underlying Usage() called %v times, want once", counting.calls)
+	}
+
+	// Files saved are added to the cached total without reading it again
+	store.Save("rqid-new.txt", strings.NewReader("123"))
+	if usage, _ := store.Usage(); usage != 8 || counting.calls != 1 {
+		t.Errorf("Usage() after Save = %v with %v reads, want 8 with 1 read", usage, counting.calls)
+	}
+
+	// Deleted files are reflected once the total expires
+	store.Delete("rqid-existing.txt")
+	store.ttl = 0
+	if usage, _ := store.Usage(); usage != 3 || counting.calls != 2 {
+		t.Errorf("Usage() after expiry = %v with %v reads, want 3 with 2 reads", usage, counting.calls)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"rq/config"
+	"rq/files"
+	"rq/records"
+	"strings"
+)
+
+const (
+	healthOk     = "ok"
+	healthFailed = "fail"
+	// readinessProbePrefix names the files saved to and removed from the file store to check it is writable
+	readinessProbePrefix = ".rq-readiness-"
+)
+
+// HealthServer reports whether RQ is alive, and whether it is ready to accept requests, for orchestrators and load
+// balancers. Neither endpoint requires authentication, so the underlying errors of failed checks, which may name
+// paths or buckets, are only logged.
+type HealthServer struct {
+	Records *RecordServer
+	// FileStore is the disk or S3 store files are kept in, beneath any encryption, compression or deduplication,
+	// which the readiness probe is written to. The record server's FileStore is used if it is not set.
+	FileStore files.FileStore
+}
+
+// healthCheck is the result of a readiness check, with details such as the free disk space. The cause of a failed
+// check is logged but not served.
+type healthCheck struct {
+	Status  string         `json:"status"`
+	Error   string         `json:"error,omitempty"`
+	Details map[string]any `json:"details,omitempty"`
+	cause   error
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+// HandleLiveness reports that the process is running and serving requests
+func (hs *HealthServer) HandleLiveness(w http.ResponseWriter, req *http.Request) {
+	writeHealthResponse(w, healthResponse{Status: healthOk}, http.StatusOK)
+}
+
+// HandleReadiness runs each readiness check, responding with a 503 if any of them fail
+func (hs *HealthServer) HandleReadiness(w http.ResponseWriter, req *http.Request) {
+	response := healthResponse{
+		Status: healthOk,
+		Checks: map[string]healthCheck{
+			"record_store": hs.checkRecordStore(),
+			"file_store":   hs.checkFileStore(),
+			"disk_space":   hs.checkDiskSpace(),
+			"queue":        hs.checkQueue(),
+		},
+	}
+
+	status := http.StatusOK
+	for name, check := range response.Checks {
+		if check.Status != healthOk {
+			slog.WarnContext(req.Context(), "readiness check failed", "check", name, "error", check.Error, "cause", check.cause, "details", check.Details)
+			response.Status = healthFailed
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeHealthResponse(w, response, status)
+}
+
+// checkRecordStore checks the database can be reached
+func (hs *HealthServer) checkRecordStore() healthCheck {
+	if err := hs.Records.Store.Ping(); err != nil {
+		return failedCheck(errors.New("unable to reach the database"), nil).withCause(err)
+	}
+	return healthCheck{Status: healthOk}
+}
+
+// checkFileStore checks a small file can be saved to the file store, found and removed again. The probe goes to the
+// underlying disk or S3 store, so it is not encrypted, deduplicated or counted against the stored bytes.
+func (hs *HealthServer) checkFileStore() healthCheck {
+	store := hs.FileStore
+	if store == nil {
+		store = hs.Records.FileStore
+	}
+	details := map[string]any{"type": fileStoreType()}
+
+	probe := readinessProbePrefix + GenerateRequestId()
+	if _, err := store.Save(probe, strings.NewReader(healthOk)); err != nil {
+		return failedCheck(errors.New("unable to save to the file store"), details).withCause(err)
+	}
+	_, statErr := store.Stat(probe)
+	if err := store.Delete(probe); err != nil {
+		return failedCheck(errors.New("unable to remove from the file store"), details).withCause(err)
+	}
+	if statErr != nil {
+		return failedCheck(errors.New("unable to read from the file store"), details).withCause(statErr)
+	}
+	return healthCheck{Status: healthOk, Details: details}
+}
+
+// checkDiskSpace checks the free space of the directories written to, against the min_free_disk_bytes limit. The
+// directories are named by what they hold rather than their paths.
+func (hs *HealthServer) checkDiskSpace() healthCheck {
+	minFree := config.Config.Limits.MinFreeDiskBytes
+	details := map[string]any{"min_free_bytes": minFree}
+	paths := diskPaths()
+	for i, name := range []string{"upload_directory_free_bytes", "database_directory_free_bytes"} {
+		free, err := files.FreeSpace(paths[i])
+		if err != nil {
+			return failedCheck(errors.New("unable to check free disk space"), details).withCause(err)
+		}
+		details[name] = free
+		if free < minFree {
+			return failedCheck(errors.New("insufficient free disk space"), details)
+		}
+	}
+	return healthCheck{Status: healthOk, Details: details}
+}
+
+// checkQueue checks the records queued and failed are below the configured thresholds
+func (hs *HealthServer) checkQueue() healthCheck {
+	counts, err := hs.Records.Store.StatusCounts()
+	if err != nil {
+		return failedCheck(errors.New("unable to count records"), nil).withCause(err)
+	}
+	queued, failed := counts[records.StatusQueued], counts[records.StatusFailed]
+	details := map[string]any{"queued": queued, "failed": failed}
+
+	maxQueued := config.Config.Health.MaxQueuedRecords
+	if maxQueued == 0 {
+		maxQueued = config.Config.Limits.MaxQueuedRecords
+	}
+	if maxQueued > 0 && queued >= maxQueued {
+		details["max_queued"] = maxQueued
+		return failedCheck(errors.New("queue backlog reached the threshold"), details)
+	}
+	if maxFailed := config.Config.Health.MaxFailedRecords; maxFailed > 0 && failed >= maxFailed {
+		details["max_failed"] = maxFailed
+		return failedCheck(errors.New("failed records reached the threshold"), details)
+	}
+	return healthCheck{Status: healthOk, Details: details}
+}
+
+func failedCheck(err error, details map[string]any) healthCheck {
+	return healthCheck{Status: healthFailed, Error: err.Error(), Details: details}
+}
+
+// withCause sets the underlying error of a failed check, which is logged but not served as it may name paths
+func (hc healthCheck) withCause(err error) healthCheck {
+	hc.cause = err
+	return hc
+}
+
+// fileStoreType returns the type of store files are kept in, as selected by the file_store config value
+func fileStoreType() string {
+	if config.Config.FileStore == "" {
+		return "disk"
+	}
+	return config.Config.FileStore
+}
+
+func writeHealthResponse(w http.ResponseWriter, response healthResponse, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"rq/config"
+	"rq/files"
+	"rq/records"
+	"strings"
+	"testing"
+)
+
+func TestHealthServer_HandleLiveness(t *testing.T) {
+	hs := &HealthServer{Records: &RecordServer{}}
+	response := httptest.NewRecorder()
+	hs.HandleLiveness(response, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if response.Code != http.StatusOK {
+		t.Errorf("status = %v, want %v", response.Code, http.StatusOK)
+	}
+	if body := response.Body.String(); body != `{"status":"ok"}`+"\n" {
+		t.Errorf("body = %v", body)
+	}
+}
+
+func TestHealthServer_HandleReadiness(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	uploadDirectory := t.TempDir()
+	config.Config.Database.Filepath = uploadDirectory + "/db.sqlite"
+
+	// A file in place of the upload directory can't be written to, even when running as root
+	notDirectory := filepath.Join(t.TempDir(), "uploads")
+	os.WriteFile(notDirectory, nil, 0600)
+
+	failed := records.RqRecord{Id: "failed", Error: "connection refused"}
+	tests := []struct {
+		name       string
+		pingErr    error
+		readOnly   bool
+		records    []records.RqRecord
+		health     config.RqHealthConfig
+		limits     config.RqLimitsConfig
+		wantStatus int
+		wantFailed string
+	}{
+		{name: "ready", records: []records.RqRecord{{Id: "queued"}, failed}, health: config.RqHealthConfig{MaxQueuedRecords: 2, MaxFailedRecords: 2}, wantStatus: http.StatusOK},
+		{name: "database unreachable", pingErr: errors.New("database is closed"), wantStatus: http.StatusServiceUnavailable, wantFailed: "record_store"},
+		{name: "file store not writable", readOnly: true, wantStatus: http.StatusServiceUnavailable, wantFailed: "file_store"},
+		{name: "free disk space below minimum", limits: config.RqLimitsConfig{MinFreeDiskBytes: ^uint64(0) >> 1}, wantStatus: http.StatusServiceUnavailable, wantFailed: "disk_space"},
+		{name: "queue at limit", records: []records.RqRecord{{Id: "queued"}}, limits: config.RqLimitsConfig{MaxQueuedRecords: 1}, wantStatus: http.StatusServiceUnavailable, wantFailed: "queue"},
+		{name: "too many failed records", records: []records.RqRecord{failed}, health: config.RqHealthConfig{MaxFailedRecords: 1}, wantStatus: http.StatusServiceUnavailable, wantFailed: "queue"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config.Config.Health = test.health
+			config.Config.Limits = test.limits
+			config.Config.UploadDirectory = uploadDirectory
+			if test.readOnly {
+				config.Config.UploadDirectory = notDirectory
+			}
+
+			store := &MockMemoryRecordStore{db: make(map[string]records.RqRecord), pingErr: test.pingErr}
+			for _, record := range test.records {
+				store.Add(record)
+			}
+			fileStore, _ := files.NewInMemoryFileStore()
+			diskFileStore, _ := files.NewDiskFileStore()
+
+			hs := &HealthServer{Records: &RecordServer{Store: store, FileStore: fileStore}, FileStore: diskFileStore}
+			response := httptest.NewRecorder()
+			hs.HandleReadiness(response, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if response.Code != test.wantStatus {
+				t.Errorf("status = %v, want %v", response.Code, test.wantStatus)
+			}
+			var body healthResponse
+			if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q is not JSON: %v", response.Body.String(), err)
+			}
+			if strings.Contains(response.Body.String(), config.Config.UploadDirectory) {
+				t.Errorf("body %v contains the upload directory", response.Body.String())
+			}
+			if len(body.Checks) != 4 {
+				t.Errorf("checks = %v, want all four", body.Checks)
+			}
+			if storeType := body.Checks["file_store"].Details["type"]; storeType != "disk" {
+				t.Errorf("file_store type = %v, want disk", storeType)
+			}
+			if _, ok := body.Checks["disk_space"].Details["upload_directory_free_bytes"]; !ok && test.wantFailed != "file_store" {
+				t.Errorf("disk_space details = %v, want the upload directory's free space", body.Checks["disk_space"].Details)
+			}
+			for name, check := range body.Checks {
+				wantStatus := healthOk
+				if name == test.wantFailed {
+					wantStatus = healthFailed
+				}
+				if check.Status != wantStatus || (wantStatus == healthFailed) != (check.Error != "") {
+					t.Errorf("%v check = %+v, want %v", name, check, wantStatus)
+				}
+			}
+
+			if usage, _ := fileStore.Usage(); usage != 0 {
+				t.Errorf("record server's file store holds %v bytes after the check, want the probe written beneath it", usage)
+			}
+			if probes, _ := filepath.Glob(filepath.Join(uploadDirectory, readinessProbePrefix+"*")); len(probes) > 0 {
+				t.Errorf("upload directory holds %v after the check, want the probe removed", probes)
+			}
+		})
+	}
+}
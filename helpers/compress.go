@@ -0,0 +1,35 @@
+package helpers
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CompressionGzip is the name of the gzip compression algorithm in config and stored metadata
+const CompressionGzip = "gzip"
+
+// ErrUnsupportedCompression is returned when an unknown compression algorithm is configured or read
+var ErrUnsupportedCompression = errors.New("unsupported compression algorithm")
+
+// NewCompressWriter returns a writer which compresses to w with the given algorithm. It must be closed to flush the
+// compressed contents.
+func NewCompressWriter(algorithm string, w io.Writer) (io.WriteCloser, error) {
+	switch algorithm {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedCompression, algorithm)
+	}
+}
+
+// NewDecompressReader returns a reader which decompresses r with the given algorithm.
+func NewDecompressReader(algorithm string, r io.Reader) (io.ReadCloser, error) {
+	switch algorithm {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedCompression, algorithm)
+	}
+}
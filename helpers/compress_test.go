@@ -0,0 +1,39 @@
+package helpers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	contents := bytes.Repeat([]byte(`{"key":"value"}`), 50)
+
+	compressed := &bytes.Buffer{}
+	writer, err := NewCompressWriter(CompressionGzip, compressed)
+	if err != nil {
+		t.Fatalf("NewCompressWriter() error = %v", err)
+	}
+	writer.Write(contents)
+	writer.Close()
+
+	if compressed.Len() >= len(contents) {
+		t.Errorf("compressed size %v is not smaller than %v", compressed.Len(), len(contents))
+	}
+
+	reader, err := NewDecompressReader(CompressionGzip, compressed)
+	if err != nil {
+		t.Fatalf("NewDecompressReader() error = %v", err)
+	}
+	if out, _ := io.ReadAll(reader); !bytes.Equal(out, contents) {
+		t.Errorf("decompressed contents = %q, want %q", out, contents)
+	}
+
+	if _, err := NewCompressWriter("zstd", compressed); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Errorf("NewCompressWriter() error = %v, want %v", err, ErrUnsupportedCompression)
+	}
+	if _, err := NewDecompressReader("zstd", compressed); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Errorf("NewDecompressReader() error = %v, want %v", err, ErrUnsupportedCompression)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"rq/config"
+	"rq/files"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultRetryAfterSeconds is sent to clients when RQ is at capacity and no value is set in config
+	defaultRetryAfterSeconds = 60
+	// defaultMaxMemoryBytes is the total size of the form values read from a multipart form, as files are streamed
+	defaultMaxMemoryBytes = 320000
+	// usageCacheTTL is how long the FileStore's usage is cached for, as reading it walks every file held
+	usageCacheTTL = 10 * time.Second
+)
+
+// The reasons requests are rejected at capacity, which label rq_rejected_requests_total
+const (
+	reasonQueueFull          = "queue_full"
+	reasonStorageFull        = "storage_full"
+	reasonDiskFull           = "disk_full"
+	reasonTenantQueueQuota   = "tenant_queue_quota"
+	reasonTenantStorageQuota = "tenant_storage_quota"
+	reasonUsageUnavailable   = "usage_unavailable"
+)
+
+// checkCapacity checks the configured limits before a new request is accepted, so the request is rejected up front
+// rather than failing part way through writing to the database or upload directory. incomingBytes is the expected
+// size of the files in the request, or 0 if unknown or there are none.
+func (rs *RecordServer) checkCapacity(incomingBytes int64) error {
+	limits := config.Config.Limits
+
+	if limits.MaxQueuedRecords > 0 {
+		count, err := rs.Store.Count()
+		if err != nil {
+			return StatusError{
+				StatusCode: http.StatusServiceUnavailable,
+				Err:        fmt.Errorf("unable to count queued records: %v", err),
+				Reason:     reasonUsageUnavailable,
+			}
+		}
+		if count >= limits.MaxQueuedRecords {
+			return StatusError{
+				StatusCode: http.StatusServiceUnavailable,
+				Err:        fmt.Errorf("queue is full: %v records queued", count),
+				Reason:     reasonQueueFull,
+			}
+		}
+	}
+
+	if incomingBytes < 0 {
+		incomingBytes = 0
+	}
+
+	if limits.MaxStoredBytes > 0 {
+		usage, err := rs.FileStore.Usage()
+		if err != nil {
+			return StatusError{
+				StatusCode: http.StatusInsufficientStorage,
+				Err:        fmt.Errorf("unable to check file storage usage: %v", err),
+				Reason:     reasonUsageUnavailable,
+			}
+		}
+		if usage >= limits.MaxStoredBytes || usage+incomingBytes > limits.MaxStoredBytes {
+			return StatusError{
+				StatusCode: http.StatusInsufficientStorage,
+				Err:        fmt.Errorf("file storage limit reached: %v bytes stored", usage),
+				Reason:     reasonStorageFull,
+			}
+		}
+	}
+
+	if limits.MinFreeDiskBytes > 0 {
+		for _, path := range diskPaths() {
+			free, err := files.FreeSpace(path)
+			if err != nil {
+				slog.Warn("unable to check free disk space", "path", path, "error", err)
+				continue
+			}
+			if free < limits.MinFreeDiskBytes+uint64(incomingBytes) {
+				return StatusError{
+					StatusCode: http.StatusInsufficientStorage,
+					Err:        fmt.Errorf("insufficient free disk space: %v bytes available", free),
+					Reason:     reasonDiskFull,
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// incomingFileBytes returns the expected size of the files in req, the length of its body if it is a multipart form.
+// Other bodies are stored with the record rather than in the FileStore, so do not count towards max_stored_bytes.
+func incomingFileBytes(req *http.Request) int64 {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return 0
+	}
+	return req.ContentLength
+}
+
+// diskPaths returns the directories RQ writes to on local disk, the upload directory and the database's directory
+func diskPaths() []string {
+	return []string{config.Config.UploadDirectory, filepath.Dir(config.Config.Database.Filepath)}
+}
+
+// checkTenantQuota checks the quotas of the tenant making a request before it is accepted. incomingBytes is the
+// expected size of the files in the request, or 0 if unknown, measured as for checkCapacity. The tenant's stored bytes
+// include its uploads which are not yet attached to a record. Requests without a tenant are only subject to the
+// overall limits.
+func (rs *RecordServer) checkTenantQuota(tenant string, incomingBytes int64) error {
+	quota, ok := config.Config.Tenants[tenant]
+	if tenant == "" || !ok || (quota.MaxQueuedRecords <= 0 && quota.MaxStoredBytes <= 0) {
+		return nil
+	}
+
+	count, storedBytes, err := rs.Store.TenantUsage(tenant)
+	if err != nil {
+		return StatusError{
+			StatusCode: http.StatusServiceUnavailable,
+			Err:        fmt.Errorf("unable to check usage for tenant %v: %v", tenant, err),
+			Reason:     reasonUsageUnavailable,
+		}
+	}
+
+	if quota.MaxQueuedRecords > 0 && count >= quota.MaxQueuedRecords {
+		return StatusError{
+			StatusCode: http.StatusTooManyRequests,
+			Err:        fmt.Errorf("queue quota reached for tenant %v: %v records queued", tenant, count),
+			Reason:     reasonTenantQueueQuota,
+		}
+	}
+
+	if quota.MaxStoredBytes > 0 {
+		uploadBytes, err := tenantUploadBytes(rs.FileStore, tenant)
+		if err != nil {
+			return StatusError{
+				StatusCode: http.StatusServiceUnavailable,
+				Err:        fmt.Errorf("unable to check uploads for tenant %v: %v", tenant, err),
+				Reason:     reasonUsageUnavailable,
+			}
+		}
+		storedBytes += uploadBytes
+	}
+
+	if incomingBytes < 0 {
+		incomingBytes = 0
+	}
+	if quota.MaxStoredBytes > 0 && (storedBytes >= quota.MaxStoredBytes || storedBytes+incomingBytes > quota.MaxStoredBytes) {
+		return StatusError{
+			StatusCode: http.StatusInsufficientStorage,
+			Err:        fmt.Errorf("storage quota reached for tenant %v: %v bytes stored", tenant, storedBytes),
+			Reason:     reasonTenantStorageQuota,
+		}
+	}
+
+	return nil
+}
+
+// rejectAtCapacity writes the error from checkCapacity or checkTenantQuota, telling the client when to retry and
+// recording which limit was reached
+func rejectAtCapacity(w http.ResponseWriter, req *http.Request, err error) {
+	if statusErr, ok := err.(StatusError); ok {
+		setRejectReason(req, statusErr.Reason)
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds()))
+	ReturnHTTPErrorResponse(w, err.Error(), err.(HttpError).Status())
+}
+
+// retryAfterSeconds returns the Retry-After value sent to clients when RQ is at capacity
+func retryAfterSeconds() int {
+	if config.Config.Limits.RetryAfterSeconds > 0 {
+		return config.Config.Limits.RetryAfterSeconds
+	}
+	return defaultRetryAfterSeconds
+}
+
+// maxMemoryBytes returns the total size of the form values read from a multipart form, which are held in memory. Files
+// are streamed to the FileStore, so are not counted.
+func maxMemoryBytes() int64 {
+	if config.Config.Uploads.MaxMemoryBytes > 0 {
+		return config.Config.Uploads.MaxMemoryBytes
+	}
+	return defaultMaxMemoryBytes
+}
+
+// limitRequestBody caps the request body at the configured maximum request size, so reading stops as soon as the
+// limit is passed rather than after the whole body has been received.
+func limitRequestBody(w http.ResponseWriter, req *http.Request) error {
+	maxBytes := config.Config.Uploads.MaxRequestBytes
+	if maxBytes <= 0 {
+		return nil
+	}
+
+	if req.ContentLength > maxBytes {
+		return requestTooLargeError(maxBytes)
+	}
+
+	req.Body = http.MaxBytesReader(w, req.Body, maxBytes)
+	return nil
+}
+
+// asRequestTooLarge returns a 413 StatusError if err was caused by the request body exceeding its limit
+func asRequestTooLarge(err error) (error, bool) {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		return requestTooLargeError(maxBytesError.Limit), true
+	}
+	return err, false
+}
+
+func requestTooLargeError(maxBytes int64) error {
+	return StatusError{
+		StatusCode: http.StatusRequestEntityTooLarge,
+		Err:        fmt.Errorf("request body exceeds the maximum of %v bytes", maxBytes),
+	}
+}
+
+// checkFileLimits checks the number of files in a request and the size of each file against the configured limits.
+// fileSizes maps each form key to the sizes of the files submitted under it.
+func checkFileLimits(fileSizes map[string][]int64) error {
+	uploads := config.Config.Uploads
+
+	count := 0
+	for _, sizes := range fileSizes {
+		count += len(sizes)
+	}
+	if uploads.MaxFiles > 0 && count > uploads.MaxFiles {
+		return StatusError{
+			StatusCode: http.StatusRequestEntityTooLarge,
+			Err:        fmt.Errorf("too many files: %v submitted, maximum is %v", count, uploads.MaxFiles),
+		}
+	}
+
+	if uploads.MaxFileBytes > 0 {
+		for key, sizes := range fileSizes {
+			for _, size := range sizes {
+				if size > uploads.MaxFileBytes {
+					return fileTooLargeError(key, uploads.MaxFileBytes)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func fileTooLargeError(key string, maxBytes int64) error {
+	return StatusError{
+		StatusCode: http.StatusRequestEntityTooLarge,
+		Err:        fmt.Errorf("file for key %v exceeds the maximum of %v bytes", key, maxBytes),
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"rq/config"
+	"rq/files"
+	"rq/records"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordServer_checkCapacity(t *testing.T) {
+	defer func(limits config.RqLimitsConfig) { config.Config.Limits = limits }(config.Config.Limits)
+
+	tests := []struct {
+		name          string
+		limits        config.RqLimitsConfig
+		queued        int
+		storedBytes   int
+		incomingBytes int64
+		wantStatus    int
+	}{
+		{
+			name:       "no limits configured",
+			limits:     config.RqLimitsConfig{},
+			queued:     100,
+			wantStatus: 0,
+		},
+		{
+			name:       "queue below limit",
+			limits:     config.RqLimitsConfig{MaxQueuedRecords: 3},
+			queued:     2,
+			wantStatus: 0,
+		},
+		{
+			name:       "queue full",
+			limits:     config.RqLimitsConfig{MaxQueuedRecords: 2},
+			queued:     2,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:        "file storage full",
+			limits:      config.RqLimitsConfig{MaxStoredBytes: 10},
+			storedBytes: 10,
+			wantStatus:  http.StatusInsufficientStorage,
+		},
+		{
+			name:          "incoming upload would exceed file storage",
+			limits:        config.RqLimitsConfig{MaxStoredBytes: 10},
+			storedBytes:   5,
+			incomingBytes: 6,
+			wantStatus:    http.StatusInsufficientStorage,
+		},
+		{
+			name:       "free disk space below minimum",
+			limits:     config.RqLimitsConfig{MinFreeDiskBytes: ^uint64(0) >> 1},
+			wantStatus: http.StatusInsufficientStorage,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config.Config.Limits = test.limits
+			config.Config.UploadDirectory = t.TempDir()
+
+			store := &MockMemoryRecordStore{db: make(map[string]records.RqRecord)}
+			for i := 0; i < test.queued; i++ {
+				store.db[GenerateRequestId()] = records.RqRecord{}
+			}
+			fileStore, _ := files.NewInMemoryFileStore()
+			if test.storedBytes > 0 {
+				fileStore.Save("existing", bytes.NewReader(make([]byte, test.storedBytes)))
+			}
+
+			rs := &RecordServer{Store: store, FileStore: fileStore}
+			err := rs.checkCapacity(test.incomingBytes)
+
+			if test.wantStatus == 0 {
+				if err != nil {
+					t.Fatalf("checkCapacity() unexpected error: %v", err)
+				}
+				return
+			}
+			httpErr, ok := err.(HttpError)
+			if !ok {
+				t.Fatalf("checkCapacity() error = %v, want HttpError", err)
+			}
+			if httpErr.Status() != test.wantStatus {
+				t.Errorf("checkCapacity() status = %v, want %v", httpErr.Status(), test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRecordServer_ServeHTTPAtCapacity(t *testing.T) {
+	defer func(limits config.RqLimitsConfig) { config.Config.Limits = limits }(config.Config.Limits)
+	config.Config.Limits = config.RqLimitsConfig{MaxQueuedRecords: 1, RetryAfterSeconds: 30}
+
+	mfs, _ := files.NewInMemoryFileStore()
+	server := &RecordServer{
+		Store: &MockMemoryRecordStore{
+			db: map[string]records.RqRecord{"existing": {}},
+		},
+		FileStore: mfs,
+	}
+
+	response := httptest.NewRecorder()
+	RqHttpMiddleware(server).ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/?url=https://www.imagination.com", nil))
+
+	if response.Code != http.StatusServiceUnavailable {
+		t.Errorf("ServeHTTP() got %v, want %v", response.Code, http.StatusServiceUnavailable)
+	}
+	if got := response.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("ServeHTTP() Retry-After = %q, want %q", got, "30")
+	}
+}
+
+func TestIncomingFileBytes(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		want        int64
+	}{
+		{name: "multipart form", contentType: "multipart/form-data; boundary=xyz", want: 9},
+		{name: "json body is stored with the record", contentType: "application/json", want: 0},
+		{name: "form body is stored with the record", contentType: "application/x-www-form-urlencoded", want: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/?url=https://www.imagination.com", strings.NewReader("some body"))
+			req.Header.Set("Content-Type", test.contentType)
+			if got := incomingFileBytes(req); got != test.want {
+				t.Errorf("incomingFileBytes() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func newMultipartRequest(t *testing.T, files map[string][]byte) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for key, contents := range files {
+		part, err := writer.CreateFormFile(key, key+".jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(contents)
+	}
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/?url=https://www.imagination.com", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestRecordServer_ServeHTTPUploadLimits(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.Server.AllowedContentTypes = []string{"multipart/form-data", "application/json"}
+
+	tests := []struct {
+		name      string
+		uploads   config.RqUploadsConfig
+		request   func(t *testing.T) *http.Request
+		wantCode  int
+		wantError string
+	}{
+		{
+			name:    "within limits",
+			uploads: config.RqUploadsConfig{MaxFileBytes: 100, MaxFiles: 2, MaxRequestBytes: 10000},
+			request: func(t *testing.T) *http.Request {
+				return newMultipartRequest(t, map[string][]byte{"file": make([]byte, 100)})
+			},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:    "file too large",
+			uploads: config.RqUploadsConfig{MaxFileBytes: 100},
+			request: func(t *testing.T) *http.Request {
+				return newMultipartRequest(t, map[string][]byte{"small": make([]byte, 10), "large": make([]byte, 101)})
+			},
+			wantCode:  http.StatusRequestEntityTooLarge,
+			wantError: "file for key large exceeds the maximum of 100 bytes",
+		},
+		{
+			name:    "too many files",
+			uploads: config.RqUploadsConfig{MaxFiles: 1},
+			request: func(t *testing.T) *http.Request {
+				return newMultipartRequest(t, map[string][]byte{"first": {1}, "second": {2}})
+			},
+			wantCode:  http.StatusRequestEntityTooLarge,
+			wantError: "too many files: 2 submitted, maximum is 1",
+		},
+		{
+			name:    "request larger than content length limit",
+			uploads: config.RqUploadsConfig{MaxRequestBytes: 100},
+			request: func(t *testing.T) *http.Request {
+				return newMultipartRequest(t, map[string][]byte{"file": make([]byte, 1000)})
+			},
+			wantCode:  http.StatusRequestEntityTooLarge,
+			wantError: "request body exceeds the maximum of 100 bytes",
+		},
+		{
+			name:    "streamed request cut off at limit",
+			uploads: config.RqUploadsConfig{MaxRequestBytes: 100},
+			request: func(t *testing.T) *http.Request {
+				req := newMultipartRequest(t, map[string][]byte{"file": make([]byte, 1000)})
+				req.ContentLength = -1
+				return req
+			},
+			wantCode:  http.StatusRequestEntityTooLarge,
+			wantError: "request body exceeds the maximum of 100 bytes",
+		},
+		{
+			name:    "streamed json request cut off at limit",
+			uploads: config.RqUploadsConfig{MaxRequestBytes: 10},
+			request: func(t *testing.T) *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/?url=https://www.imagination.com", strings.NewReader(`{"foo":"a longer value"}`))
+				req.Header.Set("Content-Type", "application/json")
+				req.ContentLength = -1
+				return req
+			},
+			wantCode:  http.StatusRequestEntityTooLarge,
+			wantError: "request body exceeds the maximum of 10 bytes",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config.Config.Uploads = test.uploads
+
+			mfs, _ := files.NewInMemoryFileStore()
+			server := &RecordServer{
+				Store:     &MockMemoryRecordStore{db: make(map[string]records.RqRecord)},
+				FileStore: mfs,
+			}
+
+			response := httptest.NewRecorder()
+			RqHttpMiddleware(server).ServeHTTP(response, test.request(t))
+
+			if response.Code != test.wantCode {
+				t.Fatalf("ServeHTTP() got %v, want %v: %v", response.Code, test.wantCode, response.Body.String())
+			}
+			if test.wantError != "" {
+				var errorResponse ErrorResponse
+				json.NewDecoder(response.Body).Decode(&errorResponse)
+				if errorResponse.Error != test.wantError {
+					t.Errorf("ServeHTTP() error = %q, want %q", errorResponse.Error, test.wantError)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordServer_checkTenantQuota(t *testing.T) {
+	defer func(tenants map[string]config.RqTenantConfig) { config.Config.Tenants = tenants }(config.Config.Tenants)
+	config.Config.Tenants = map[string]config.RqTenantConfig{
+		"media":  {MaxQueuedRecords: 2, MaxStoredBytes: 100},
+		"retail": {},
+	}
+
+	store := &MockMemoryRecordStore{db: map[string]records.RqRecord{
+		"1": {Tenant: "media", StoredBytes: 60},
+		"2": {Tenant: "retail", StoredBytes: 1000},
+		"3": {Tenant: "retail", StoredBytes: 1000},
+	}}
+	fileStore, _ := files.NewInMemoryFileStore()
+	rs := &RecordServer{Store: store, FileStore: fileStore}
+
+	tests := []struct {
+		name          string
+		tenant        string
+		queued        int
+		uploadTenant  string
+		uploadBytes   int
+		incomingBytes int64
+		wantStatus    int
+	}{
+		{name: "no tenant", tenant: ""},
+		{name: "tenant without quotas", tenant: "retail", incomingBytes: 5000},
+		{name: "within quota", tenant: "media", incomingBytes: 40},
+		{name: "incoming request would exceed storage quota", tenant: "media", incomingBytes: 41, wantStatus: http.StatusInsufficientStorage},
+		{name: "queue quota reached", tenant: "media", queued: 1, wantStatus: http.StatusTooManyRequests},
+		{name: "upload in progress counts towards storage quota", tenant: "media", uploadTenant: "media", uploadBytes: 30, incomingBytes: 11, wantStatus: http.StatusInsufficientStorage},
+		{name: "another tenant's upload does not count", tenant: "media", uploadTenant: "retail", uploadBytes: 30, incomingBytes: 40},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < test.queued; i++ {
+				id := GenerateRequestId()
+				store.db[id] = records.RqRecord{Tenant: test.tenant}
+				defer delete(store.db, id)
+			}
+			if test.uploadBytes > 0 {
+				upload := RqUpload{Id: GenerateRequestId(), Tenant: test.uploadTenant, Length: 100, Created: time.Now()}
+				out, _ := json.Marshal(upload)
+				fileStore.Save(uploadInfoName(upload.Id), strings.NewReader(string(out)))
+				fileStore.Save(uploadChunkName(upload.Id, 0), strings.NewReader(strings.Repeat("a", test.uploadBytes)))
+				defer fileStore.Delete(uploadInfoName(upload.Id))
+				defer fileStore.Delete(uploadChunkName(upload.Id, 0))
+			}
+
+			err := rs.checkTenantQuota(test.tenant, test.incomingBytes)
+			if test.wantStatus == 0 {
+				if err != nil {
+					t.Fatalf("checkTenantQuota() unexpected error: %v", err)
+				}
+				return
+			}
+			httpErr, ok := err.(HttpError)
+			if !ok {
+				t.Fatalf("checkTenantQuota() error = %v, want HttpError", err)
+			}
+			if httpErr.Status() != test.wantStatus {
+				t.Errorf("checkTenantQuota() status = %v, want %v", httpErr.Status(), test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRecordServer_ServeHTTPTenantQuota(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.Tenants = map[string]config.RqTenantConfig{"media": {MaxQueuedRecords: 1}}
+	withAuthConfig(t, config.RqAuthConfig{
+		Enabled: true,
+		Keys: []config.RqAuthKeyConfig{
+			{Name: "studio", Type: "api_key", Key: "studio-key", Tenant: "media"},
+			{Name: "kiosk", Type: "api_key", Key: "kiosk-key"},
+		},
+	})
+
+	store := &MockMemoryRecordStore{db: make(map[string]records.RqRecord)}
+	mfs, _ := files.NewInMemoryFileStore()
+	handler := RqHttpMiddleware(RqAuthMiddleware(&RecordServer{Store: store, FileStore: mfs}))
+
+	enqueue := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/?url=https://www.imagination.com", strings.NewReader(`{"foo":"bar"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Api-Key", key)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		return response
+	}
+
+	response := enqueue("studio-key")
+	if response.Code != http.StatusOK {
+		t.Fatalf("first request got %v, want %v", response.Code, http.StatusOK)
+	}
+	record := store.db[response.Header().Get("RqId")]
+	if record.Tenant != "media" || record.StoredBytes != int64(len(record.Payload)) {
+		t.Errorf("record tenant = %q, stored bytes = %v", record.Tenant, record.StoredBytes)
+	}
+
+	if response := enqueue("studio-key"); response.Code != http.StatusTooManyRequests {
+		t.Errorf("request over quota got %v, want %v", response.Code, http.StatusTooManyRequests)
+	}
+
+	// Other tenants are unaffected
+	if response := enqueue("kiosk-key"); response.Code != http.StatusOK {
+		t.Errorf("request from another tenant got %v, want %v", response.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,153 @@
+// Package logging configures structured logging with log/slog. The id, method, destination host and tenant of a
+// request are carried in its context, and added to every record logged with that context, so each line can be
+// correlated with its request.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"rq/config"
+	"sort"
+	"strings"
+)
+
+// redacted replaces the values of sensitive headers
+const redacted = "[REDACTED]"
+
+// sensitiveHeaders are always redacted, in addition to any configured
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+type contextKey struct{}
+
+// redactedHeaders holds the canonical names of the headers redacted by Headers
+var redactedHeaders = headerSet(nil)
+
+// Setup replaces the default logger with one writing to w in the configured format and level, redacting the
+// configured headers and the API key header. Lines written with the log package are written by the new logger, at
+// info level.
+func Setup(w io.Writer) error {
+	loggingConfig := config.Config.Logging
+	logger, err := New(w, loggingConfig)
+	if err != nil {
+		return err
+	}
+	redactedHeaders = headerSet(append([]string{config.Config.Auth.ApiKeyHeader}, loggingConfig.RedactHeaders...))
+	slog.SetDefault(logger)
+	return nil
+}
+
+// New returns a logger writing to w in the configured format and level, which adds the attributes in the context of
+// each record
+func New(w io.Writer, loggingConfig config.RqLoggingConfig) (*slog.Logger, error) {
+	var level slog.Level
+	if loggingConfig.Level != "" {
+		if err := level.UnmarshalText([]byte(loggingConfig.Level)); err != nil {
+			return nil, fmt.Errorf("invalid log level: %v", loggingConfig.Level)
+		}
+	}
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(loggingConfig.Format) {
+	case "", "json":
+		handler = slog.NewJSONHandler(w, options)
+	case "text":
+		handler = slog.NewTextHandler(w, options)
+	default:
+		return nil, fmt.Errorf("unknown log format: %v", loggingConfig.Format)
+	}
+	return slog.New(contextHandler{handler}), nil
+}
+
+// request holds the attributes added to every record logged with a request's context
+type request struct {
+	rqId   string
+	method string
+	host   string
+	tenant string
+}
+
+// WithRequest returns a copy of ctx carrying the request's id, method and the host it is to be sent to, which are
+// added to every record logged with it
+func WithRequest(ctx context.Context, rqId string, method string, host string) context.Context {
+	return context.WithValue(ctx, contextKey{}, request{rqId: rqId, method: method, host: host})
+}
+
+// WithTenant returns a copy of ctx carrying the tenant the request was authenticated as
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	r, _ := ctx.Value(contextKey{}).(request)
+	r.tenant = tenant
+	return context.WithValue(ctx, contextKey{}, r)
+}
+
+// contextHandler adds the request attributes carried in a record's context before passing it on
+type contextHandler struct {
+	slog.Handler
+}
+
+func (ch contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if r, ok := ctx.Value(contextKey{}).(request); ok {
+		record.AddAttrs(
+			slog.String("rqid", r.rqId),
+			slog.String("method", r.method),
+			slog.String("host", r.host),
+			slog.String("tenant", r.tenant),
+		)
+	}
+	return ch.Handler.Handle(ctx, record)
+}
+
+func (ch contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{ch.Handler.WithAttrs(attrs)}
+}
+
+func (ch contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{ch.Handler.WithGroup(name)}
+}
+
+// Headers logs http headers as a group, with the values of sensitive headers redacted
+type Headers http.Header
+
+func (h Headers) LogValue() slog.Value {
+	names := []string{}
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	attrs := []slog.Attr{}
+	for _, name := range names {
+		value := strings.Join(h[name], ", ")
+		if redactedHeaders[http.CanonicalHeaderKey(name)] {
+			value = redacted
+		}
+		attrs = append(attrs, slog.String(name, value))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// Redact returns a copy of header with the values of the headers redacted from logs replaced, for showing headers
+// anywhere else they may be seen
+func Redact(header http.Header) http.Header {
+	out := http.Header{}
+	for name, values := range header {
+		if redactedHeaders[http.CanonicalHeaderKey(name)] {
+			values = []string{redacted}
+		}
+		out[name] = values
+	}
+	return out
+}
+
+func headerSet(extra []string) map[string]bool {
+	set := map[string]bool{}
+	for _, name := range append(append([]string{}, sensitiveHeaders...), extra...) {
+		if name != "" {
+			set[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	return set
+}
@@ -0,0 +1,132 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"rq/config"
+	"strings"
+	"testing"
+)
+
+func TestNewRequestAttrs(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger, err := New(out, config.RqLoggingConfig{})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	ctx := WithRequest(context.Background(), "4d6f7c1e", http.MethodPost, "api.example.com")
+	ctx = WithTenant(ctx, "acme")
+	logger.InfoContext(ctx, "processing request", "key", "photo")
+
+	var line map[string]any
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", out.String(), err)
+	}
+	want := map[string]string{
+		"msg":    "processing request",
+		"level":  "INFO",
+		"rqid":   "4d6f7c1e",
+		"method": http.MethodPost,
+		"host":   "api.example.com",
+		"tenant": "acme",
+		"key":    "photo",
+	}
+	for key, value := range want {
+		if line[key] != value {
+			t.Errorf("%v = %v, want %v", key, line[key], value)
+		}
+	}
+}
+
+func TestNewConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		loggingConfig config.RqLoggingConfig
+		wantErr       bool
+		wantLogged    bool
+		wantPrefix    string
+	}{
+		{name: "default", loggingConfig: config.RqLoggingConfig{}, wantLogged: true, wantPrefix: "{"},
+		{name: "debug text", loggingConfig: config.RqLoggingConfig{Level: "debug", Format: "text"}, wantLogged: true, wantPrefix: "time="},
+		{name: "above level", loggingConfig: config.RqLoggingConfig{Level: "warn"}, wantLogged: false},
+		{name: "invalid level", loggingConfig: config.RqLoggingConfig{Level: "verbose"}, wantErr: true},
+		{name: "invalid format", loggingConfig: config.RqLoggingConfig{Format: "xml"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			logger, err := New(out, test.loggingConfig)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			logger.Info("listening")
+			if logged := out.Len() > 0; logged != test.wantLogged {
+				t.Fatalf("logged %q, want logged %v", out.String(), test.wantLogged)
+			}
+			if !strings.HasPrefix(out.String(), test.wantPrefix) {
+				t.Errorf("logged %q, want prefix %q", out.String(), test.wantPrefix)
+			}
+		})
+	}
+}
+
+func TestSetupRedactsHeaders(t *testing.T) {
+	previousConfig, previousLogger := config.Config, slog.Default()
+	defer func() {
+		config.Config = previousConfig
+		slog.SetDefault(previousLogger)
+		redactedHeaders = headerSet(nil)
+	}()
+	config.Config.Logging = config.RqLoggingConfig{RedactHeaders: []string{"x-device-token"}}
+	config.Config.Auth.ApiKeyHeader = "X-Rq-Key"
+
+	out := &bytes.Buffer{}
+	if err := Setup(out); err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer secret")
+	headers.Set("Cookie", "session=secret")
+	headers.Set("X-Rq-Key", "secret")
+	headers.Set("X-Device-Token", "secret")
+	headers.Set("Content-Type", "application/json")
+	slog.Info("handling request", "headers", Headers(headers))
+
+	var line struct {
+		Headers map[string]string `json:"headers"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", out.String(), err)
+	}
+	for _, name := range []string{"Authorization", "Cookie", "X-Rq-Key", "X-Device-Token"} {
+		if line.Headers[name] != redacted {
+			t.Errorf("%v = %q, want it redacted", name, line.Headers[name])
+		}
+	}
+	if got := line.Headers["Content-Type"]; got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+
+	redactedCopy := Redact(headers)
+	for _, name := range []string{"Authorization", "Cookie", "X-Rq-Key", "X-Device-Token"} {
+		if got := redactedCopy.Get(name); got != redacted {
+			t.Errorf("Redact() %v = %q, want it redacted", name, got)
+		}
+	}
+	if got := redactedCopy.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Redact() Content-Type = %q, want application/json", got)
+	}
+	if got := headers.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("Redact() changed the headers given to it, Authorization = %q", got)
+	}
+}
@@ -1,17 +1,33 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
 	"net/http"
+	"os"
 	"rq/config"
+	"rq/delivery"
+	"rq/encryption"
 	"rq/files"
+	"rq/logging"
 	"rq/storage"
+	"rq/tracing"
 )
 
 func main() {
 	// TODO: Move profile selection to CLI arg / env var
 	if err := config.LoadConfigFile("default"); err != nil {
-		log.Fatal("Could not load config file", err)
+		fatal("could not load config file", err)
+	}
+	if err := logging.Setup(os.Stderr); err != nil {
+		fatal("error in logging config", err)
+	}
+	shutdownTracing, err := tracing.Setup(context.Background())
+	if err != nil {
+		fatal("error in tracing config", err)
 	}
 
 	addServerExcludedHeaders(&config.Config.Server.ExcludedHeaders)
@@ -19,15 +35,136 @@ func main() {
 	mux := http.NewServeMux()
 
 	databaseStore, err := storage.NewSqliteRecordStore(config.Config.Database.Filepath)
-	fileStore, err := files.NewDiskFileStore()
+	if err != nil {
+		fatal("error opening database connection", err)
+	}
+
+	fileStore, err := newFileStore()
+	if err != nil {
+		fatal("error creating file store", err)
+	}
+	if err := files.RemoveTempFiles(); err != nil {
+		fatal("error removing temporary files", err)
+	}
+	baseFileStore := fileStore
+
+	// Encryption sits beneath compression, as encrypted data does not compress
+	var encryptedStore *files.EncryptedFileStore
+	if config.Config.Encryption.Enabled {
+		keyring, err := encryption.LoadKeyring(config.Config.Encryption)
+		if err != nil {
+			fatal("error loading encryption keys", err)
+		}
+		databaseStore.Keyring = keyring
+		encryptedStore, _ = files.NewEncryptedFileStore(fileStore, keyring)
+		fileStore = encryptedStore
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		if err := rotateKeys(databaseStore, encryptedStore); err != nil {
+			fatal("error rotating keys", err)
+		}
+		return
+	}
+
+	// Compression sits beneath deduplication, so blobs are checksummed by their uncompressed contents
+	if compression := config.Config.Compression; compression.Enabled {
+		fileStore, err = files.NewCompressedFileStore(fileStore, compression.Algorithm, compression.MinBytes)
+		if err != nil {
+			fatal("error creating file store", err)
+		}
+	}
+
+	if config.Config.DeduplicateFiles {
+		blobIndex, err := databaseStore.NewBlobIndex()
+		if err != nil {
+			fatal("error creating blob index", err)
+		}
+		fileStore, _ = files.NewContentAddressedFileStore(fileStore, blobIndex)
+	}
+
+	recordStore := storage.NewInstrumentedRecordStore(databaseStore)
+	fileStore = files.NewCachedUsageFileStore(files.NewInstrumentedFileStore(fileStore), usageCacheTTL)
+	registerStoreMetrics(recordStore, fileStore)
 
+	urlPolicy, err := delivery.NewUrlPolicy(config.Config.UrlPolicy)
 	if err != nil {
-		log.Fatal("error opening database connection: ", err)
+		fatal("error in url policy config", err)
 	}
-	recordServer := &RecordServer{databaseStore, fileStore}
+	recordServer := &RecordServer{Store: recordStore, FileStore: fileStore, UrlPolicy: urlPolicy}
 	//HttpRequestHandler := http.HandlerFunc(QueueHttpHandler)
 
-	mux.Handle("/api/rq/http", RqHttpMiddleware(recordServer))
-	log.Fatal(http.ListenAndServe(":8080", mux))
+	uploadServer := &UploadServer{Records: recordServer}
+	healthServer := &HealthServer{Records: recordServer, FileStore: baseFileStore}
+	adminServer := &AdminServer{Records: recordServer}
+	statusServer := &StatusServer{Records: recordServer}
 
+	if err := checkAuthConfig(config.Config.Auth, config.Config.Tenants); err != nil {
+		fatal("error in auth config", err)
+	}
+	if err := checkAdminConfig(config.Config.Admin); err != nil {
+		fatal("error in admin config", err)
+	}
+
+	mux.Handle("/api/rq/http", RqMetricsMiddleware(enqueueRoute, RqHttpMiddleware(RqAuthMiddleware(recordServer))))
+	mux.Handle(uploadsPath, RqMetricsMiddleware("uploads", RqHttpMiddleware(RqAuthMiddleware(uploadServer))))
+	mux.Handle(uploadsPath+"/", RqMetricsMiddleware("uploads", RqHttpMiddleware(RqAuthMiddleware(uploadServer))))
+	mux.Handle(statusPath, RqMetricsMiddleware("status", RqHttpMiddleware(RqAuthMiddleware(statusServer))))
+	mux.Handle(recordsPath, RqMetricsMiddleware("status", RqHttpMiddleware(RqAuthMiddleware(statusServer))))
+	mux.Handle(recordsPath+"/", RqMetricsMiddleware("status", RqHttpMiddleware(RqAuthMiddleware(statusServer))))
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", healthServer.HandleLiveness)
+	mux.HandleFunc("/readyz", healthServer.HandleReadiness)
+	go uploadServer.RunSweeper(context.Background())
+	if config.Config.Delivery.Enabled {
+		sender, err := delivery.NewSender(fileStore)
+		if err != nil {
+			fatal("error in delivery config", err)
+		}
+		dispatcher := &Dispatcher{Records: recordServer, Sender: sender}
+		go dispatcher.Run(context.Background())
+	}
+	if config.Config.Admin.Enabled {
+		go func() { fatal("admin server stopped", listenAndServeAdmin(adminServer)) }()
+	}
+	err = listenAndServe(RqClientCertMiddleware(mux))
+	shutdownTracing(context.Background())
+	fatal("server stopped", err)
+
+}
+
+// fatal logs err and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// rotateKeys re-encrypts all records and files with the current encryption key. It is run with "rq rotate-keys" after
+// adding a new key to the start of the keyring, after which the old key can be removed.
+func rotateKeys(databaseStore *storage.SqliteRecordStore, encryptedStore *files.EncryptedFileStore) error {
+	if encryptedStore == nil {
+		return errors.New("encryption is not enabled")
+	}
+
+	rotatedRecords, err := databaseStore.RotateKeys()
+	slog.Info("re-encrypted records", "count", rotatedRecords)
+	if err != nil {
+		return err
+	}
+
+	rotatedFiles, err := encryptedStore.RotateKeys()
+	slog.Info("re-encrypted files", "count", rotatedFiles)
+	return err
+}
+
+// newFileStore returns the FileStore selected by the file_store config value, defaulting to disk storage.
+func newFileStore() (files.FileStore, error) {
+	switch config.Config.FileStore {
+	case "s3":
+		return files.NewS3FileStore(config.Config.S3)
+	case "", "disk":
+		return files.NewDiskFileStore()
+	default:
+		return nil, fmt.Errorf("unknown file store: %v", config.Config.FileStore)
+	}
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log/slog"
+	"mime"
+	"net/http"
+	"rq/config"
+	"rq/files"
+	"rq/helpers"
+	"rq/records"
+	"strings"
+)
+
+// enqueueRoute is the route label of the enqueue endpoint, whose requests are also counted by method, content type
+// and outcome
+const enqueueRoute = "enqueue"
+
+var (
+	enqueueRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rq_enqueue_requests_total",
+		Help: "Requests to enqueue a record, by method, content type and outcome.",
+	}, []string{"method", "content_type", "outcome"})
+	rejectedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rq_rejected_requests_total",
+		Help: "Requests rejected, by route and reason, the limit reached or otherwise the status text of the response.",
+	}, []string{"route", "reason"})
+)
+
+// rejectReasonKey is the context key of the reason a request was rejected, set by the handler for RqMetricsMiddleware
+type rejectReasonKey struct{}
+
+// setRejectReason records why req was rejected, for rejections whose status alone doesn't say which limit was reached
+func setRejectReason(req *http.Request, reason string) {
+	if rejectReason, ok := req.Context().Value(rejectReasonKey{}).(*string); ok && reason != "" {
+		*rejectReason = reason
+	}
+}
+
+// statusRecorder records the status code written to a ResponseWriter
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+// RqMetricsMiddleware counts the requests to route which are rejected, and for the enqueue route, every request by
+// its outcome. Label values are limited to known methods and content types, so clients cannot create new series.
+func RqMetricsMiddleware(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		rejectReason := ""
+		next.ServeHTTP(recorder, req.WithContext(context.WithValue(req.Context(), rejectReasonKey{}, &rejectReason)))
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		if status >= 400 {
+			if rejectReason == "" {
+				rejectReason = metricReason(status)
+			}
+			rejectedRequests.WithLabelValues(route, rejectReason).Inc()
+		}
+		if route == enqueueRoute {
+			enqueueRequests.WithLabelValues(metricMethod(req.Method), metricContentType(req.Header.Get("Content-Type")), metricOutcome(status)).Inc()
+		}
+	})
+}
+
+// storeCollector collects the gauges read from the stores each time metrics are scraped
+type storeCollector struct {
+	store      records.RecordStore
+	fileStore  files.FileStore
+	queueDepth *prometheus.Desc
+	storeBytes *prometheus.Desc
+}
+
+// registerStoreMetrics registers the gauges read from the stores each time metrics are collected. fileStore should
+// cache its usage, as it is read on every scrape and disk stores walk every file to total it.
+func registerStoreMetrics(store records.RecordStore, fileStore files.FileStore) {
+	prometheus.MustRegister(&storeCollector{
+		store:      store,
+		fileStore:  fileStore,
+		queueDepth: prometheus.NewDesc("rq_queue_depth", "Records held, by status.", []string{"status"}, nil),
+		storeBytes: prometheus.NewDesc("rq_file_store_bytes", "Bytes held in the file store.", nil, nil),
+	})
+}
+
+func (sc *storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sc.queueDepth
+	ch <- sc.storeBytes
+}
+
+// Collect sends the gauges which can be read. A store which can't be read is logged and its gauge left out, rather
+// than failing the whole scrape.
+func (sc *storeCollector) Collect(ch chan<- prometheus.Metric) {
+	counts, err := sc.store.StatusCounts()
+	if err != nil {
+		slog.Error("error collecting metric", "metric", "rq_queue_depth", "error", err)
+	} else {
+		for status, count := range counts {
+			ch <- prometheus.MustNewConstMetric(sc.queueDepth, prometheus.GaugeValue, float64(count), status)
+		}
+	}
+
+	usage, err := sc.fileStore.Usage()
+	if err != nil {
+		slog.Error("error collecting metric", "metric", "rq_file_store_bytes", "error", err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(sc.storeBytes, prometheus.GaugeValue, float64(usage))
+	}
+}
+
+func metricOutcome(status int) string {
+	switch {
+	case status < 400:
+		return "accepted"
+	case status >= 500 && status != http.StatusServiceUnavailable && status != http.StatusInsufficientStorage:
+		return "failed"
+	default:
+		return "rejected"
+	}
+}
+
+func metricReason(status int) string {
+	reason := strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+	if reason == "" {
+		return "unknown"
+	}
+	return reason
+}
+
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return method
+	default:
+		return "other"
+	}
+}
+
+func metricContentType(contentType string) string {
+	if contentType == "" {
+		return "none"
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !helpers.Contains(&config.Config.Server.AllowedContentTypes, mediaType) {
+		return "other"
+	}
+	return mediaType
+}
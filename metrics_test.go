@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"rq/config"
+	"rq/files"
+	"rq/records"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// metricValue returns the value of the sample written as line by the metrics endpoint, or 0 if there is none. Labels
+// are written in alphabetical order.
+func metricValue(t *testing.T, sample string) float64 {
+	out := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(out, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if out.Code != http.StatusOK {
+		t.Fatalf("metrics endpoint returned %v", out.Code)
+	}
+	scanner := bufio.NewScanner(strings.NewReader(out.Body.String()))
+	for scanner.Scan() {
+		if value, found := strings.CutPrefix(scanner.Text(), sample+" "); found {
+			parsed, _ := strconv.ParseFloat(value, 64)
+			return parsed
+		}
+	}
+	return 0
+}
+
+func TestRqMetricsMiddleware(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.Server.AllowedContentTypes = []string{"application/json"}
+
+	config.Config.Tenants = map[string]config.RqTenantConfig{"full": {MaxQueuedRecords: 1}}
+
+	store := &MockMemoryRecordStore{db: map[string]records.RqRecord{"queued": {Tenant: "full"}}}
+	mfs, _ := files.NewInMemoryFileStore()
+	handler := RqMetricsMiddleware(enqueueRoute, RqHttpMiddleware(&RecordServer{Store: store, FileStore: mfs}))
+
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		limits      config.RqLimitsConfig
+		tenant      string
+		wantCode    int
+		wantSamples []string
+	}{
+		{
+			name:        "accepted",
+			target:      "/?url=https://www.imagination.com",
+			contentType: "application/json; charset=utf-8",
+			wantCode:    http.StatusOK,
+			wantSamples: []string{`rq_enqueue_requests_total{content_type="application/json",method="POST",outcome="accepted"}`},
+		},
+		{
+			name:        "no url",
+			target:      "/",
+			contentType: "application/json",
+			wantCode:    http.StatusBadRequest,
+			wantSamples: []string{
+				`rq_enqueue_requests_total{content_type="application/json",method="POST",outcome="rejected"}`,
+				`rq_rejected_requests_total{reason="bad_request",route="enqueue"}`,
+			},
+		},
+		{
+			name:        "unknown content type",
+			target:      "/?url=https://www.imagination.com",
+			contentType: "text/x-made-up",
+			wantCode:    http.StatusBadRequest,
+			wantSamples: []string{`rq_enqueue_requests_total{content_type="other",method="POST",outcome="rejected"}`},
+		},
+		{
+			name:        "queue full",
+			target:      "/?url=https://www.imagination.com",
+			contentType: "application/json",
+			limits:      config.RqLimitsConfig{MaxQueuedRecords: 1},
+			wantCode:    http.StatusServiceUnavailable,
+			wantSamples: []string{`rq_rejected_requests_total{reason="queue_full",route="enqueue"}`},
+		},
+		{
+			name:        "tenant over quota",
+			target:      "/?url=https://www.imagination.com",
+			contentType: "application/json",
+			tenant:      "full",
+			wantCode:    http.StatusTooManyRequests,
+			wantSamples: []string{`rq_rejected_requests_total{reason="tenant_queue_quota",route="enqueue"}`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := map[string]float64{}
+			for _, sample := range test.wantSamples {
+				before[sample] = metricValue(t, sample)
+			}
+
+			config.Config.Limits = test.limits
+			req := httptest.NewRequest(http.MethodPost, test.target, strings.NewReader(`{"foo":"bar"}`))
+			req.Header.Set("Content-Type", test.contentType)
+			if test.tenant != "" {
+				req = req.WithContext(context.WithValue(req.Context(), "rqtenant", test.tenant))
+			}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, req)
+			assert.Equal(t, test.wantCode, response.Code)
+
+			for _, sample := range test.wantSamples {
+				assert.Equal(t, before[sample]+1, metricValue(t, sample), sample)
+			}
+		})
+	}
+}
+
+func TestRegisterStoreMetrics(t *testing.T) {
+	store := &MockMemoryRecordStore{db: map[string]records.RqRecord{
+		"a": {},
+		"b": {},
+		"c": {Error: "destination unavailable"},
+	}}
+	mfs, _ := files.NewInMemoryFileStore()
+	mfs.Save("video.mp4", strings.NewReader("a video"))
+
+	registerStoreMetrics(store, mfs)
+
+	assert.Equal(t, float64(2), metricValue(t, `rq_queue_depth{status="queued"}`))
+	assert.Equal(t, float64(1), metricValue(t, `rq_queue_depth{status="failed"}`))
+	assert.Equal(t, float64(7), metricValue(t, `rq_file_store_bytes`))
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"rq/config"
+	"rq/files"
+	"rq/records"
+	"rq/tracing"
+)
+
+// partReader wraps a multipart file part while it is saved, stopping the upload as soon as it passes the maximum
+// file size and keeping any read error, as not every FileStore preserves the error it was given.
+type partReader struct {
+	part     io.Reader
+	key      string
+	maxBytes int64
+	read     int64
+	tooLarge bool
+	err      error
+}
+
+func (pr *partReader) Read(p []byte) (int, error) {
+	n, err := pr.part.Read(p)
+	pr.read += int64(n)
+	if pr.maxBytes > 0 && pr.read > pr.maxBytes {
+		pr.tooLarge = true
+		return 0, fileTooLargeError(pr.key, pr.maxBytes)
+	}
+	if err != nil && err != io.EOF {
+		pr.err = err
+	}
+	return n, err
+}
+
+// HandleMultipartStream reads a multipart/form-data request one part at a time, streaming each file directly into
+// the FileStore rather than buffering it in memory or temporary files first. Form fields are collected into req.Form.
+// It returns the file keys in the order they were received, along with the stored file details for each key.
+//
+// If any part fails validation, files already saved for the request are deleted.
+func (rs *RecordServer) HandleMultipartStream(req *http.Request) (keys []string, storedFiles map[string]records.RqFile, err error) {
+
+	rqId := getRqId(req)
+
+	reader, err := req.MultipartReader()
+	if err != nil {
+		errMsg := fmt.Sprintf("error parsing multipart formdata, %v", err)
+		return nil, nil, StatusError{
+			StatusCode: http.StatusInternalServerError,
+			Err:        errors.New(errMsg),
+		}
+	}
+
+	form := req.URL.Query()
+	fileKeys := []string{}
+	saved := map[string]records.RqFile{}
+	fileCount := 0
+	valueBytes := int64(0)
+
+	// Remove anything already stored if the request is rejected part way through
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, storedFile := range saved {
+			if deleteErr := rs.FileStore.Delete(storedFile.Filename); deleteErr != nil {
+				slog.ErrorContext(req.Context(), "error removing file", "file", storedFile.Filename, "error", deleteErr)
+			}
+		}
+	}()
+
+	for {
+		part, partErr := reader.NextPart()
+		if partErr == io.EOF {
+			break
+		}
+		if partErr != nil {
+			return nil, nil, multipartReadError(partErr)
+		}
+
+		key := part.FormName()
+		if key == "" {
+			part.Close()
+			continue
+		}
+
+		// Form fields are held in memory, so are capped at the same size as a parsed multipart form would be
+		if part.FileName() == "" {
+			value, readErr := io.ReadAll(io.LimitReader(part, maxMemoryBytes()-valueBytes+1))
+			part.Close()
+			if readErr != nil {
+				return nil, nil, multipartReadError(readErr)
+			}
+			valueBytes += int64(len(value))
+			if valueBytes > maxMemoryBytes() {
+				return nil, nil, StatusError{
+					StatusCode: http.StatusRequestEntityTooLarge,
+					Err:        fmt.Errorf("form values exceed the maximum of %v bytes", maxMemoryBytes()),
+				}
+			}
+			form.Add(key, string(value))
+			continue
+		}
+
+		fileCount++
+		if maxFiles := config.Config.Uploads.MaxFiles; maxFiles > 0 && fileCount > maxFiles {
+			part.Close()
+			return nil, nil, StatusError{
+				StatusCode: http.StatusRequestEntityTooLarge,
+				Err:        fmt.Errorf("too many files: %v submitted, maximum is %v", fileCount, maxFiles),
+			}
+		}
+
+		// Files are saved as "{rqId}-{key}.{ext}", so a second file for a key is refused rather than replacing the first
+		if _, exists := saved[key]; exists {
+			part.Close()
+			return nil, nil, duplicateFileKeyError(key)
+		}
+
+		contents := &partReader{part: part, key: key, maxBytes: config.Config.Uploads.MaxFileBytes}
+		storedFile, saveErr := rs.saveFile(req.Context(), rqId, key, part.FileName(), contents)
+		part.Close()
+		if saveErr != nil {
+			switch {
+			case contents.tooLarge:
+				return nil, nil, fileTooLargeError(key, contents.maxBytes)
+			case contents.err != nil:
+				return nil, nil, multipartReadError(contents.err)
+			default:
+				return nil, nil, saveErr
+			}
+		}
+
+		fileKeys = append(fileKeys, key)
+		saved[key] = storedFile
+	}
+
+	req.Form = form
+	return fileKeys, saved, nil
+}
+
+// duplicateFileKeyError is returned when more than one file is sent for a key, as each key holds a single file
+func duplicateFileKeyError(key string) error {
+	return StatusError{
+		StatusCode: http.StatusBadRequest,
+		Err:        fmt.Errorf("more than one file sent for key %v", key),
+	}
+}
+
+// saveFile validates a single uploaded file and saves it to the FileStore as "{rqId}-{key}.{ext}".
+func (rs *RecordServer) saveFile(ctx context.Context, rqId string, key string, srcFileName string, file io.Reader) (records.RqFile, error) {
+
+	fileExtOk, ext := files.CheckExtensionIsAllowed(srcFileName, config.Config.PermittedFileExtensions)
+	if fileExtOk == false {
+		errMsg := fmt.Sprintf("File extension not allowed: %v", srcFileName)
+		return records.RqFile{}, StatusError{
+			StatusCode: http.StatusBadRequest,
+			Err:        errors.New(errMsg),
+		}
+	}
+
+	// Check the file's contents are what its extension claims, if content types are restricted in config
+	var contents io.Reader = file
+	contentType := files.MimeTypeForExtension(ext)
+	if len(config.Config.PermittedMimeTypes) > 0 {
+		var err error
+		contentType, contents, err = files.CheckContentType(file, ext, config.Config.PermittedMimeTypes)
+		if err != nil {
+			errMsg := fmt.Sprintf("file for key %v rejected: %v", key, err)
+			return records.RqFile{}, StatusError{
+				StatusCode: http.StatusUnsupportedMediaType,
+				Err:        errors.New(errMsg),
+			}
+		}
+	}
+
+	dstFileName := fmt.Sprintf("%v-%v.%v", rqId, key, ext)
+
+	counter := &countingReader{reader: contents}
+	_, span := tracing.Tracer().Start(ctx, "FileStore.Save", trace.WithAttributes(attribute.String("rq.file", dstFileName)))
+	checksum, err := rs.FileStore.Save(dstFileName, counter)
+	tracing.End(span, err)
+	if err != nil {
+		slog.ErrorContext(ctx, "error saving file", "file", dstFileName, "error", err)
+		return records.RqFile{}, StatusError{
+			StatusCode: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	return records.RqFile{
+		Filename:         dstFileName,
+		OriginalFilename: filepath.Base(srcFileName),
+		Size:             counter.count,
+		Checksum:         checksum,
+		ContentType:      contentType,
+	}, nil
+}
+
+// countingReader counts the bytes read through it, as a streamed file's size is not known until it has been saved
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.reader.Read(p)
+	cr.count += int64(n)
+	return n, err
+}
+
+// multipartReadError converts an error reading the multipart body into a StatusError
+func multipartReadError(err error) error {
+	if err, tooLarge := asRequestTooLarge(err); tooLarge {
+		return err
+	}
+	errMsg := fmt.Sprintf("error parsing multipart formdata, %v", err)
+	return StatusError{
+		StatusCode: http.StatusBadRequest,
+		Err:        errors.New(errMsg),
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"rq/config"
+	"rq/files"
+	"rq/records"
+	"testing"
+)
+
+type multipartField struct {
+	key      string
+	filename string
+	contents []byte
+}
+
+// newStreamedMultipartRequest builds a multipart request from fields in order, with no Content-Length, as a client
+// streaming an upload would send it
+func newStreamedMultipartRequest(t *testing.T, fields []multipartField) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, field := range fields {
+		var part io.Writer
+		var err error
+		if field.filename == "" {
+			part, err = writer.CreateFormField(field.key)
+		} else {
+			part, err = writer.CreateFormFile(field.key, field.filename)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(field.contents)
+	}
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/?url=https://www.imagination.com", io.NopCloser(body))
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.ContentLength = -1
+	return req
+}
+
+func TestRecordServer_HandleMultipartStream(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.PermittedFileExtensions = "mp4|jpg"
+
+	tests := []struct {
+		name          string
+		uploads       config.RqUploadsConfig
+		fields        []multipartField
+		wantKeys      []string
+		wantFilenames []string
+		wantStored    int
+		wantStatus    int
+	}{
+		{
+			name: "files and form fields",
+			fields: []multipartField{
+				{key: "mode", contents: []byte("test")},
+				{key: "image", filename: "image.jpg", contents: []byte("an image")},
+				{key: "video", filename: "video.mp4", contents: []byte("a video")},
+			},
+			wantKeys:      []string{"image", "video"},
+			wantFilenames: []string{"image.jpg", "video.mp4"},
+			wantStored:    2,
+		},
+		{
+			name: "second file for a key is refused and the first removed",
+			fields: []multipartField{
+				{key: "image", filename: "first.jpg", contents: []byte("first")},
+				{key: "image", filename: "second.jpg", contents: []byte("second")},
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "bad extension removes files already stored",
+			fields: []multipartField{
+				{key: "image", filename: "image.jpg", contents: []byte("an image")},
+				{key: "script", filename: "script.sh", contents: []byte("rm -rf /")},
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:    "oversized file is cut off while streaming",
+			uploads: config.RqUploadsConfig{MaxFileBytes: 10},
+			fields: []multipartField{
+				{key: "image", filename: "image.jpg", contents: []byte("small")},
+				{key: "video", filename: "video.mp4", contents: make([]byte, 1<<20)},
+			},
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:    "too many files",
+			uploads: config.RqUploadsConfig{MaxFiles: 1},
+			fields: []multipartField{
+				{key: "image", filename: "image.jpg", contents: []byte("an image")},
+				{key: "video", filename: "video.mp4", contents: []byte("a video")},
+			},
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config.Config.Uploads = test.uploads
+			mfs, _ := files.NewInMemoryFileStore()
+			rs := &RecordServer{Store: &MockMemoryRecordStore{}, FileStore: mfs}
+
+			req := newStreamedMultipartRequest(t, test.fields)
+			keys, storedFiles, err := rs.HandleMultipartStream(req)
+
+			stored, _ := mfs.List("")
+			if len(stored) != test.wantStored {
+				t.Errorf("HandleMultipartStream() left %v files in the FileStore, want %v", len(stored), test.wantStored)
+			}
+
+			if test.wantStatus != 0 {
+				httpErr, ok := err.(HttpError)
+				if !ok || httpErr.Status() != test.wantStatus {
+					t.Fatalf("HandleMultipartStream() error = %v, want status %v", err, test.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("HandleMultipartStream() unexpected error = %v", err)
+			}
+
+			if len(keys) != len(test.wantKeys) {
+				t.Fatalf("HandleMultipartStream() keys = %v, want %v", keys, test.wantKeys)
+			}
+			for i, key := range test.wantKeys {
+				if keys[i] != key {
+					t.Errorf("HandleMultipartStream() keys = %v, want %v", keys, test.wantKeys)
+				}
+				if storedFiles[key].Size == 0 || storedFiles[key].Checksum == "" {
+					t.Errorf("HandleMultipartStream() stored file for %v = %+v", key, storedFiles[key])
+				}
+				if storedFiles[key].OriginalFilename != test.wantFilenames[i] {
+					t.Errorf("HandleMultipartStream() original filename for %v = %v, want %v", key, storedFiles[key].OriginalFilename, test.wantFilenames[i])
+				}
+			}
+
+			if req.MultipartForm != nil && len(req.MultipartForm.File) > 0 {
+				t.Errorf("HandleMultipartStream() buffered the request into a MultipartForm")
+			}
+			if req.Form.Get("url") != "https://www.imagination.com" {
+				t.Errorf("HandleMultipartStream() form = %v, want querystring values included", req.Form)
+			}
+		})
+	}
+}
+
+func TestRecordServer_HandleMultipartStreamFileKeys(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.PermittedFileExtensions = "mp4|jpg"
+
+	// Test files are stored in memory
+	MockFileStore, _ := files.NewInMemoryFileStore()
+
+	// Create a request body
+	requestBody := &bytes.Buffer{}
+
+	// Create multipart writer
+	multipartWriter := multipart.NewWriter(requestBody)
+
+	// Write the file to the writer
+	fileWriter, err := multipartWriter.CreateFormFile("file", "test.jpg")
+	if err != nil {
+		t.Errorf("Error creating form file")
+	}
+
+	// Write the file contents to the writer
+	fileContents := []byte("test file contents")
+	_, err = fileWriter.Write(fileContents)
+	if err != nil {
+		t.Errorf("Error writing file contents")
+	}
+
+	// Close the writer
+	err = multipartWriter.Close()
+	if err != nil {
+		t.Errorf("Error closing multipart writer")
+	}
+
+	// Create a mock request
+	mockRequest := &http.Request{
+		Method: http.MethodPost,
+		URL:    &url.URL{Scheme: "http", Host: "localhost", Path: "/api/rq/http"},
+		Header: http.Header{"Content-Type": []string{multipartWriter.FormDataContentType()}},
+		Body:   io.NopCloser(requestBody),
+	}
+
+	// Create bad file
+	requestBodyBadExtension := &bytes.Buffer{}
+	multipartWriterBadExtension := multipart.NewWriter(requestBodyBadExtension)
+	fileWriterBadExtension, err := multipartWriterBadExtension.CreateFormFile("file", "test.exe")
+	if err != nil {
+		t.Errorf("Error creating bad form file")
+	}
+
+	badFileContents := []byte("test file contents")
+	_, err = fileWriterBadExtension.Write(badFileContents)
+
+	if err != nil {
+		t.Errorf("Error writing bad file contents")
+	}
+
+	err = multipartWriterBadExtension.Close()
+	if err != nil {
+		t.Errorf("Error closing bad multipart writer")
+	}
+
+	mockRequestBadFileExtension := &http.Request{
+		Method: http.MethodPost,
+		URL:    &url.URL{Scheme: "http", Host: "localhost", Path: "/api/rq/http"},
+		Header: http.Header{"Content-Type": []string{multipartWriterBadExtension.FormDataContentType()}},
+		Body:   io.NopCloser(requestBodyBadExtension),
+	}
+
+	type fields struct {
+		Store     records.RecordStore
+		FileStore files.FileStore
+	}
+	type args struct {
+		req *http.Request
+	}
+	tests := []struct {
+		name     string
+		fields   fields
+		args     args
+		wantKeys []string
+		wantErr  bool
+	}{
+		{
+			name:     "one file in request with matching keys",
+			fields:   fields{FileStore: MockFileStore, Store: &MockMemoryRecordStore{}},
+			args:     args{req: mockRequest},
+			wantKeys: []string{"file"},
+			wantErr:  false,
+		},
+		{
+			name:    "one file in request with bad extension",
+			fields:  fields{FileStore: MockFileStore, Store: &MockMemoryRecordStore{}},
+			args:    args{req: mockRequestBadFileExtension},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rs := &RecordServer{
+				Store:     test.fields.Store,
+				FileStore: test.fields.FileStore,
+			}
+
+			gotKeys, _, err := rs.HandleMultipartStream(test.args.req)
+			if (err != nil) != test.wantErr {
+				t.Errorf("HandleMultipartStream() error = %v, wantErr %v", err, test.wantErr)
+				return
+			}
+			if !test.wantErr && !reflect.DeepEqual(gotKeys, test.wantKeys) {
+				t.Errorf("HandleMultipartStream() gotKeys = %v, want %v", gotKeys, test.wantKeys)
+			}
+		})
+	}
+}
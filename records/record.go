@@ -1,25 +1,77 @@
 package records
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"rq/config"
+	"rq/encryption"
 	"rq/helpers"
+	"time"
 )
 
+// Record statuses, as counted by RecordStore.StatusCounts
+const (
+	StatusQueued = "queued"
+	StatusFailed = "failed"
+)
+
+// ErrNotFound is returned by a RecordStore when there is no record with the id given
+var ErrNotFound = errors.New("record not found")
+
 type RqRecord struct {
-	Id          string          `json:"id"`
-	Method      string          `json:"method"`
-	ContentType string          `json:"content_type"`
-	Headers     json.RawMessage `json:"headers"`
-	Url         string          `json:"url"`
-	FileKeys    string          `json:"file_keys"`
-	Payload     json.RawMessage `json:"payload"`
-	Error       string          `json:"error"`
+	Id              string          `json:"id"`
+	Method          string          `json:"method"`
+	ContentType     string          `json:"content_type"`
+	Headers         json.RawMessage `json:"headers"`
+	Url             string          `json:"url"`
+	Host            string          `json:"host" gorm:"index"`
+	Credential      string          `json:"credential"`
+	Tenant          string          `json:"tenant" gorm:"index"`
+	Client          string          `json:"client"`
+	CertSubject     string          `json:"cert_subject"`
+	FileKeys        string          `json:"file_keys"`
+	Files           json.RawMessage `json:"files"`
+	Payload         json.RawMessage `json:"payload"`
+	PayloadEncoding string          `json:"payload_encoding"`
+	KeyId           string          `json:"key_id"`
+	DataKey         []byte          `json:"-"`
+	StoredBytes     int64           `json:"stored_bytes"`
+	TraceParent     string          `json:"trace_parent"`
+	CreatedAt       time.Time       `json:"created_at" gorm:"index"`
+	Attempts        int             `json:"attempts"`
+	NextAttemptAt   time.Time       `json:"next_attempt_at" gorm:"index"`
+	Error           string          `json:"error"`
+}
+
+// RqFile describes a file uploaded with a request, as held in the FileStore. OriginalFilename is the name the client
+// uploaded it with, which it is sent onwards as.
+type RqFile struct {
+	Filename         string `json:"filename"`
+	OriginalFilename string `json:"original_filename"`
+	Size             int64  `json:"size"`
+	Checksum         string `json:"checksum"`
+	ContentType      string `json:"content_type"`
 }
 
 type RecordStore interface {
 	Add(record RqRecord) error
 	Get(id string) (*RqRecord, error)
+	Count() (int64, error)
+	TenantUsage(tenant string) (int64, int64, error)
+	StatusCounts() (map[string]int64, error)
+	TenantStatusCounts(tenant string) (map[string]int64, error)
+	HostStatusCounts() (map[string]map[string]int64, error)
+	List(status string, limit int) ([]RqRecord, error)
+	TenantList(tenant string, status string, limit int) ([]RqRecord, error)
+	QueuedIds(due time.Time, skipHosts []string, limit int) ([]string, error)
+	Defer(id string, until time.Time) error
+	Fail(id string, reason string) error
+	Requeue(id string) error
+	Delete(id string) error
+	Ping() error
 }
 
 // SetHeaders takes the headers from the request and adds to the Record , providing they are not in the config's
@@ -36,3 +88,139 @@ func (rr *RqRecord) SetHeaders(requestHeaders map[string][]string) {
 	out, _ := json.Marshal(headers)
 	rr.Headers = out
 }
+
+// SetFiles stores the details of the files uploaded with the request against the Record, keyed by form key.
+func (rr *RqRecord) SetFiles(files map[string]RqFile) {
+	out, _ := json.Marshal(files)
+	rr.Files = out
+}
+
+// GetFiles returns the details of the files uploaded with the request, keyed by form key.
+func (rr *RqRecord) GetFiles() (map[string]RqFile, error) {
+	files := map[string]RqFile{}
+	if len(rr.Files) == 0 {
+		return files, nil
+	}
+	err := json.Unmarshal(rr.Files, &files)
+	return files, err
+}
+
+// Status returns StatusFailed if sending the record has failed, and otherwise StatusQueued
+func (rr *RqRecord) Status() string {
+	if rr.Error != "" {
+		return StatusFailed
+	}
+	return StatusQueued
+}
+
+// Size returns the number of bytes held for the record, its payload and the files uploaded with it, before any
+// compression or deduplication.
+func (rr *RqRecord) Size() int64 {
+	size := int64(len(rr.Payload))
+	storedFiles, _ := rr.GetFiles()
+	for _, storedFile := range storedFiles {
+		size += storedFile.Size
+	}
+	return size
+}
+
+// CompressPayload compresses the payload with algorithm for storage, recording the algorithm in PayloadEncoding.
+func (rr *RqRecord) CompressPayload(algorithm string) error {
+	if rr.PayloadEncoding != "" {
+		return nil
+	}
+
+	out := &bytes.Buffer{}
+	writer, err := helpers.NewCompressWriter(algorithm, out)
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(rr.Payload); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	rr.Payload = out.Bytes()
+	rr.PayloadEncoding = algorithm
+	return nil
+}
+
+// DecompressPayload restores a payload compressed by CompressPayload. Payloads stored uncompressed are unchanged.
+func (rr *RqRecord) DecompressPayload() error {
+	if rr.PayloadEncoding == "" {
+		return nil
+	}
+
+	reader, err := helpers.NewDecompressReader(rr.PayloadEncoding, bytes.NewReader(rr.Payload))
+	if err != nil {
+		return fmt.Errorf("error decompressing payload for record %v: %w", rr.Id, err)
+	}
+	defer reader.Close()
+
+	payload, err := io.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("error decompressing payload for record %v: %w", rr.Id, err)
+	}
+
+	rr.Payload = payload
+	rr.PayloadEncoding = ""
+	return nil
+}
+
+// Encrypt encrypts the headers and payload with a new data key, which is stored on the record encrypted with the
+// keyring's current key. Records which are already encrypted are unchanged.
+func (rr *RqRecord) Encrypt(keyring *encryption.Keyring) error {
+	if rr.KeyId != "" {
+		return nil
+	}
+
+	dataKey, keyId, wrapped, err := keyring.NewDataKey()
+	if err != nil {
+		return err
+	}
+	headers, err := encryption.Seal(dataKey, rr.Headers)
+	if err != nil {
+		return err
+	}
+	payload, err := encryption.Seal(dataKey, rr.Payload)
+	if err != nil {
+		return err
+	}
+
+	rr.Headers = headers
+	rr.Payload = payload
+	rr.KeyId = keyId
+	rr.DataKey = wrapped
+	return nil
+}
+
+// Decrypt restores the headers and payload encrypted by Encrypt. Records stored unencrypted are unchanged.
+func (rr *RqRecord) Decrypt(keyring *encryption.Keyring) error {
+	if rr.KeyId == "" {
+		return nil
+	}
+	if keyring == nil {
+		return fmt.Errorf("record %v is encrypted but encryption is not enabled", rr.Id)
+	}
+
+	dataKey, err := keyring.UnwrapDataKey(rr.KeyId, rr.DataKey)
+	if err != nil {
+		return fmt.Errorf("error decrypting record %v: %w", rr.Id, err)
+	}
+	headers, err := encryption.Open(dataKey, rr.Headers)
+	if err != nil {
+		return fmt.Errorf("error decrypting headers for record %v: %w", rr.Id, err)
+	}
+	payload, err := encryption.Open(dataKey, rr.Payload)
+	if err != nil {
+		return fmt.Errorf("error decrypting payload for record %v: %w", rr.Id, err)
+	}
+
+	rr.Headers = headers
+	rr.Payload = payload
+	rr.KeyId = ""
+	rr.DataKey = nil
+	return nil
+}
@@ -6,16 +6,28 @@ import (
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"io"
-	"log"
+	"log/slog"
 	"mime"
 	"net/http"
+	"net/url"
 	"rq/config"
+	"rq/delivery"
 	"rq/files"
 	"rq/helpers"
+	"rq/logging"
 	"rq/records"
+	"rq/tracing"
+	"strings"
+	"sync"
 )
 
+// credentialQueryKey is the querystring parameter naming the credential profile to send a request with
+const credentialQueryKey = "credential"
+
 type HttpError interface {
 	error
 	Status() int
@@ -24,6 +36,8 @@ type HttpError interface {
 type StatusError struct {
 	StatusCode int
 	Err        error
+	// Reason names the limit a request was rejected by in metrics, if the status alone doesn't say
+	Reason string
 }
 
 type ErrorResponse struct {
@@ -38,6 +52,11 @@ type RqRequest struct {
 type RecordServer struct {
 	Store     records.RecordStore
 	FileStore files.FileStore
+	// UrlPolicy checks the urls requests are enqueued for. If nil, it is built from config for each request.
+	UrlPolicy *delivery.UrlPolicy
+	// uploadClaims holds the ids of resumable uploads being attached to a record or removed, so only one request can
+	// attach each upload, and an upload is not removed while it is attached
+	uploadClaims sync.Map
 }
 
 func (s StatusError) Error() string {
@@ -63,14 +82,48 @@ func (rs *RecordServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Reject the request before anything is written if the queue or disk is full, or the tenant is over quota
+	tenant := getRqTenant(req)
+	incomingBytes := incomingFileBytes(req)
+	err := rs.checkCapacity(incomingBytes)
+	if err == nil {
+		err = rs.checkTenantQuota(tenant, incomingBytes)
+	}
+	if err != nil {
+		slog.WarnContext(req.Context(), "request rejected", "error", err)
+		rejectAtCapacity(w, req, err)
+		return
+	}
+
+	// Cut off oversized requests while they are being read
+	if err := limitRequestBody(w, req); err != nil {
+		ReturnHTTPErrorResponse(w, err.Error(), err.(HttpError).Status())
+		return
+	}
+
 	// Don't create the record until the request is mildly valid
 	record := records.RqRecord{
-		Id:     rqId,
-		Method: req.Method,
-		Error:  "",
+		Id:          rqId,
+		Method:      req.Method,
+		Tenant:      tenant,
+		Client:      getRqClient(req),
+		CertSubject: getRqCertSubject(req),
+		TraceParent: tracing.TraceParent(req.Context()),
+		Error:       "",
 	}
 
-	record.Url = url
+	if err := rs.HandleUrl(req.Context(), url, &record); err != nil {
+		slog.WarnContext(req.Context(), "request rejected", "error", err)
+		ReturnHTTPErrorResponse(w, err.Error(), err.(HttpError).Status())
+		return
+	}
+
+	if err := rs.HandleCredential(querystring.Get(credentialQueryKey), &record); err != nil {
+		ReturnHTTPErrorResponse(w, err.Error(), err.(HttpError).Status())
+		return
+	}
+	querystring.Del(credentialQueryKey)
+
 	out, _ := json.Marshal(querystring)
 
 	rqreq := RqRequest{
@@ -84,7 +137,12 @@ func (rs *RecordServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	case http.MethodGet:
 
-		err := rs.saveRecord(record)
+		// Files are sent as a multipart body, which a GET request does not have
+		if len(querystring[uploadQueryKey]) > 0 {
+			ReturnHTTPErrorResponse(w, "uploads can only be attached to POST, PUT or PATCH requests", http.StatusBadRequest)
+			return
+		}
+		err := rs.saveRecord(req.Context(), record)
 		if err != nil {
 			switch e := err.(type) {
 			case HttpError:
@@ -123,13 +181,14 @@ func (rs *RecordServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 
 // HandleRequest processes the request made, validates it, saves media and builds up the record to be stored.
-func (rs *RecordServer) HandleRequest(req *http.Request, record *records.RqRecord) error {
+func (rs *RecordServer) HandleRequest(req *http.Request, record *records.RqRecord) (err error) {
 
-	// Get RqId
-	rqId := getRqId(req)
+	ctx, span := tracing.Tracer().Start(req.Context(), "HandleRequest")
+	defer func() { tracing.End(span, err) }()
+	req = req.WithContext(ctx)
 
 	// Log request
-	log.Printf("%v: Got a %v request", rqId, req.Method)
+	slog.DebugContext(req.Context(), "handling request", "headers", logging.Headers(req.Header))
 
 	// Get the Content-Type full header
 	contentTypeHeader := req.Header.Get("Content-Type")
@@ -167,7 +226,15 @@ func (rs *RecordServer) HandleRequest(req *http.Request, record *records.RqRecor
 
 	// Process payload for application/json requests
 	if mediaType == "application/json" {
-		rs.HandleJsonPayload(req.Body, record)
+		if err := rs.HandleJsonPayload(req.Body, record); err != nil {
+			if err, tooLarge := asRequestTooLarge(err); tooLarge {
+				return err
+			}
+			return StatusError{
+				StatusCode: http.StatusBadRequest,
+				Err:        fmt.Errorf("error reading request body: %v", err),
+			}
+		}
 	}
 
 	media_types := []string{"application/x-www-form-urlencoded", "multipart/form-data"}
@@ -178,10 +245,22 @@ func (rs *RecordServer) HandleRequest(req *http.Request, record *records.RqRecor
 	// Save Headers to Record
 	record.SetHeaders(req.Header)
 
-	err = rs.saveRecord(*record)
+	// Attach any files uploaded in advance with resumable uploads. The files sent with the request are removed if the
+	// record isn't saved, while uploads are kept to be attached again.
+	sentFiles, _ := record.GetFiles()
+	uploadIds, err := rs.HandleUploadReferences(req.URL.Query(), record)
+	if err != nil {
+		rs.removeFiles(req.Context(), sentFiles)
+		return err
+	}
+
+	err = rs.saveRecord(req.Context(), *record)
 	if err != nil {
+		rs.unclaimUploads(uploadIds)
+		rs.removeFiles(req.Context(), sentFiles)
 		return err
 	}
+	rs.releaseUploads(req.Context(), uploadIds)
 
 	return nil
 }
@@ -199,14 +278,6 @@ func (rs *RecordServer) HandleMediaType(mediaType string, req *http.Request, rec
 	*/
 
 	if mediaType == "multipart/form-data" {
-		//TODO: Set maxMemory in config or env var?
-		if err := req.ParseMultipartForm(320000); err != nil {
-			errMsg := fmt.Sprintf("error parsing multipart formdata, %v", err)
-			return StatusError{
-				StatusCode: http.StatusInternalServerError,
-				Err:        errors.New(errMsg),
-			}
-		}
 
 		/*
 			File Handler
@@ -218,17 +289,12 @@ func (rs *RecordServer) HandleMediaType(mediaType string, req *http.Request, rec
 			and puts the onus on the calling service to ensure keys match the onward API requirements.
 
 			As such, a list of file keys in the request is stored and appended to the stored file name.
-		*/
 
-		if len(req.MultipartForm.File) == 0 {
-			errMsg := fmt.Sprintf("no file submitted but Content-Type %v used", mediaType)
-			return StatusError{
-				StatusCode: http.StatusBadRequest,
-				Err:        errors.New(errMsg),
-			}
-		}
+			Each part of the request is streamed straight into the FileStore as it arrives, rather than
+			being buffered to temporary files by req.ParseMultipartForm() and then copied again.
+		*/
 
-		keys, err := rs.HandleFilesInRequest(req)
+		keys, storedFiles, err := rs.HandleMultipartStream(req)
 		if err != nil {
 			switch e := err.(type) {
 			case HttpError:
@@ -244,8 +310,17 @@ func (rs *RecordServer) HandleMediaType(mediaType string, req *http.Request, rec
 			}
 		}
 
+		if len(keys) == 0 {
+			errMsg := fmt.Sprintf("no file submitted but Content-Type %v used", mediaType)
+			return StatusError{
+				StatusCode: http.StatusBadRequest,
+				Err:        errors.New(errMsg),
+			}
+		}
+
 		out, _ := json.Marshal(keys)
 		record.FileKeys = string(out)
+		record.SetFiles(storedFiles)
 
 	}
 
@@ -255,8 +330,10 @@ func (rs *RecordServer) HandleMediaType(mediaType string, req *http.Request, rec
 		curl -v -d "url=https://imagination.com" -X POST http://localhost:8080/api/rq/http
 	*/
 	if mediaType == "application/x-www-form-urlencoded" {
-		//TODO: Set maxMemory in config or env var?
 		if err := req.ParseForm(); err != nil {
+			if err, tooLarge := asRequestTooLarge(err); tooLarge {
+				return err
+			}
 			errMsg := fmt.Sprintf("error parsing  formdata, %v", err)
 			return StatusError{
 				StatusCode: http.StatusInternalServerError,
@@ -271,8 +348,8 @@ func (rs *RecordServer) HandleMediaType(mediaType string, req *http.Request, rec
 	return nil
 }
 
-// HandleUrl takes the URL from the querystring and adds to the record
-func (rs *RecordServer) HandleUrl(url string, record *records.RqRecord) error {
+// HandleUrl takes the URL from the querystring, checks it is permitted by the URL policy and adds to the record
+func (rs *RecordServer) HandleUrl(ctx context.Context, url string, record *records.RqRecord) error {
 	if url == "" {
 		errMsg := fmt.Sprintf("no URL provided")
 		return StatusError{
@@ -281,90 +358,95 @@ func (rs *RecordServer) HandleUrl(url string, record *records.RqRecord) error {
 		}
 	}
 
+	policy := rs.UrlPolicy
+	if policy == nil {
+		var err error
+		if policy, err = delivery.NewUrlPolicy(config.Config.UrlPolicy); err != nil {
+			return StatusError{
+				StatusCode: http.StatusInternalServerError,
+				Err:        err,
+			}
+		}
+	}
+	if err := policy.CheckEnqueue(ctx, url); err != nil {
+		return StatusError{
+			StatusCode: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+
 	record.Url = url
+	record.Host = urlHost(url)
+	return nil
+}
+
+// HandleCredential checks the named credential profile exists and may be sent to the record's host for its tenant,
+// and records it against the record, so its secret is added when the request is sent rather than stored.
+func (rs *RecordServer) HandleCredential(name string, record *records.RqRecord) error {
+	if name == "" {
+		return nil
+	}
+
+	if err := delivery.CheckCredentialUse(name, record.Host, record.Tenant); err != nil {
+		return StatusError{
+			StatusCode: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+
+	record.Credential = name
 	return nil
 }
 
 // HandlePayload takes all submitted form key value pairs in the http.Request and saves them to the records.RqRecord
 func (rs *RecordServer) HandleFormPayload(form map[string][]string, record *records.RqRecord) {
-	// remove URL from stored payload, as this isn't sent onwards
+	// remove URL, upload and credential references from stored payload, as these aren't sent onwards
 	delete(form, "url")
+	delete(form, uploadQueryKey)
+	delete(form, credentialQueryKey)
 
 	out, _ := json.Marshal(form)
 	record.Payload = out
 }
 
 // HandleJsonPayload extracts the JSON payload from the request and sets it to the `Payload` field of the record.
-func (rs *RecordServer) HandleJsonPayload(body io.ReadCloser, record *records.RqRecord) {
+func (rs *RecordServer) HandleJsonPayload(body io.ReadCloser, record *records.RqRecord) error {
 	payload := map[string]json.RawMessage{}
-	out, _ := io.ReadAll(body)
+	out, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
 	json.Unmarshal(out, &payload)
 
 	record.Payload = out
+	return nil
 }
 
 // HandleQuerystringPayload takes a querystring map and a pointer to a records.RqRecord and processes the querystring payload.
 func (rs *RecordServer) HandleQuerystringPayload(qs map[string][]string, record *records.RqRecord) {
 	delete(qs, "url")
+	delete(qs, uploadQueryKey)
+	delete(qs, credentialQueryKey)
 	out, _ := json.Marshal(qs)
 	record.Payload = out
 }
 
-// HandleFilesInRequest iterates through all files sent in a request, saves them to disk and returns a slice
-// of stings containing the names of all files.
-func (rs *RecordServer) HandleFilesInRequest(req *http.Request) (keys []string, err error) {
-
-	rqId := getRqId(req)
-
-	var fileKeys []string
-	for key, _ := range req.MultipartForm.File {
-
-		// Store the file on disk
-		file, fileHeaders, err := req.FormFile(key)
-		if err != nil {
-			errMsg := fmt.Sprintf("server error getting file for key: %v, %v", key, err)
-			log.Println(errMsg)
-
-			return []string{}, StatusError{
-				StatusCode: http.StatusInternalServerError,
-				Err:        err,
-			}
-		}
-		srcFileName := fileHeaders.Filename
-		fmt.Println("Checking file extension: ", srcFileName)
-
-		fileExtOk, ext := files.CheckExtensionIsAllowed(srcFileName, config.Config.PermittedFileExtensions)
-		fmt.Println("File extension is ok: ", fileExtOk, config.Config.PermittedFileExtensions)
-		if fileExtOk == false {
-			errMsg := fmt.Sprintf("File extension not allowed: %v", srcFileName)
-			return []string{key}, StatusError{
-				StatusCode: http.StatusBadRequest,
-				Err:        errors.New(errMsg),
-			}
-		}
-
-		dstFileName := fmt.Sprintf("%v-%v.%v", rqId, key, ext)
-
-		if err := rs.FileStore.Save(dstFileName, file); err != nil {
-			log.Printf("%v: Error saving file %v", rqId, err.Error())
-			return []string{}, StatusError{
-				StatusCode: http.StatusInternalServerError,
-				Err:        err,
-			}
+// removeFiles deletes files saved for a request which was then rejected
+func (rs *RecordServer) removeFiles(ctx context.Context, storedFiles map[string]records.RqFile) {
+	for _, storedFile := range storedFiles {
+		if err := rs.FileStore.Delete(storedFile.Filename); err != nil {
+			slog.ErrorContext(ctx, "error removing file of rejected request", "file", storedFile.Filename, "error", err)
 		}
-		// TODO: Record key names into db
-		fileKeys = append(fileKeys, key)
-
 	}
-	return fileKeys, nil
-
 }
 
-func (rs *RecordServer) saveRecord(record records.RqRecord) error {
+func (rs *RecordServer) saveRecord(ctx context.Context, record records.RqRecord) error {
+	record.StoredBytes = record.Size()
+	_, span := tracing.Tracer().Start(ctx, "RecordStore.Add", trace.WithAttributes(attribute.String("rq.id", record.Id)))
 	err := rs.Store.Add(record)
+	tracing.End(span, err)
 	if err != nil {
-		out := fmt.Sprintf("%v: Record save failed: %v", record.Id, err)
-		log.Println(out)
+		slog.ErrorContext(ctx, "record save failed", "error", err)
 
 		return StatusError{
 			StatusCode: http.StatusInternalServerError,
@@ -378,15 +460,53 @@ func RqHttpMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 
 		rqid := GenerateRequestId()
+		host := targetHost(req)
 		ctx := req.Context()
 		ctx = context.WithValue(ctx, "rqid", rqid)
+		ctx = logging.WithRequest(ctx, rqid, req.Method, host)
+
+		// The span continues any trace the device started, and is recorded on the record for delivery to link back to
+		ctx, span := tracing.Tracer().Start(tracing.Extract(ctx, req.Header), "RqHttpMiddleware",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("rq.id", rqid),
+				attribute.String("http.request.method", req.Method),
+				attribute.String("url.path", req.URL.Path),
+				attribute.String("rq.target_host", host),
+			))
+		defer span.End()
+
 		req = req.WithContext(ctx)
-		log.Printf("%v: processing request", rqid)
+		slog.InfoContext(ctx, "processing request")
 		w.Header().Add("RqId", rqid)
-		next.ServeHTTP(w, req)
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, req)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
 	})
 }
 
+// targetHost returns the host the request is to be sent to, or "" if it has no valid url
+func targetHost(req *http.Request) string {
+	return urlHost(req.URL.Query().Get("url"))
+}
+
+// urlHost returns the lower case hostname of rawUrl, or "" if it is not a valid url
+func urlHost(rawUrl string) string {
+	target, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(target.Hostname())
+}
+
 // ReturnHTTPError returns an ErrorResponse back to the client if a request has failed.
 func ReturnHTTPErrorResponse(w http.ResponseWriter, errorMessage string, status int) {
 	output, _ := json.Marshal(ErrorResponse{Error: errorMessage})
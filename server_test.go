@@ -2,21 +2,30 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
-	"reflect"
 	"rq/config"
+	"rq/delivery"
 	"rq/files"
+	"rq/helpers"
 	"rq/records"
+	"rq/tracing"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -76,7 +85,8 @@ func TestHandleQuerystringPayload(t *testing.T) {
 }
 
 type MockMemoryRecordStore struct {
-	db map[string]records.RqRecord
+	db      map[string]records.RqRecord
+	pingErr error
 }
 
 func (ms *MockMemoryRecordStore) Add(record records.RqRecord) error {
@@ -89,7 +99,143 @@ func (ms *MockMemoryRecordStore) Get(id string) (*records.RqRecord, error) {
 		return &record, nil
 	}
 
-	return nil, errors.New("No record found.")
+	return nil, records.ErrNotFound
+}
+
+func (ms *MockMemoryRecordStore) Count() (int64, error) {
+	return int64(len(ms.db)), nil
+}
+
+func (ms *MockMemoryRecordStore) TenantUsage(tenant string) (int64, int64, error) {
+	var count, size int64
+	for _, record := range ms.db {
+		if record.Tenant == tenant {
+			count++
+			size += record.StoredBytes
+		}
+	}
+	return count, size, nil
+}
+
+func (ms *MockMemoryRecordStore) HostStatusCounts() (map[string]map[string]int64, error) {
+	counts := map[string]map[string]int64{}
+	for _, record := range ms.db {
+		if counts[record.Host] == nil {
+			counts[record.Host] = map[string]int64{records.StatusQueued: 0, records.StatusFailed: 0}
+		}
+		counts[record.Host][record.Status()]++
+	}
+	return counts, nil
+}
+
+func (ms *MockMemoryRecordStore) List(status string, limit int) ([]records.RqRecord, error) {
+	list := []records.RqRecord{}
+	for _, record := range ms.db {
+		if status == "" || record.Status() == status {
+			list = append(list, record)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+func (ms *MockMemoryRecordStore) TenantList(tenant string, status string, limit int) ([]records.RqRecord, error) {
+	list, _ := ms.List(status, len(ms.db))
+	tenantList := []records.RqRecord{}
+	for _, record := range list {
+		if record.Tenant == tenant && len(tenantList) < limit {
+			tenantList = append(tenantList, record)
+		}
+	}
+	return tenantList, nil
+}
+
+func (ms *MockMemoryRecordStore) QueuedIds(due time.Time, skipHosts []string, limit int) ([]string, error) {
+	list := []records.RqRecord{}
+	for _, record := range ms.db {
+		if record.Status() == records.StatusQueued && !record.NextAttemptAt.After(due) && !helpers.Contains(&skipHosts, record.Host) {
+			list = append(list, record)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].NextAttemptAt.Equal(list[j].NextAttemptAt) {
+			return list[i].NextAttemptAt.Before(list[j].NextAttemptAt)
+		}
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	ids := []string{}
+	for _, record := range list {
+		if len(ids) < limit {
+			ids = append(ids, record.Id)
+		}
+	}
+	return ids, nil
+}
+
+func (ms *MockMemoryRecordStore) Defer(id string, until time.Time) error {
+	record, ok := ms.db[id]
+	if !ok {
+		return records.ErrNotFound
+	}
+	record.Attempts++
+	record.NextAttemptAt = until
+	ms.db[id] = record
+	return nil
+}
+
+func (ms *MockMemoryRecordStore) Fail(id string, reason string) error {
+	record, ok := ms.db[id]
+	if !ok {
+		return records.ErrNotFound
+	}
+	record.Error = reason
+	ms.db[id] = record
+	return nil
+}
+
+func (ms *MockMemoryRecordStore) Requeue(id string) error {
+	record, ok := ms.db[id]
+	if !ok {
+		return records.ErrNotFound
+	}
+	record.Error = ""
+	record.Attempts = 0
+	record.NextAttemptAt = time.Time{}
+	ms.db[id] = record
+	return nil
+}
+
+func (ms *MockMemoryRecordStore) Delete(id string) error {
+	if _, ok := ms.db[id]; !ok {
+		return records.ErrNotFound
+	}
+	delete(ms.db, id)
+	return nil
+}
+
+func (ms *MockMemoryRecordStore) Ping() error {
+	return ms.pingErr
+}
+
+func (ms *MockMemoryRecordStore) StatusCounts() (map[string]int64, error) {
+	counts := map[string]int64{records.StatusQueued: 0, records.StatusFailed: 0}
+	for _, record := range ms.db {
+		counts[record.Status()]++
+	}
+	return counts, nil
+}
+
+func (ms *MockMemoryRecordStore) TenantStatusCounts(tenant string) (map[string]int64, error) {
+	counts := map[string]int64{records.StatusQueued: 0, records.StatusFailed: 0}
+	for _, record := range ms.db {
+		if record.Tenant == tenant {
+			counts[record.Status()]++
+		}
+	}
+	return counts, nil
 }
 
 func TestRecordServer_HandleQuerystringPayload(t *testing.T) {
@@ -157,133 +303,6 @@ func TestRecordServer_HandleQuerystringPayload(t *testing.T) {
 	}
 }
 
-func TestRecordServer_HandleFilesInRequest(t *testing.T) {
-
-	// Test files are stored in memory
-	MockFileStore, _ := files.NewInMemoryFileStore()
-
-	// Create a request body
-	requestBody := &bytes.Buffer{}
-
-	// Create multipart writer
-	multipartWriter := multipart.NewWriter(requestBody)
-
-	// Write the file to the writer
-	fileWriter, err := multipartWriter.CreateFormFile("file", "test.jpg")
-	if err != nil {
-		t.Errorf("Error creating form file")
-	}
-
-	// Write the file contents to the writer
-	fileContents := []byte("test file contents")
-	_, err = fileWriter.Write(fileContents)
-	if err != nil {
-		t.Errorf("Error writing file contents")
-	}
-
-	// Close the writer
-	err = multipartWriter.Close()
-	if err != nil {
-		t.Errorf("Error closing multipart writer")
-	}
-
-	// Create a mock request
-	mockRequest := &http.Request{
-		Method: http.MethodPost,
-		URL:    &url.URL{Scheme: "http", Host: "localhost", Path: "/api/rq/http"},
-		Header: http.Header{"Content-Type": []string{multipartWriter.FormDataContentType()}},
-		Body:   io.NopCloser(requestBody),
-	}
-
-	// Create bad file
-	requestBodyBadExtension := &bytes.Buffer{}
-	multipartWriterBadExtension := multipart.NewWriter(requestBodyBadExtension)
-	fileWriterBadExtension, err := multipartWriterBadExtension.CreateFormFile("file", "test.exe")
-	if err != nil {
-		t.Errorf("Error creating bad form file")
-	}
-
-	badFileContents := []byte("test file contents")
-	_, err = fileWriterBadExtension.Write(badFileContents)
-
-	if err != nil {
-		t.Errorf("Error writing bad file contents")
-	}
-
-	err = multipartWriterBadExtension.Close()
-	if err != nil {
-		t.Errorf("Error closing bad multipart writer")
-	}
-
-	mockRequestBadFileExtension := &http.Request{
-		Method: http.MethodPost,
-		URL:    &url.URL{Scheme: "http", Host: "localhost", Path: "/api/rq/http"},
-		Header: http.Header{"Content-Type": []string{multipartWriterBadExtension.FormDataContentType()}},
-		Body:   io.NopCloser(requestBodyBadExtension),
-	}
-
-	// Parse the request so we can access the form data
-	err = mockRequest.ParseMultipartForm(32 << 20)
-	if err != nil {
-		t.Errorf("Error parsing multipart form")
-
-	}
-
-	// Parse bad file request
-	err = mockRequestBadFileExtension.ParseMultipartForm(32 << 20)
-	if err != nil {
-		t.Errorf("Error parsing bad multipart form")
-
-	}
-
-	type fields struct {
-		Store     records.RecordStore
-		FileStore files.FileStore
-	}
-	type args struct {
-		req *http.Request
-	}
-	tests := []struct {
-		name     string
-		fields   fields
-		args     args
-		wantKeys []string
-		wantErr  bool
-	}{
-		{
-			name:     "one file in request with matching keys",
-			fields:   fields{FileStore: MockFileStore, Store: &MockMemoryRecordStore{}},
-			args:     args{req: mockRequest},
-			wantKeys: []string{"file"},
-			wantErr:  false,
-		},
-		{
-			name:     "one file in request with bad extension",
-			fields:   fields{FileStore: MockFileStore, Store: &MockMemoryRecordStore{}},
-			args:     args{req: mockRequestBadFileExtension},
-			wantKeys: []string{"file"},
-			wantErr:  true,
-		},
-	}
-	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
-			rs := &RecordServer{
-				Store:     test.fields.Store,
-				FileStore: test.fields.FileStore,
-			}
-
-			gotKeys, err := rs.HandleFilesInRequest(test.args.req)
-			if (err != nil) != test.wantErr {
-				t.Errorf("HandleFilesInRequest() error = %v, wantErr %v", err, test.wantErr)
-				return
-			}
-			if !reflect.DeepEqual(gotKeys, test.wantKeys) {
-				t.Errorf("HandleFilesInRequest() gotKeys = %v, want %v", gotKeys, test.wantKeys)
-			}
-		})
-	}
-}
-
 func NewMockRequestWithFile(filename string, fileContents []byte) (*http.Request, error) {
 	// Create a request body
 	requestBody := &bytes.Buffer{}
@@ -475,6 +494,26 @@ func TestRecordServer_HandleUrl(t *testing.T) {
 			url:           "http://example.com",
 			expectedError: false,
 		},
+		{
+			name:          "disallowed scheme",
+			url:           "file:///etc/passwd",
+			expectedError: true,
+		},
+		{
+			name:          "metadata service",
+			url:           "http://169.254.169.254/latest/meta-data",
+			expectedError: true,
+		},
+		{
+			name:          "loopback",
+			url:           "http://127.0.0.1:8080/admin",
+			expectedError: true,
+		},
+	}
+
+	policy, err := delivery.NewUrlPolicy(config.Config.UrlPolicy)
+	if err != nil {
+		t.Fatalf("NewUrlPolicy() error = %v", err)
 	}
 
 	for _, test := range tests {
@@ -485,9 +524,10 @@ func TestRecordServer_HandleUrl(t *testing.T) {
 			server := &RecordServer{
 				Store:     store,
 				FileStore: fileStore,
+				UrlPolicy: policy,
 			}
 			record := &records.RqRecord{}
-			err := server.HandleUrl(test.url, record)
+			err := server.HandleUrl(context.Background(), test.url, record)
 
 			if (err != nil) != test.expectedError {
 				t.Errorf("HandleUrl() error = %v, expectedError = %v", err, test.expectedError)
@@ -891,3 +931,141 @@ func TestRecordServer_ServeHTTP(t *testing.T) {
 	}
 
 }
+
+func TestRecordServer_HandleMediaTypeContentSniffing(t *testing.T) {
+	defer func(permitted []string) { config.Config.PermittedMimeTypes = permitted }(config.Config.PermittedMimeTypes)
+	config.Config.PermittedMimeTypes = []string{"image/jpeg", "video/mp4"}
+
+	jpegContents := []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x10, 'J', 'F', 'I', 'F', 0x00}
+	exeContents := []byte{'M', 'Z', 0x90, 0x00, 0x03, 0x00, 0x00, 0x00}
+
+	tests := []struct {
+		name       string
+		filename   string
+		contents   []byte
+		wantStatus int
+	}{
+		{name: "jpeg with jpg extension", filename: "image.jpg", contents: jpegContents, wantStatus: 0},
+		{name: "executable renamed to mp4", filename: "video.mp4", contents: exeContents, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "jpeg renamed to mp4", filename: "video.mp4", contents: jpegContents, wantStatus: http.StatusUnsupportedMediaType},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mfs, _ := files.NewInMemoryFileStore()
+			rs := &RecordServer{Store: &MockMemoryRecordStore{}, FileStore: mfs}
+
+			req, err := NewMockRequestWithFile(test.filename, test.contents)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			record := &records.RqRecord{}
+			err = rs.HandleMediaType("multipart/form-data", req, record)
+			if test.wantStatus == 0 {
+				if err != nil {
+					t.Fatalf("HandleMediaType() unexpected error = %v", err)
+				}
+				storedFiles, _ := record.GetFiles()
+				if storedFiles["file"].ContentType != "image/jpeg" {
+					t.Errorf("HandleMediaType() stored content type = %v, want image/jpeg", storedFiles["file"].ContentType)
+				}
+				return
+			}
+
+			httpErr, ok := err.(HttpError)
+			if !ok || httpErr.Status() != test.wantStatus {
+				t.Errorf("HandleMediaType() error = %v, want status %v", err, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRecordServer_ServeHTTPCredential(t *testing.T) {
+	defer func() { config.Config.Credentials = nil }()
+	config.Config.Credentials = map[string]config.RqCredentialConfig{
+		"partner": {Type: "bearer", Token: "secret-token", AllowedHosts: []string{"www.imagination.com"}},
+	}
+
+	tests := []struct {
+		name           string
+		target         string
+		wantCode       int
+		wantCredential string
+	}{
+		{name: "known credential", target: "/?url=https://www.imagination.com&credential=partner&foo=bar", wantCode: 200, wantCredential: "partner"},
+		{name: "unknown credential", target: "/?url=https://www.imagination.com&credential=missing", wantCode: http.StatusBadRequest},
+		{name: "credential for another host", target: "/?url=https://www.example.com&credential=partner", wantCode: http.StatusBadRequest},
+		{name: "no credential", target: "/?url=https://www.imagination.com&foo=bar", wantCode: 200},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &MockMemoryRecordStore{db: make(map[string]records.RqRecord)}
+			mfs, _ := files.NewInMemoryFileStore()
+			server := &RecordServer{Store: store, FileStore: mfs}
+
+			response := httptest.NewRecorder()
+			RqHttpMiddleware(server).ServeHTTP(response, httptest.NewRequest(http.MethodGet, test.target, nil))
+			if response.Code != test.wantCode {
+				t.Fatalf("ServeHTTP() got %v, want %v", response.Code, test.wantCode)
+			}
+			if test.wantCode != 200 {
+				assert.Empty(t, store.db)
+				return
+			}
+
+			record := store.db[response.Header().Get("RqId")]
+			assert.Equal(t, test.wantCredential, record.Credential)
+			assert.NotContains(t, string(record.Payload), "credential")
+			assert.NotContains(t, string(record.Payload), "secret-token")
+			assert.NotContains(t, string(record.Headers), "secret-token")
+		})
+	}
+}
+
+func TestRqHttpMiddlewareTracing(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.Server.AllowedContentTypes = []string{"application/json"}
+
+	store := &MockMemoryRecordStore{db: make(map[string]records.RqRecord)}
+	mfs, _ := files.NewInMemoryFileStore()
+	handler := RqHttpMiddleware(&RecordServer{Store: store, FileStore: mfs})
+
+	const deviceTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest(http.MethodPost, "/?url=https://www.imagination.com", strings.NewReader(`{"a":1}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Traceparent", deviceTraceParent)
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, req)
+	if response.Code != http.StatusOK {
+		t.Fatalf("status = %v, want %v: %v", response.Code, http.StatusOK, response.Body.String())
+	}
+
+	ended := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range spans.Ended() {
+		ended[span.Name()] = span
+	}
+	middleware, ok := ended["RqHttpMiddleware"]
+	if !ok {
+		t.Fatalf("no RqHttpMiddleware span in %v", spans.Ended())
+	}
+	for _, name := range []string{"RqHttpMiddleware", "HandleRequest", "RecordStore.Add"} {
+		span, ok := ended[name]
+		if !ok {
+			t.Errorf("no %v span", name)
+			continue
+		}
+		if span.SpanContext().TraceID() != tracing.SpanContext(deviceTraceParent).TraceID() {
+			t.Errorf("%v span is not in the device's trace", name)
+		}
+	}
+
+	record := store.db[response.Header().Get("RqId")]
+	if got := tracing.SpanContext(record.TraceParent).SpanID(); got != middleware.SpanContext().SpanID() {
+		t.Errorf("record trace parent = %q, want the RqHttpMiddleware span %v", record.TraceParent, middleware.SpanContext().SpanID())
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"rq/config"
+	"rq/records"
+	"strings"
+	"time"
+)
+
+const (
+	recordsPath = "/api/rq/records"
+	statusPath  = "/api/rq/status"
+)
+
+// StatusServer lets clients follow the requests they have enqueued. Everything is scoped to the caller's tenant, so
+// records of other tenants are reported as not found, as uploads are:
+//
+//	GET /api/rq/status                  the number of records queued and failed, and the bytes stored, against quota
+//	GET /api/rq/records?status=&limit=  recent records, newest first
+//	GET /api/rq/records/{id}            the status of a single record
+type StatusServer struct {
+	Records *RecordServer
+}
+
+// statusRecord is a record as shown to the client which enqueued it. The headers, payload and credential are left
+// out, as they are only needed to send it.
+type statusRecord struct {
+	Id            string     `json:"id"`
+	Method        string     `json:"method"`
+	Url           string     `json:"url"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// tenantStatus is the usage of a tenant, with its quotas if any are configured
+type tenantStatus struct {
+	Tenant      string                 `json:"tenant"`
+	Records     map[string]int64       `json:"records"`
+	StoredBytes int64                  `json:"stored_bytes"`
+	Quota       *config.RqTenantConfig `json:"quota,omitempty"`
+}
+
+func (ss *StatusServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+
+	if req.Method != http.MethodGet {
+		ReturnHTTPErrorResponse(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(req.URL.Path, recordsPath), "/")
+	switch {
+	case req.URL.Path == statusPath:
+		ss.HandleStatus(w, req)
+	case strings.HasPrefix(req.URL.Path, recordsPath) && id == "":
+		ss.HandleList(w, req)
+	case strings.HasPrefix(req.URL.Path, recordsPath):
+		ss.HandleRecord(w, req, id)
+	default:
+		ReturnHTTPErrorResponse(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	}
+}
+
+// HandleStatus returns the number of records held for the caller's tenant with each status, and the bytes stored for
+// them and its uploads
+func (ss *StatusServer) HandleStatus(w http.ResponseWriter, req *http.Request) {
+	tenant := getRqTenant(req)
+	counts, err := ss.Records.Store.TenantStatusCounts(tenant)
+	if err != nil {
+		ss.serverError(w, req, err)
+		return
+	}
+	_, storedBytes, err := ss.Records.Store.TenantUsage(tenant)
+	if err != nil {
+		ss.serverError(w, req, err)
+		return
+	}
+	uploadBytes, err := tenantUploadBytes(ss.Records.FileStore, tenant)
+	if err != nil {
+		ss.serverError(w, req, err)
+		return
+	}
+
+	status := tenantStatus{Tenant: tenant, Records: counts, StoredBytes: storedBytes + uploadBytes}
+	if quota, ok := config.Config.Tenants[tenant]; ok && tenant != "" {
+		status.Quota = &quota
+	}
+	writeAdminResponse(w, status)
+}
+
+// HandleList returns the caller's tenant's most recent records, optionally only those queued or failed
+func (ss *StatusServer) HandleList(w http.ResponseWriter, req *http.Request) {
+	status, limit, err := parseListQuery(req.URL.Query())
+	if err != nil {
+		ReturnHTTPErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	list, err := ss.Records.Store.TenantList(getRqTenant(req), status, limit)
+	if err != nil {
+		ss.serverError(w, req, err)
+		return
+	}
+	out := []statusRecord{}
+	for _, record := range list {
+		out = append(out, newStatusRecord(record))
+	}
+	writeAdminResponse(w, out)
+}
+
+// HandleRecord returns the status of a record enqueued by the caller's tenant. Records which have been sent are no
+// longer held, so are not found.
+func (ss *StatusServer) HandleRecord(w http.ResponseWriter, req *http.Request, id string) {
+	record, err := ss.Records.Store.Get(id)
+	if err == nil && record.Tenant != getRqTenant(req) {
+		err = records.ErrNotFound
+	}
+	if errors.Is(err, records.ErrNotFound) {
+		ReturnHTTPErrorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		ss.serverError(w, req, err)
+		return
+	}
+	writeAdminResponse(w, newStatusRecord(*record))
+}
+
+func (ss *StatusServer) serverError(w http.ResponseWriter, req *http.Request, err error) {
+	slog.ErrorContext(req.Context(), "status request failed", "path", req.URL.Path, "error", err)
+	ReturnHTTPErrorResponse(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+func newStatusRecord(record records.RqRecord) statusRecord {
+	out := statusRecord{
+		Id:        record.Id,
+		Method:    record.Method,
+		Url:       record.Url,
+		Status:    record.Status(),
+		Attempts:  record.Attempts,
+		Error:     record.Error,
+		CreatedAt: record.CreatedAt,
+	}
+	if !record.NextAttemptAt.IsZero() {
+		out.NextAttemptAt = &record.NextAttemptAt
+	}
+	return out
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"rq/config"
+	"rq/files"
+	"rq/records"
+	"testing"
+	"time"
+)
+
+func TestStatusServer_TenantScoped(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.Tenants = map[string]config.RqTenantConfig{"media": {MaxQueuedRecords: 10}, "retail": {}}
+	withAuthConfig(t, config.RqAuthConfig{
+		Enabled: true,
+		Keys: []config.RqAuthKeyConfig{
+			{Name: "studio", Type: "api_key", Key: "studio-key", Tenant: "media"},
+			{Name: "kiosk", Type: "api_key", Key: "kiosk-key", Tenant: "retail"},
+		},
+	})
+
+	store := &MockMemoryRecordStore{db: make(map[string]records.RqRecord)}
+	now := time.Now()
+	store.Add(records.RqRecord{Id: "media-queued", Tenant: "media", Url: "https://api.example.com", StoredBytes: 5, CreatedAt: now})
+	store.Add(records.RqRecord{Id: "media-failed", Tenant: "media", Error: "400 Bad Request", StoredBytes: 7, CreatedAt: now.Add(-time.Minute)})
+	store.Add(records.RqRecord{Id: "retail-queued", Tenant: "retail", Attempts: 2, NextAttemptAt: now.Add(time.Minute), CreatedAt: now})
+	fileStore, _ := files.NewInMemoryFileStore()
+	handler := RqAuthMiddleware(&StatusServer{Records: &RecordServer{Store: store, FileStore: fileStore}})
+
+	get := func(target string, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-Api-Key", key)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		return response
+	}
+
+	t.Run("status", func(t *testing.T) {
+		response := get(statusPath, "studio-key")
+		var status tenantStatus
+		if err := json.Unmarshal(response.Body.Bytes(), &status); err != nil {
+			t.Fatalf("body %q is not JSON: %v", response.Body.String(), err)
+		}
+		if status.Tenant != "media" || status.Records[records.StatusQueued] != 1 || status.Records[records.StatusFailed] != 1 {
+			t.Errorf("status = %+v, want media's 1 queued and 1 failed record", status)
+		}
+		if status.StoredBytes != 12 || status.Quota == nil || status.Quota.MaxQueuedRecords != 10 {
+			t.Errorf("status = %+v, want 12 stored bytes and media's quota", status)
+		}
+	})
+
+	listTests := []struct {
+		name    string
+		target  string
+		key     string
+		wantIds []string
+	}{
+		{name: "own records", target: recordsPath, key: "studio-key", wantIds: []string{"media-queued", "media-failed"}},
+		{name: "own failed records", target: recordsPath + "?status=failed", key: "studio-key", wantIds: []string{"media-failed"}},
+		{name: "another tenant's records", target: recordsPath, key: "kiosk-key", wantIds: []string{"retail-queued"}},
+	}
+	for _, test := range listTests {
+		t.Run(test.name, func(t *testing.T) {
+			response := get(test.target, test.key)
+			var list []statusRecord
+			if err := json.Unmarshal(response.Body.Bytes(), &list); err != nil {
+				t.Fatalf("body %q is not JSON: %v", response.Body.String(), err)
+			}
+			ids := []string{}
+			for _, record := range list {
+				ids = append(ids, record.Id)
+			}
+			if len(ids) != len(test.wantIds) || (len(ids) > 0 && ids[0] != test.wantIds[0]) {
+				t.Errorf("listed %v, want %v", ids, test.wantIds)
+			}
+		})
+	}
+
+	recordTests := []struct {
+		name       string
+		id         string
+		key        string
+		wantStatus int
+	}{
+		{name: "own record", id: "retail-queued", key: "kiosk-key", wantStatus: http.StatusOK},
+		{name: "another tenant's record", id: "media-queued", key: "kiosk-key", wantStatus: http.StatusNotFound},
+		{name: "unknown record", id: "sent", key: "kiosk-key", wantStatus: http.StatusNotFound},
+	}
+	for _, test := range recordTests {
+		t.Run(test.name, func(t *testing.T) {
+			response := get(recordsPath+"/"+test.id, test.key)
+			if response.Code != test.wantStatus {
+				t.Fatalf("status = %v, want %v", response.Code, test.wantStatus)
+			}
+			if test.wantStatus != http.StatusOK {
+				return
+			}
+			var record statusRecord
+			json.Unmarshal(response.Body.Bytes(), &record)
+			if record.Status != records.StatusQueued || record.Attempts != 2 || record.NextAttemptAt == nil {
+				t.Errorf("record = %+v, want queued after 2 attempts with the next scheduled", record)
+			}
+		})
+	}
+
+	if response := get(recordsPath, ""); response.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated list got %v, want %v", response.Code, http.StatusUnauthorized)
+	}
+}
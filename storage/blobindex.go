@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"rq/files"
+	"unicode/utf8"
+)
+
+// FileReference maps a filename in a ContentAddressedFileStore to the checksum of the blob holding its contents
+type FileReference struct {
+	Filename string `gorm:"primaryKey"`
+	Checksum string `gorm:"index"`
+}
+
+// SqliteBlobIndex is a files.BlobIndex stored alongside records in the SQLite database
+type SqliteBlobIndex struct {
+	db *gorm.DB
+}
+
+// NewBlobIndex returns a SqliteBlobIndex sharing the record store's database connection.
+func (s *SqliteRecordStore) NewBlobIndex() (*SqliteBlobIndex, error) {
+	if err := s.db.AutoMigrate(&FileReference{}); err != nil {
+		return nil, err
+	}
+	return &SqliteBlobIndex{db: s.db}, nil
+}
+
+func (bi *SqliteBlobIndex) AddReference(filename string, checksum string) (string, error) {
+	previous := ""
+	err := bi.db.Transaction(func(tx *gorm.DB) error {
+		var existing FileReference
+		err := tx.Where("filename = ?", filename).First(&existing).Error
+		if err == nil {
+			previous = existing.Checksum
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&FileReference{Filename: filename, Checksum: checksum}).Error
+	})
+	return previous, err
+}
+
+func (bi *SqliteBlobIndex) RemoveReference(filename string) (string, error) {
+	checksum := ""
+	err := bi.db.Transaction(func(tx *gorm.DB) error {
+		var existing FileReference
+		if err := tx.Where("filename = ?", filename).First(&existing).Error; err != nil {
+			return notFoundReference(filename, err)
+		}
+		checksum = existing.Checksum
+		return tx.Delete(&existing).Error
+	})
+	return checksum, err
+}
+
+func (bi *SqliteBlobIndex) Lookup(filename string) (string, error) {
+	var existing FileReference
+	if err := bi.db.Where("filename = ?", filename).First(&existing).Error; err != nil {
+		return "", notFoundReference(filename, err)
+	}
+	return existing.Checksum, nil
+}
+
+func (bi *SqliteBlobIndex) References(checksum string) (int64, error) {
+	var count int64
+	err := bi.db.Model(&FileReference{}).Where("checksum = ?", checksum).Count(&count).Error
+	return count, err
+}
+
+func (bi *SqliteBlobIndex) List(prefix string) ([]string, error) {
+	filenames := []string{}
+	err := bi.db.Model(&FileReference{}).
+		Where("substr(filename, 1, ?) = ?", utf8.RuneCountInString(prefix), prefix).
+		Order("filename").
+		Pluck("filename", &filenames).Error
+	return filenames, err
+}
+
+// notFoundReference converts a missing row into files.ErrFileNotFound, so callers see the same error as other stores
+func notFoundReference(filename string, err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("%w: %v", files.ErrFileNotFound, filename)
+	}
+	return err
+}
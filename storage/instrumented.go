@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"rq/records"
+	"time"
+)
+
+var recordStoreDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "rq_record_store_operation_duration_seconds",
+	Help: "Time taken by record store operations.",
+}, []string{"operation"})
+
+// InstrumentedRecordStore records the duration of each operation on a RecordStore
+type InstrumentedRecordStore struct {
+	store records.RecordStore
+}
+
+// NewInstrumentedRecordStore returns a RecordStore which times each operation on store.
+func NewInstrumentedRecordStore(store records.RecordStore) *InstrumentedRecordStore {
+	return &InstrumentedRecordStore{store: store}
+}
+
+func (is *InstrumentedRecordStore) Add(record records.RqRecord) error {
+	defer prometheus.NewTimer(recordStoreDuration.WithLabelValues("add")).ObserveDuration()
+	return is.store.Add(record)
+}
+
+func (is *InstrumentedRecordStore) Get(id string) (*records.RqRecord, error) {
+	defer prometheus.NewTimer(recordStoreDuration.WithLabelValues("get")).ObserveDuration()
+	return is.store.Get(id)
+}
+
+func (is *InstrumentedRecordStore) Count() (int64, error) {
+	defer prometheus.NewTimer(recordStoreDuration.WithLabelValues("count")).ObserveDuration()
+	return is.store.Count()
+}
+
+func (is *InstrumentedRecordStore) TenantUsage(tenant string) (int64, int64, error) {
+	defer prometheus.NewTimer(recordStoreDuration.WithLabelValues("tenant_usage")).ObserveDuration()
+	return is.store.TenantUsage(tenant)
+}
+
+func (is *InstrumentedRecordStore) StatusCounts() (map[string]int64, error) {
+	defer prometheus.NewTimer(recordStoreDuration.WithLabelValues("status_counts")).ObserveDuration()
+	return is.store.StatusCounts()
+}
+
+func (is *InstrumentedRecordStore) TenantStatusCounts(tenant string) (map[string]int64, error) {
+	defer prometheus.NewTimer(recordStoreDuration.WithLabelValues("tenant_status_counts")).ObserveDuration()
+	return is.store.TenantStatusCounts(tenant)
+}
+
+func (is *InstrumentedRecordStore) HostStatusCounts() (map[string]map[string]int64, error) {
+	defer prometheus.NewTimer(recordStoreDuration.WithLabelValues("host_status_counts")).ObserveDuration()
+	return is.store.HostStatusCounts()
+}
+
+func (is *InstrumentedRecordStore) List(status string, limit int) ([]records.RqRecord, error) {
+	defer prometheus.NewTimer(recordStoreDuration.WithLabelValues("list")).ObserveDuration()
+	return is.store.List(status, limit)
+}
+
+func (is *InstrumentedRecordStore) TenantList(tenant string, status string, limit int) ([]records.RqRecord, error) {
+	defer prometheus.NewTimer(recordStoreDuration.WithLabelValues("tenant_list")).ObserveDuration()
+	return is.store.TenantList(tenant, status, limit)
+}
+
+func (is *InstrumentedRecordStore) QueuedIds(due time.Time, skipHosts []string, limit int) ([]string, error) {
+	defer prometheus.NewTimer(recordStoreDuration.WithLabelValues("queued_ids")).ObserveDuration()
+	return is.store.QueuedIds(due, skipHosts, limit)
+}
+
+func (is *InstrumentedRecordStore) Defer(id string, until time.Time) error {
+	defer prometheus.NewTimer(recordStoreDuration.WithLabelValues("defer")).ObserveDuration()
+	return is.store.Defer(id, until)
+}
+
+func (is *InstrumentedRecordStore) Fail(id string, reason string) error {
+	defer prometheus.NewTimer(recordStoreDuration.WithLabelValues("fail")).ObserveDuration()
+	return is.store.Fail(id, reason)
+}
+
+func (is *InstrumentedRecordStore) Requeue(id string) error {
+	defer prometheus.NewTimer(recordStoreDuration.WithLabelValues("requeue")).ObserveDuration()
+	return is.store.Requeue(id)
+}
+
+func (is *InstrumentedRecordStore) Delete(id string) error {
+	defer prometheus.NewTimer(recordStoreDuration.WithLabelValues("delete")).ObserveDuration()
+	return is.store.Delete(id)
+}
+
+func (is *InstrumentedRecordStore) Ping() error {
+	defer prometheus.NewTimer(recordStoreDuration.WithLabelValues("ping")).ObserveDuration()
+	return is.store.Ping()
+}
@@ -1,13 +1,19 @@
 package storage
 
 import (
+	"errors"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"rq/config"
+	"rq/encryption"
 	"rq/records"
+	"time"
 )
 
 type SqliteRecordStore struct {
 	db *gorm.DB
+	// Keyring encrypts the headers and payload of records as they are added, if set
+	Keyring *encryption.Keyring
 }
 
 func NewSqliteRecordStore(path string) (*SqliteRecordStore, error) {
@@ -23,13 +29,241 @@ func NewSqliteRecordStore(path string) (*SqliteRecordStore, error) {
 
 }
 
+// Add saves the record, compressing its payload if compression is enabled and it is at least the configured size
 func (s *SqliteRecordStore) Add(record records.RqRecord) error {
-	err := s.db.Create(record).Error
+	compression := config.Config.Compression
+	if compression.Enabled && int64(len(record.Payload)) >= compression.MinBytes {
+		if err := record.CompressPayload(compression.Algorithm); err != nil {
+			return err
+		}
+	}
+	if s.Keyring != nil {
+		if err := record.Encrypt(s.Keyring); err != nil {
+			return err
+		}
+	}
+
+	err := s.db.Create(&record).Error
 	return err
 }
 
+// Get returns the record with the given id, with its headers and payload decrypted and decompressed
 func (s *SqliteRecordStore) Get(id string) (*records.RqRecord, error) {
 	var record records.RqRecord
 	err := s.db.Where("id = ?", id).First(&record).Error
-	return &record, err
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &record, records.ErrNotFound
+	}
+	if err != nil {
+		return &record, err
+	}
+	if err := record.Decrypt(s.Keyring); err != nil {
+		return &record, err
+	}
+	return &record, record.DecompressPayload()
+}
+
+// Count returns the number of records currently held in the store
+func (s *SqliteRecordStore) Count() (int64, error) {
+	var count int64
+	err := s.db.Model(&records.RqRecord{}).Count(&count).Error
+	return count, err
+}
+
+// TenantUsage returns the number of records held for tenant, and the bytes stored for them
+func (s *SqliteRecordStore) TenantUsage(tenant string) (int64, int64, error) {
+	var usage struct {
+		Count int64
+		Bytes int64
+	}
+	err := s.db.Model(&records.RqRecord{}).
+		Select("count(*) as count, coalesce(sum(stored_bytes), 0) as bytes").
+		Where("tenant = ?", tenant).
+		Scan(&usage).Error
+	return usage.Count, usage.Bytes, err
+}
+
+// StatusCounts returns the number of records held with each status
+func (s *SqliteRecordStore) StatusCounts() (map[string]int64, error) {
+	return statusCounts(s.db.Model(&records.RqRecord{}))
+}
+
+// TenantStatusCounts returns the number of records held for tenant with each status
+func (s *SqliteRecordStore) TenantStatusCounts(tenant string) (map[string]int64, error) {
+	return statusCounts(s.db.Model(&records.RqRecord{}).Where("tenant = ?", tenant))
+}
+
+// statusCounts returns the number of records matched by query with each status
+func statusCounts(query *gorm.DB) (map[string]int64, error) {
+	rows := []struct {
+		Status string
+		Count  int64
+	}{}
+	err := query.
+		Select("case when coalesce(error, '') = '' then ? else ? end as status, count(*) as count", records.StatusQueued, records.StatusFailed).
+		Group("status").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int64{records.StatusQueued: 0, records.StatusFailed: 0}
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+	return counts, nil
+}
+
+// HostStatusCounts returns the number of records held for each destination host, with each status
+func (s *SqliteRecordStore) HostStatusCounts() (map[string]map[string]int64, error) {
+	rows := []struct {
+		Host   string
+		Status string
+		Count  int64
+	}{}
+	err := s.db.Model(&records.RqRecord{}).
+		Select("host, case when coalesce(error, '') = '' then ? else ? end as status, count(*) as count", records.StatusQueued, records.StatusFailed).
+		Group("host, status").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]map[string]int64{}
+	for _, row := range rows {
+		if counts[row.Host] == nil {
+			counts[row.Host] = map[string]int64{records.StatusQueued: 0, records.StatusFailed: 0}
+		}
+		counts[row.Host][row.Status] = row.Count
+	}
+	return counts, nil
+}
+
+// List returns up to limit records with status, or with any status if status is "", newest first. The headers and
+// payload are not read, as they are only needed for a single record, which is read with Get.
+func (s *SqliteRecordStore) List(status string, limit int) ([]records.RqRecord, error) {
+	return list(s.db.Model(&records.RqRecord{}), status, limit)
+}
+
+// TenantList returns up to limit records held for tenant with status, or with any status if status is "", newest
+// first, as List does.
+func (s *SqliteRecordStore) TenantList(tenant string, status string, limit int) ([]records.RqRecord, error) {
+	return list(s.db.Model(&records.RqRecord{}).Where("tenant = ?", tenant), status, limit)
+}
+
+// list returns up to limit of the records matched by query with status, newest first, without their headers and
+// payload
+func list(query *gorm.DB, status string, limit int) ([]records.RqRecord, error) {
+	query = query.Omit("headers", "payload", "data_key")
+	switch status {
+	case records.StatusQueued:
+		query = query.Where("coalesce(error, '') = ''")
+	case records.StatusFailed:
+		query = query.Where("coalesce(error, '') <> ''")
+	}
+
+	list := []records.RqRecord{}
+	err := query.Order("created_at desc").Limit(limit).Find(&list).Error
+	return list, err
+}
+
+// QueuedIds returns the ids of up to limit queued records due to be sent by due, other than those for skipHosts, in
+// the order they are to be sent: records not yet attempted oldest first, then those whose next attempt is earliest
+func (s *SqliteRecordStore) QueuedIds(due time.Time, skipHosts []string, limit int) ([]string, error) {
+	query := s.db.Model(&records.RqRecord{}).
+		Where("coalesce(error, '') = ''").
+		Where("next_attempt_at is null or next_attempt_at <= ?", due.UTC())
+	if len(skipHosts) > 0 {
+		query = query.Where("host not in ?", skipHosts)
+	}
+
+	ids := []string{}
+	err := query.Order("next_attempt_at").Order("created_at").Limit(limit).Pluck("id", &ids).Error
+	return ids, err
+}
+
+// Defer counts a failed attempt to send a record, which is left queued but not sent again until after until
+func (s *SqliteRecordStore) Defer(id string, until time.Time) error {
+	result := s.db.Model(&records.RqRecord{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"attempts":        gorm.Expr("attempts + 1"),
+		"next_attempt_at": until.UTC(),
+	})
+	if result.Error == nil && result.RowsAffected == 0 {
+		return records.ErrNotFound
+	}
+	return result.Error
+}
+
+// Fail records why a record could not be sent, so it is no longer sent until it is requeued
+func (s *SqliteRecordStore) Fail(id string, reason string) error {
+	result := s.db.Model(&records.RqRecord{}).Where("id = ?", id).Update("error", reason)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return records.ErrNotFound
+	}
+	return result.Error
+}
+
+// Requeue clears the error and attempts of a failed record, so it is sent again on the next pass
+func (s *SqliteRecordStore) Requeue(id string) error {
+	result := s.db.Model(&records.RqRecord{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"error":           "",
+		"attempts":        0,
+		"next_attempt_at": nil,
+	})
+	if result.Error == nil && result.RowsAffected == 0 {
+		return records.ErrNotFound
+	}
+	return result.Error
+}
+
+// Delete removes the record with the given id
+func (s *SqliteRecordStore) Delete(id string) error {
+	result := s.db.Where("id = ?", id).Delete(&records.RqRecord{})
+	if result.Error == nil && result.RowsAffected == 0 {
+		return records.ErrNotFound
+	}
+	return result.Error
+}
+
+// Ping checks the database can still be reached
+func (s *SqliteRecordStore) Ping() error {
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return db.Ping()
+}
+
+// RotateKeys re-encrypts every record not encrypted with the keyring's current key, including records stored before
+// encryption was enabled, and returns the number of records updated.
+func (s *SqliteRecordStore) RotateKeys() (int, error) {
+	if s.Keyring == nil {
+		return 0, errors.New("encryption is not enabled")
+	}
+
+	rotated := 0
+	var batch []records.RqRecord
+	result := s.db.Where("key_id IS NULL OR key_id <> ?", s.Keyring.CurrentKeyId()).
+		FindInBatches(&batch, 100, func(tx *gorm.DB, _ int) error {
+			for _, record := range batch {
+				if err := record.Decrypt(s.Keyring); err != nil {
+					return err
+				}
+				if err := record.Encrypt(s.Keyring); err != nil {
+					return err
+				}
+				err := s.db.Model(&records.RqRecord{}).Where("id = ?", record.Id).Updates(map[string]interface{}{
+					"headers":  record.Headers,
+					"payload":  record.Payload,
+					"key_id":   record.KeyId,
+					"data_key": record.DataKey,
+				}).Error
+				if err != nil {
+					return err
+				}
+				rotated++
+			}
+			return nil
+		})
+	return rotated, result.Error
 }
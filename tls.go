@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"rq/config"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultListen is the address the server listens on, if none is configured
+const defaultListen = ":8080"
+
+// defaultReloadInterval is how often certificate files are checked for changes, if no interval is configured
+const defaultReloadInterval = 60 * time.Second
+
+// certReloader holds the server's TLS config, and replaces it when the certificate, key or client CA files change,
+// so certificates can be renewed without restarting the server. Connections already open keep the config they were
+// accepted with.
+type certReloader struct {
+	tlsConfig config.RqTLSConfig
+	mu        sync.RWMutex
+	current   *tls.Config
+	modTimes  map[string]time.Time
+}
+
+func newCertReloader(tlsConfig config.RqTLSConfig) (*certReloader, error) {
+	if tlsConfig.CertFile == "" || tlsConfig.KeyFile == "" {
+		return nil, errors.New("tls needs a cert_file and key_file")
+	}
+	if _, err := clientAuthType(tlsConfig); err != nil {
+		return nil, err
+	}
+
+	reloader := &certReloader{tlsConfig: tlsConfig}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Reload loads the certificate files. If they cannot be loaded, the previous config stays in use.
+func (cr *certReloader) Reload() error {
+	modTimes, err := cr.fileModTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.tlsConfig.CertFile, cr.tlsConfig.KeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate: %w", err)
+	}
+
+	clientAuth, _ := clientAuthType(cr.tlsConfig)
+	next := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuth,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if cr.tlsConfig.ClientCAFile != "" {
+		pem, err := os.ReadFile(cr.tlsConfig.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("error loading client CA: %w", err)
+		}
+		next.ClientCAs = x509.NewCertPool()
+		if !next.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %v", cr.tlsConfig.ClientCAFile)
+		}
+	}
+
+	cr.mu.Lock()
+	cr.current = next
+	cr.modTimes = modTimes
+	cr.mu.Unlock()
+	return nil
+}
+
+// Changed returns true if any of the certificate files have been modified since they were loaded
+func (cr *certReloader) Changed() bool {
+	modTimes, err := cr.fileModTimes()
+	if err != nil {
+		// Files are often briefly missing while they are replaced, so wait until they are back
+		return false
+	}
+
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	for name, modTime := range modTimes {
+		if !modTime.Equal(cr.modTimes[name]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the certificate files whenever they change, until ctx is done
+func (cr *certReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !cr.Changed() {
+				continue
+			}
+			if err := cr.Reload(); err != nil {
+				slog.Error("error reloading TLS certificates, keeping the previous certificates", "error", err)
+				continue
+			}
+			slog.Info("reloaded TLS certificates")
+		}
+	}
+}
+
+// GetConfigForClient returns the current TLS config, for use as the server's tls.Config.GetConfigForClient
+func (cr *certReloader) GetConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.current, nil
+}
+
+// GetCertificate returns the current certificate, for use as the server's tls.Config.GetCertificate
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return &cr.current.Certificates[0], nil
+}
+
+// ServerConfig returns the tls.Config to serve with, which looks up the current config for each connection. The
+// certificate is also looked up directly, as http.Server.ServeTLS needs a certificate when no files are passed to it.
+func (cr *certReloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetCertificate:     cr.GetCertificate,
+		GetConfigForClient: cr.GetConfigForClient,
+	}
+}
+
+func (cr *certReloader) fileModTimes() (map[string]time.Time, error) {
+	modTimes := map[string]time.Time{}
+	for _, name := range []string{cr.tlsConfig.CertFile, cr.tlsConfig.KeyFile, cr.tlsConfig.ClientCAFile} {
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[name] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// clientAuthType returns how client certificates are verified. Certificates are required by default if a client CA
+// is configured.
+func clientAuthType(tlsConfig config.RqTLSConfig) (tls.ClientAuthType, error) {
+	switch strings.ToLower(tlsConfig.ClientAuth) {
+	case "":
+		if tlsConfig.ClientCAFile != "" {
+			return tls.RequireAndVerifyClientCert, nil
+		}
+		return tls.NoClientCert, nil
+	case "none":
+		return tls.NoClientCert, nil
+	case "request":
+		if tlsConfig.ClientCAFile == "" {
+			return 0, errors.New("client_auth request needs a client_ca_file")
+		}
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		if tlsConfig.ClientCAFile == "" {
+			return 0, errors.New("client_auth require needs a client_ca_file")
+		}
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return 0, fmt.Errorf("unknown client_auth: %v", tlsConfig.ClientAuth)
+	}
+}
+
+// RqClientCertMiddleware adds the subject of a verified client certificate to the request's Context, to be recorded
+// on the records it enqueues. The client is identified by the name its subject or common name is mapped to in the
+// identities config, or otherwise its common name, unless it also authenticates with a key.
+func RqClientCertMiddleware(next http.Handler) http.Handler {
+	identities := config.Config.Server.TLS.Identities
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		cert := req.TLS.VerifiedChains[0][0]
+		subject := cert.Subject.String()
+
+		client, ok := identities[subject]
+		if !ok {
+			client, ok = identities[cert.Subject.CommonName]
+		}
+		if !ok {
+			client = cert.Subject.CommonName
+		}
+
+		ctx := context.WithValue(req.Context(), "rqcertsubject", subject)
+		ctx = context.WithValue(ctx, "rqclient", client)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// getRqCertSubject returns the subject of the client's verified certificate from the Request's Context, if any
+func getRqCertSubject(req *http.Request) string {
+	if subject, ok := req.Context().Value("rqcertsubject").(string); ok {
+		return subject
+	}
+	return ""
+}
+
+// listenAndServe serves handler on the configured address, over HTTPS if a certificate is configured
+func listenAndServe(handler http.Handler) error {
+	serverConfig := config.Config.Server
+	server := &http.Server{Addr: serverConfig.Listen, Handler: handler}
+	if server.Addr == "" {
+		server.Addr = defaultListen
+	}
+
+	if serverConfig.TLS.CertFile == "" && serverConfig.TLS.KeyFile == "" {
+		slog.Info("listening", "address", server.Addr)
+		return server.ListenAndServe()
+	}
+
+	reloader, err := newCertReloader(serverConfig.TLS)
+	if err != nil {
+		return err
+	}
+	server.TLSConfig = reloader.ServerConfig()
+
+	interval := time.Duration(serverConfig.TLS.ReloadIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	go reloader.Watch(context.Background(), interval)
+	go reloadOnHangup(reloader)
+
+	slog.Info("listening with TLS", "address", server.Addr)
+	return server.ListenAndServeTLS("", "")
+}
+
+// reloadOnHangup reloads the certificate files when the server receives SIGHUP
+func reloadOnHangup(reloader *certReloader) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := reloader.Reload(); err != nil {
+			slog.Error("error reloading TLS certificates, keeping the previous certificates", "error", err)
+			continue
+		}
+		slog.Info("reloaded TLS certificates")
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"rq/config"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert returns a certificate for commonName, signed by parent, or self-signed as a CA if parent is nil
+func newTestCert(t *testing.T, commonName string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Imagination"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+// writeTestCert writes cert's certificate and key to dir, returning their paths
+func writeTestCert(t *testing.T, dir string, cert *testCert) (string, string) {
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, cert.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, cert.keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestClientCertIdentity(t *testing.T) {
+	ca := newTestCert(t, "rq test CA", nil)
+	serverCert := newTestCert(t, "rq", ca)
+	kiosk := newTestCert(t, "kiosk-1", ca)
+	backend := newTestCert(t, "backend", ca)
+
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, serverCert)
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, ca.certPEM, 0600)
+
+	previous := config.Config.Server.TLS
+	config.Config.Server.TLS = config.RqTLSConfig{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: caFile,
+		Identities:   map[string]string{"CN=kiosk-1,O=Imagination": "lobby-kiosk"},
+	}
+	defer func() { config.Config.Server.TLS = previous }()
+
+	reloader, err := newCertReloader(config.Config.Server.TLS)
+	if err != nil {
+		t.Fatalf("newCertReloader() error = %v", err)
+	}
+
+	var gotSubject, gotClient string
+	server := httptest.NewUnstartedServer(RqClientCertMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotSubject = getRqCertSubject(req)
+		gotClient = getRqClient(req)
+	})))
+	server.TLS = reloader.ServerConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		name        string
+		clientCert  *testCert
+		wantErr     bool
+		wantSubject string
+		wantClient  string
+	}{
+		{name: "mapped identity", clientCert: kiosk, wantSubject: "CN=kiosk-1,O=Imagination", wantClient: "lobby-kiosk"},
+		{name: "common name", clientCert: backend, wantSubject: "CN=backend,O=Imagination", wantClient: "backend"},
+		{name: "no client certificate", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gotSubject, gotClient = "", ""
+			clientConfig := &tls.Config{RootCAs: roots}
+			if test.clientCert != nil {
+				clientConfig.Certificates = []tls.Certificate{{
+					Certificate: [][]byte{test.clientCert.cert.Raw},
+					PrivateKey:  test.clientCert.key,
+				}}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+
+			resp, err := client.Get(server.URL)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			resp.Body.Close()
+			assert.Equal(t, test.wantSubject, gotSubject)
+			assert.Equal(t, test.wantClient, gotClient)
+		})
+	}
+}
+
+func TestCertReloaderReload(t *testing.T) {
+	ca := newTestCert(t, "rq test CA", nil)
+	first := newTestCert(t, "first", ca)
+	second := newTestCert(t, "second", ca)
+
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, first)
+	reloader, err := newCertReloader(config.RqTLSConfig{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("newCertReloader() error = %v", err)
+	}
+	assert.False(t, reloader.Changed())
+
+	servedCommonName := func() string {
+		tlsConfig, _ := reloader.GetConfigForClient(nil)
+		cert, _ := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+		return cert.Subject.CommonName
+	}
+	assert.Equal(t, "first", servedCommonName())
+
+	// Renew the certificate, as a certificate manager would
+	writeTestCert(t, dir, second)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	assert.True(t, reloader.Changed())
+	assert.NoError(t, reloader.Reload())
+	assert.Equal(t, "second", servedCommonName())
+	assert.False(t, reloader.Changed())
+
+	// A broken certificate is not loaded, and the previous certificate is kept
+	os.WriteFile(certFile, []byte("not a certificate"), 0600)
+	assert.Error(t, reloader.Reload())
+	assert.Equal(t, "second", servedCommonName())
+}
+
+func TestListenAndServeTLS(t *testing.T) {
+	ca := newTestCert(t, "rq test CA", nil)
+	serverCert := newTestCert(t, "rq", ca)
+	certFile, keyFile := writeTestCert(t, t.TempDir(), serverCert)
+
+	// Find a free port for the server to listen on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	previous := config.Config.Server
+	config.Config.Server.Listen = addr
+	config.Config.Server.TLS = config.RqTLSConfig{CertFile: certFile, KeyFile: keyFile}
+	defer func() { config.Config.Server = previous }()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- listenAndServe(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		select {
+		case err := <-served:
+			t.Fatalf("listenAndServe() error = %v", err)
+		default:
+		}
+
+		resp, err := client.Get("https://" + addr)
+		if err == nil {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "rq", resp.TLS.PeerCertificates[0].Subject.CommonName)
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("TLS request error = %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientAuthType(t *testing.T) {
+	tests := []struct {
+		name      string
+		tlsConfig config.RqTLSConfig
+		want      tls.ClientAuthType
+		wantErr   bool
+	}{
+		{name: "no client CA", tlsConfig: config.RqTLSConfig{}, want: tls.NoClientCert},
+		{name: "required by default with a client CA", tlsConfig: config.RqTLSConfig{ClientCAFile: "ca.pem"}, want: tls.RequireAndVerifyClientCert},
+		{name: "request", tlsConfig: config.RqTLSConfig{ClientCAFile: "ca.pem", ClientAuth: "request"}, want: tls.VerifyClientCertIfGiven},
+		{name: "none", tlsConfig: config.RqTLSConfig{ClientCAFile: "ca.pem", ClientAuth: "none"}, want: tls.NoClientCert},
+		{name: "require without a client CA", tlsConfig: config.RqTLSConfig{ClientAuth: "require"}, wantErr: true},
+		{name: "unknown", tlsConfig: config.RqTLSConfig{ClientAuth: "optional"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := clientAuthType(test.tlsConfig)
+			assert.Equal(t, test.wantErr, err != nil)
+			if !test.wantErr {
+				assert.Equal(t, test.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+// Package tracing configures OpenTelemetry tracing. A request is traced from the device's call to rq, through its
+// storage, to its onward delivery, which is linked to the enqueue span by the W3C traceparent kept on the record.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"rq/config"
+	"strings"
+)
+
+// instrumentationName names the tracer rq's spans are started with
+const instrumentationName = "rq"
+
+// defaultServiceName is the service spans are reported from, if none is configured
+const defaultServiceName = "rq"
+
+// propagator reads and writes the W3C traceparent and tracestate headers
+var propagator = propagation.TraceContext{}
+
+// Setup installs a TracerProvider exporting spans as configured. The returned function flushes any spans not yet
+// exported, and should be called before exiting. If tracing is not enabled spans are not recorded.
+func Setup(ctx context.Context) (func(context.Context) error, error) {
+	tracingConfig := config.Config.Tracing
+	if !tracingConfig.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	provider, err := NewTracerProvider(ctx, tracingConfig)
+	if err != nil {
+		return nil, err
+	}
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+	return provider.Shutdown, nil
+}
+
+// NewTracerProvider returns a TracerProvider with the configured exporter and sampling. Spans written to stdout or a
+// file are exported as each ends, so they can be read while testing offline, while OTLP exports are batched.
+func NewTracerProvider(ctx context.Context, tracingConfig config.RqTracingConfig) (*sdktrace.TracerProvider, error) {
+	var processor sdktrace.SpanProcessor
+	switch strings.ToLower(tracingConfig.Exporter) {
+	case "", "otlp":
+		options := []otlptracehttp.Option{}
+		if tracingConfig.Endpoint != "" {
+			endpoint, err := url.Parse(tracingConfig.Endpoint)
+			if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+				return nil, fmt.Errorf("invalid otlp endpoint: %v", tracingConfig.Endpoint)
+			}
+			options = append(options, otlptracehttp.WithEndpointURL(tracingConfig.Endpoint))
+		}
+		if len(tracingConfig.Headers) > 0 {
+			options = append(options, otlptracehttp.WithHeaders(tracingConfig.Headers))
+		}
+		exporter, err := otlptracehttp.New(ctx, options...)
+		if err != nil {
+			return nil, fmt.Errorf("otlp exporter: %w", err)
+		}
+		processor = sdktrace.NewBatchSpanProcessor(exporter)
+	case "stdout":
+		exporter, err := newWriterExporter(os.Stdout)
+		if err != nil {
+			return nil, err
+		}
+		processor = sdktrace.NewSimpleSpanProcessor(exporter)
+	case "file":
+		if tracingConfig.File == "" {
+			return nil, fmt.Errorf("file exporter requires a file")
+		}
+		file, err := os.OpenFile(tracingConfig.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("file exporter: %w", err)
+		}
+		exporter, err := newWriterExporter(file)
+		if err != nil {
+			return nil, err
+		}
+		processor = sdktrace.NewSimpleSpanProcessor(exporter)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter: %v", tracingConfig.Exporter)
+	}
+
+	ratio := tracingConfig.SampleRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+	serviceName := tracingConfig.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	), nil
+}
+
+// newWriterExporter returns an exporter writing each span to w as a line of JSON
+func newWriterExporter(w io.Writer) (sdktrace.SpanExporter, error) {
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(w))
+	if err != nil {
+		return nil, fmt.Errorf("stdout exporter: %w", err)
+	}
+	return exporter, nil
+}
+
+// Tracer returns the tracer rq's spans are started with
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// End records err on span, if there is one, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Extract returns a copy of ctx carrying the trace context sent in header, if there is one
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Inject sets the traceparent and tracestate of the span in ctx on header, replacing any already set
+func Inject(ctx context.Context, header http.Header) {
+	header.Del("Traceparent")
+	header.Del("Tracestate")
+	propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// TraceParent returns the W3C traceparent of the span in ctx, or "" if there is none
+func TraceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// SpanContext returns the span context described by a W3C traceparent, which is invalid if traceParent is empty or
+// malformed
+func SpanContext(traceParent string) trace.SpanContext {
+	ctx := propagator.Extract(context.Background(), propagation.MapCarrier{"traceparent": traceParent})
+	return trace.SpanContextFromContext(ctx)
+}
@@ -0,0 +1,82 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"rq/config"
+	"testing"
+)
+
+func TestNewTracerProviderFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "spans.json")
+	provider, err := NewTracerProvider(context.Background(), config.RqTracingConfig{Exporter: "file", File: file, ServiceName: "rq-test"})
+	if err != nil {
+		t.Fatalf("NewTracerProvider() error = %v", err)
+	}
+
+	_, span := provider.Tracer(instrumentationName).Start(context.Background(), "HandleRequest")
+	span.End()
+	provider.Shutdown(context.Background())
+
+	out, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exported struct {
+		Name     string
+		Resource []struct {
+			Key   string
+			Value struct{ Value string }
+		}
+	}
+	if err := json.Unmarshal(out, &exported); err != nil {
+		t.Fatalf("exported span %q is not JSON: %v", out, err)
+	}
+	if exported.Name != "HandleRequest" {
+		t.Errorf("span name = %q, want HandleRequest", exported.Name)
+	}
+	if len(exported.Resource) != 1 || exported.Resource[0].Value.Value != "rq-test" {
+		t.Errorf("resource = %+v, want service.name rq-test", exported.Resource)
+	}
+}
+
+func TestNewTracerProviderInvalidConfig(t *testing.T) {
+	tests := []config.RqTracingConfig{
+		{Exporter: "zipkin"},
+		{Exporter: "file"},
+		{Exporter: "file", File: "/does/not/exist/spans.json"},
+		{Exporter: "otlp", Endpoint: "://collector"},
+	}
+	for _, tracingConfig := range tests {
+		if _, err := NewTracerProvider(context.Background(), tracingConfig); err == nil {
+			t.Errorf("NewTracerProvider(%+v) returned no error", tracingConfig)
+		}
+	}
+}
+
+func TestTraceParent(t *testing.T) {
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	ctx := Extract(context.Background(), http.Header{"Traceparent": {traceParent}})
+	if got := TraceParent(ctx); got != traceParent {
+		t.Errorf("TraceParent() = %q, want %q", got, traceParent)
+	}
+	if got := SpanContext(traceParent).TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("SpanContext() trace id = %v", got)
+	}
+	if SpanContext("").IsValid() || SpanContext("not a traceparent").IsValid() {
+		t.Error("SpanContext() of an invalid traceparent is valid")
+	}
+
+	header := http.Header{"Traceparent": {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}, "Tracestate": {"vendor=1"}}
+	Inject(ctx, header)
+	if got := header.Get("Traceparent"); got != traceParent {
+		t.Errorf("Inject() traceparent = %q, want %q", got, traceParent)
+	}
+	if got := header.Get("Tracestate"); got != "" {
+		t.Errorf("Inject() kept tracestate %q", got)
+	}
+}
@@ -0,0 +1,688 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"log/slog"
+	"net/http"
+	"rq/config"
+	"rq/files"
+	"rq/records"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Resumable Uploads
+
+	Large files can be uploaded ahead of enqueuing a request, in chunks, using a subset of the tus protocol
+	(https://tus.io/protocols/resumable-upload). An upload is created, its chunks sent with PATCH requests, and
+	after a dropped connection the client asks how much was received with HEAD and carries on from there.
+
+		curl -X POST -H "Upload-Length: 524288000" -H "Upload-Metadata: filename dmlkZW8ubXA0" http://localhost:8080/api/rq/uploads
+		curl -X PATCH -H "Upload-Offset: 0" -H "Content-Type: application/offset+octet-stream" --data-binary @chunk1 http://localhost:8080/api/rq/uploads/{id}
+		curl -I http://localhost:8080/api/rq/uploads/{id}
+
+	Once complete, the upload is attached to a request as a file key with the upload querystring parameter:
+
+		curl -X POST -d "url=https://imagination.com" "http://localhost:8080/api/rq/http?upload=file:{id}"
+
+	Everything is kept in the FileStore, so uploads survive a restart. Each chunk is saved as its own file and only
+	counted once it has been stored in full, so an interrupted PATCH is resumed from the end of the last whole chunk.
+
+	An upload expires if it is not attached to a request within the expiry_seconds of being created, given in the
+	Upload-Expires header, after which it is no longer found and is removed by the next sweep.
+*/
+
+const (
+	tusVersion          = "1.0.0"
+	uploadsPath         = "/api/rq/uploads"
+	uploadQueryKey      = "upload"
+	uploadChunkMimeType = "application/offset+octet-stream"
+	// defaultUploadExpiry is how long an upload is kept for if no expiry_seconds is configured
+	defaultUploadExpiry = 24 * time.Hour
+	// uploadSweepInterval is how often expired uploads are removed
+	uploadSweepInterval = time.Hour
+)
+
+// RqUpload describes a resumable upload, and is stored in the FileStore when the upload is created.
+type RqUpload struct {
+	Id       string    `json:"id"`
+	Tenant   string    `json:"tenant"`
+	Length   int64     `json:"length"`
+	Filename string    `json:"filename"`
+	Created  time.Time `json:"created"`
+}
+
+// UploadServer handles the creation of resumable uploads and the chunks sent to them.
+type UploadServer struct {
+	Records *RecordServer
+	// locks holds a mutex for each upload receiving chunks, removed once the upload completes or is removed
+	locks sync.Map
+}
+
+func (us *UploadServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	id := strings.Trim(strings.TrimPrefix(req.URL.Path, uploadsPath), "/")
+	if id != "" && !validUploadId(id) {
+		ReturnHTTPErrorResponse(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case id == "" && req.Method == http.MethodPost:
+		us.HandleCreate(w, req)
+	case id == "" && req.Method == http.MethodOptions:
+		w.Header().Set("Tus-Version", tusVersion)
+		w.WriteHeader(http.StatusNoContent)
+	case id != "" && req.Method == http.MethodHead:
+		us.HandleHead(w, req, id)
+	case id != "" && req.Method == http.MethodPatch:
+		us.HandlePatch(w, req, id)
+	default:
+		ReturnHTTPErrorResponse(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleCreate starts a new upload of the length given in the Upload-Length header. The original filename must be
+// supplied in the Upload-Metadata header, and is validated against the permitted file extensions.
+func (us *UploadServer) HandleCreate(w http.ResponseWriter, req *http.Request) {
+	length, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		ReturnHTTPErrorResponse(w, "invalid or missing Upload-Length", http.StatusBadRequest)
+		return
+	}
+
+	if maxBytes := config.Config.Uploads.MaxFileBytes; maxBytes > 0 && length > maxBytes {
+		errMsg := fmt.Sprintf("upload exceeds the maximum of %v bytes", maxBytes)
+		ReturnHTTPErrorResponse(w, errMsg, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	tenant := getRqTenant(req)
+	err = us.Records.checkCapacity(length)
+	if err == nil {
+		err = us.Records.checkTenantQuota(tenant, length)
+	}
+	if err != nil {
+		rejectAtCapacity(w, req, err)
+		return
+	}
+
+	filename := parseUploadMetadata(req.Header.Get("Upload-Metadata"))["filename"]
+	if filename == "" {
+		ReturnHTTPErrorResponse(w, "filename missing from Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	if fileExtOk, _ := files.CheckExtensionIsAllowed(filename, config.Config.PermittedFileExtensions); !fileExtOk {
+		errMsg := fmt.Sprintf("File extension not allowed: %v", filename)
+		ReturnHTTPErrorResponse(w, errMsg, http.StatusBadRequest)
+		return
+	}
+
+	upload := RqUpload{
+		Id:       GenerateRequestId(),
+		Tenant:   tenant,
+		Length:   length,
+		Filename: filename,
+		Created:  time.Now().UTC(),
+	}
+	out, _ := json.Marshal(upload)
+	if _, err := us.Records.FileStore.Save(uploadInfoName(upload.Id), strings.NewReader(string(out))); err != nil {
+		slog.ErrorContext(req.Context(), "error creating upload", "upload", upload.Id, "error", err)
+		ReturnHTTPErrorResponse(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// A zero length upload is complete as soon as it is created
+	if length == 0 {
+		if err := us.complete(req.Context(), upload); err != nil {
+			ReturnHTTPErrorResponse(w, err.Error(), httpStatus(err))
+			return
+		}
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("%v/%v", uploadsPath, upload.Id))
+	w.Header().Set("Upload-Expires", upload.Expires().Format(http.TimeFormat))
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HandleHead reports how much of an upload has been received, so an interrupted upload can be resumed.
+func (us *UploadServer) HandleHead(w http.ResponseWriter, req *http.Request, id string) {
+	upload, err := us.load(id, getRqTenant(req))
+	if err != nil {
+		w.WriteHeader(httpStatus(err))
+		return
+	}
+
+	offset, err := us.offset(upload)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.Expires().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandlePatch stores a chunk of an upload. The Upload-Offset header must match the amount already received.
+func (us *UploadServer) HandlePatch(w http.ResponseWriter, req *http.Request, id string) {
+	if req.Header.Get("Content-Type") != uploadChunkMimeType {
+		errMsg := fmt.Sprintf("Content-Type must be %v", uploadChunkMimeType)
+		ReturnHTTPErrorResponse(w, errMsg, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	requestOffset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || requestOffset < 0 {
+		ReturnHTTPErrorResponse(w, "invalid or missing Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	// Unknown uploads are turned away before a lock is held for them
+	if _, err := us.load(id, getRqTenant(req)); err != nil {
+		ReturnHTTPErrorResponse(w, err.Error(), httpStatus(err))
+		return
+	}
+
+	// Chunks for the same upload are handled one at a time, so offsets can't interleave
+	lock, _ := us.locks.LoadOrStore(id, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	upload, err := us.load(id, getRqTenant(req))
+	if err != nil {
+		ReturnHTTPErrorResponse(w, err.Error(), httpStatus(err))
+		return
+	}
+
+	offset, err := us.offset(upload)
+	if err != nil {
+		ReturnHTTPErrorResponse(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if requestOffset != offset {
+		errMsg := fmt.Sprintf("Upload-Offset %v does not match current offset %v", requestOffset, offset)
+		ReturnHTTPErrorResponse(w, errMsg, http.StatusConflict)
+		return
+	}
+
+	// Nothing more to receive, the client is repeating the final chunk after missing the response, or after completing
+	// the upload failed, in which case it is completed again
+	if offset == upload.Length {
+		if _, err := us.Records.FileStore.Stat(uploadDoneName(id)); errors.Is(err, files.ErrFileNotFound) {
+			if err := us.complete(req.Context(), upload); err != nil {
+				ReturnHTTPErrorResponse(w, err.Error(), httpStatus(err))
+				return
+			}
+		}
+		us.locks.Delete(id)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Expires", upload.Expires().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	remaining := upload.Length - offset
+	if req.ContentLength > remaining {
+		errMsg := fmt.Sprintf("chunk exceeds the remaining %v bytes of the upload", remaining)
+		ReturnHTTPErrorResponse(w, errMsg, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	err = us.Records.checkCapacity(req.ContentLength)
+	if err == nil {
+		err = us.Records.checkTenantQuota(upload.Tenant, req.ContentLength)
+	}
+	if err != nil {
+		rejectAtCapacity(w, req, err)
+		return
+	}
+
+	chunk := &countingReader{reader: http.MaxBytesReader(w, req.Body, remaining)}
+	if _, err := us.Records.FileStore.Save(uploadChunkName(id, offset), chunk); err != nil {
+		if err, tooLarge := asRequestTooLarge(err); tooLarge {
+			ReturnHTTPErrorResponse(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		slog.ErrorContext(req.Context(), "error saving chunk", "upload", id, "offset", offset, "error", err)
+		ReturnHTTPErrorResponse(w, "error saving chunk, resume from the current Upload-Offset", http.StatusInternalServerError)
+		return
+	}
+	if chunk.count == 0 {
+		fileStore := us.Records.FileStore
+		fileStore.Delete(uploadChunkName(id, offset))
+	}
+	offset += chunk.count
+
+	if offset == upload.Length {
+		if err := us.complete(req.Context(), upload); err != nil {
+			ReturnHTTPErrorResponse(w, err.Error(), httpStatus(err))
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", upload.Expires().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// complete joins the chunks of a finished upload into a single file, validates it as any other uploaded file would
+// be, and records the stored file so it can be attached to a request. An upload which fails validation is removed,
+// as it never will pass, while after any other error the chunks are kept so completing it can be tried again.
+func (us *UploadServer) complete(ctx context.Context, upload RqUpload) error {
+	fileStore := us.Records.FileStore
+
+	chunks, err := fileStore.List(uploadChunkPrefix(upload.Id))
+	if err != nil {
+		return err
+	}
+
+	readers := []io.Reader{}
+	for _, chunk := range chunks {
+		reader, err := fileStore.Open(chunk.Name)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		readers = append(readers, reader)
+	}
+
+	storedFile, err := us.Records.saveFile(ctx, uploadName(upload.Id), "file", upload.Filename, io.MultiReader(readers...))
+	if err != nil {
+		if httpStatus(err) < http.StatusInternalServerError {
+			us.remove(ctx, upload.Id, chunks)
+		}
+		return err
+	}
+
+	out, _ := json.Marshal(storedFile)
+	if _, err := fileStore.Save(uploadDoneName(upload.Id), strings.NewReader(string(out))); err != nil {
+		return err
+	}
+
+	for _, chunk := range chunks {
+		if err := fileStore.Delete(chunk.Name); err != nil {
+			slog.ErrorContext(ctx, "error removing chunk", "chunk", chunk.Name, "error", err)
+		}
+	}
+	us.locks.Delete(upload.Id)
+	return nil
+}
+
+// remove deletes the chunks and details of an upload which failed validation, so it is no longer found
+func (us *UploadServer) remove(ctx context.Context, id string, chunks []files.FileInfo) {
+	fileStore := us.Records.FileStore
+	for _, chunk := range chunks {
+		if err := fileStore.Delete(chunk.Name); err != nil {
+			slog.ErrorContext(ctx, "error removing chunk", "chunk", chunk.Name, "error", err)
+		}
+	}
+	if err := fileStore.Delete(uploadInfoName(id)); err != nil {
+		slog.ErrorContext(ctx, "error removing upload", "upload", id, "error", err)
+	}
+	us.locks.Delete(id)
+}
+
+// Expires returns when the upload expires, if it has not been attached to a request by then
+func (upload RqUpload) Expires() time.Time {
+	expiry := defaultUploadExpiry
+	if seconds := config.Config.Uploads.ExpirySeconds; seconds > 0 {
+		expiry = time.Duration(seconds) * time.Second
+	}
+	return upload.Created.Add(expiry)
+}
+
+// RunSweeper removes expired uploads every uploadSweepInterval until ctx is done
+func (us *UploadServer) RunSweeper(ctx context.Context) {
+	ticker := time.NewTicker(uploadSweepInterval)
+	defer ticker.Stop()
+	for {
+		if err := us.Sweep(ctx, time.Now()); err != nil {
+			slog.ErrorContext(ctx, "error sweeping expired uploads", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep removes the uploads which expired before now, along with their chunks, or the file of those completed. Uploads
+// being attached to a request or receiving a chunk are left until they are finished with.
+func (us *UploadServer) Sweep(ctx context.Context, now time.Time) error {
+	fileStore := us.Records.FileStore
+	stored, err := fileStore.List(uploadName(""))
+	if err != nil {
+		return err
+	}
+
+	for _, info := range stored {
+		id, isInfo := strings.CutSuffix(strings.TrimPrefix(info.Name, uploadName("")), ".info")
+		if !isInfo || !validUploadId(id) {
+			continue
+		}
+
+		var upload RqUpload
+		if err := readJsonFile(fileStore, info.Name, &upload); err != nil || upload.Expires().After(now) {
+			continue
+		}
+
+		lock, _ := us.locks.LoadOrStore(id, &sync.Mutex{})
+		if !lock.(*sync.Mutex).TryLock() {
+			continue
+		}
+		if us.Records.claimUpload(id) != nil {
+			lock.(*sync.Mutex).Unlock()
+			continue
+		}
+		us.expire(ctx, id)
+		us.Records.unclaimUploads([]string{id})
+		lock.(*sync.Mutex).Unlock()
+	}
+	return nil
+}
+
+// expire removes an expired upload. The details are removed last, so an upload which can't be fully removed is tried
+// again by the next sweep, and the file is only removed while the upload is marked complete, as once that mark is gone
+// the file may be attached to a record.
+func (us *UploadServer) expire(ctx context.Context, id string) {
+	fileStore := us.Records.FileStore
+	names := []string{}
+	if _, err := fileStore.Stat(uploadDoneName(id)); err == nil {
+		if storedFile, err := loadCompletedUploadFile(fileStore, id); err == nil {
+			names = append(names, storedFile.Filename)
+		}
+	}
+	chunks, err := fileStore.List(uploadChunkPrefix(id))
+	if err != nil {
+		slog.ErrorContext(ctx, "error listing chunks of expired upload", "upload", id, "error", err)
+		return
+	}
+	for _, chunk := range chunks {
+		names = append(names, chunk.Name)
+	}
+	names = append(names, uploadDoneName(id), uploadInfoName(id))
+
+	for _, name := range names {
+		if err := fileStore.Delete(name); err != nil && !errors.Is(err, files.ErrFileNotFound) {
+			slog.ErrorContext(ctx, "error removing expired upload", "upload", id, "file", name, "error", err)
+			return
+		}
+	}
+	us.locks.Delete(id)
+	slog.InfoContext(ctx, "removed expired upload", "upload", id)
+}
+
+// load returns the upload with the given id, or a 404 StatusError if it does not exist or belongs to another tenant
+func (us *UploadServer) load(id string, tenant string) (RqUpload, error) {
+	return loadUpload(us.Records.FileStore, id, tenant)
+}
+
+// offset returns the number of bytes received for an upload, from the chunks stored so far
+func (us *UploadServer) offset(upload RqUpload) (int64, error) {
+	if _, err := us.Records.FileStore.Stat(uploadDoneName(upload.Id)); err == nil {
+		return upload.Length, nil
+	}
+
+	chunks, err := us.Records.FileStore.List(uploadChunkPrefix(upload.Id))
+	if err != nil {
+		return 0, err
+	}
+
+	var offset int64
+	for _, chunk := range chunks {
+		offset += chunk.Size
+	}
+	return offset, nil
+}
+
+// HandleUploadReferences attaches completed uploads referenced in the querystring to the record, as file keys. Each
+// reference takes the form upload={key}:{upload id}. The ids of the attached uploads are returned, to be released
+// once the record has been saved.
+func (rs *RecordServer) HandleUploadReferences(querystring map[string][]string, record *records.RqRecord) ([]string, error) {
+	references := querystring[uploadQueryKey]
+	if len(references) == 0 {
+		return nil, nil
+	}
+
+	storedFiles, _ := record.GetFiles()
+	keys := []string{}
+	if record.FileKeys != "" {
+		json.Unmarshal([]byte(record.FileKeys), &keys)
+	}
+
+	ids := []string{}
+	for _, reference := range references {
+		key, id, found := strings.Cut(reference, ":")
+		if !found || key == "" || id == "" {
+			return nil, StatusError{
+				StatusCode: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid upload reference %q, expected {key}:{upload id}", reference),
+			}
+		}
+
+		// The upload is claimed before it is read, so it can't be attached by another request in the meantime
+		if err := rs.claimUpload(id); err != nil {
+			rs.unclaimUploads(ids)
+			return nil, err
+		}
+		storedFile, err := loadCompletedUpload(rs.FileStore, id, record.Tenant)
+		if err != nil {
+			rs.unclaimUploads(append(ids, id))
+			return nil, err
+		}
+
+		if _, exists := storedFiles[key]; exists {
+			rs.unclaimUploads(append(ids, id))
+			return nil, duplicateFileKeyError(key)
+		}
+		keys = append(keys, key)
+		storedFiles[key] = storedFile
+		ids = append(ids, id)
+	}
+
+	out, _ := json.Marshal(keys)
+	record.FileKeys = string(out)
+	record.SetFiles(storedFiles)
+	return ids, nil
+}
+
+// releaseUploads removes the upload details for uploads now attached to a record, and releases their claims. The
+// uploaded file itself is kept, as the record refers to it. The completed mark is removed first, as an upload without
+// it is never swept with its file.
+func (rs *RecordServer) releaseUploads(ctx context.Context, ids []string) {
+	for _, id := range ids {
+		for _, name := range []string{uploadDoneName(id), uploadInfoName(id)} {
+			if err := rs.FileStore.Delete(name); err != nil {
+				slog.ErrorContext(ctx, "error releasing upload", "upload", id, "error", err)
+			}
+		}
+	}
+	rs.unclaimUploads(ids)
+}
+
+// claimUpload marks an upload as being attached to a record or removed, returning a 409 StatusError if it already is
+func (rs *RecordServer) claimUpload(id string) error {
+	if _, claimed := rs.uploadClaims.LoadOrStore(id, true); claimed {
+		return StatusError{
+			StatusCode: http.StatusConflict,
+			Err:        fmt.Errorf("upload %v is already being attached to a request", id),
+		}
+	}
+	return nil
+}
+
+// unclaimUploads releases the claims on uploads which were not attached, so they can be attached again
+func (rs *RecordServer) unclaimUploads(ids []string) {
+	for _, id := range ids {
+		rs.uploadClaims.Delete(id)
+	}
+}
+
+// tenantUploadBytes returns the bytes received for the uploads of tenant which are not yet attached to a record, the
+// chunks of those in progress and the files of those complete, as they count towards the tenant's storage quota
+func tenantUploadBytes(fileStore files.FileStore, tenant string) (int64, error) {
+	stored, err := fileStore.List(uploadName(""))
+	if err != nil {
+		return 0, err
+	}
+
+	ids := []string{}
+	sizes := map[string]int64{}
+	for _, info := range stored {
+		name := strings.TrimPrefix(info.Name, uploadName(""))
+		if len(name) < len(uuid.Nil.String()) {
+			continue
+		}
+		// Names are the upload id followed by .info, .done, .part-{offset}, or the key and extension of the file
+		id, suffix := name[:len(uuid.Nil.String())], name[len(uuid.Nil.String()):]
+		switch suffix {
+		case ".info":
+			ids = append(ids, id)
+		case ".done":
+		default:
+			sizes[id] += info.Size
+		}
+	}
+
+	var total int64
+	for _, id := range ids {
+		if _, err := loadUpload(fileStore, id, tenant); err != nil {
+			if httpStatus(err) == http.StatusNotFound {
+				continue
+			}
+			return 0, err
+		}
+		total += sizes[id]
+	}
+	return total, nil
+}
+
+// loadUpload reads the details of an upload from the FileStore. Uploads belonging to another tenant are reported as
+// not found, so tenants cannot discover each other's uploads.
+func loadUpload(fileStore files.FileStore, id string, tenant string) (RqUpload, error) {
+	var upload RqUpload
+	if !validUploadId(id) {
+		return upload, uploadNotFound(id, files.ErrFileNotFound)
+	}
+	if err := readJsonFile(fileStore, uploadInfoName(id), &upload); err != nil {
+		return upload, uploadNotFound(id, err)
+	}
+	if upload.Tenant != tenant || !upload.Expires().After(time.Now()) {
+		return RqUpload{}, uploadNotFound(id, files.ErrFileNotFound)
+	}
+	return upload, nil
+}
+
+// loadCompletedUpload returns the stored file for an upload, or an error if the upload is not complete
+func loadCompletedUpload(fileStore files.FileStore, id string, tenant string) (records.RqFile, error) {
+	if _, err := loadUpload(fileStore, id, tenant); err != nil {
+		return records.RqFile{}, err
+	}
+
+	storedFile, err := loadCompletedUploadFile(fileStore, id)
+	if err != nil {
+		if errors.Is(err, files.ErrFileNotFound) {
+			return storedFile, StatusError{
+				StatusCode: http.StatusConflict,
+				Err:        fmt.Errorf("upload %v is not complete", id),
+			}
+		}
+		return storedFile, err
+	}
+	return storedFile, nil
+}
+
+// loadCompletedUploadFile returns the stored file recorded when an upload completed
+func loadCompletedUploadFile(fileStore files.FileStore, id string) (records.RqFile, error) {
+	var storedFile records.RqFile
+	err := readJsonFile(fileStore, uploadDoneName(id), &storedFile)
+	return storedFile, err
+}
+
+func readJsonFile(fileStore files.FileStore, filename string, v any) error {
+	reader, err := fileStore.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return json.NewDecoder(reader).Decode(v)
+}
+
+func uploadNotFound(id string, err error) error {
+	if errors.Is(err, files.ErrFileNotFound) {
+		return StatusError{
+			StatusCode: http.StatusNotFound,
+			Err:        fmt.Errorf("upload %v not found", id),
+		}
+	}
+	return err
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header, a comma separated list of keys and base64 encoded values
+func parseUploadMetadata(header string) map[string]string {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(value)
+	}
+	return metadata
+}
+
+// httpStatus returns the status code for err, defaulting to 500 for errors which are not an HttpError
+func httpStatus(err error) int {
+	if e, ok := err.(HttpError); ok {
+		return e.Status()
+	}
+	return http.StatusInternalServerError
+}
+
+// validUploadId reports whether id is a well formed upload id, so it is safe to use in file names
+func validUploadId(id string) bool {
+	_, err := uuid.Parse(id)
+	return err == nil
+}
+
+func uploadName(id string) string {
+	return "upload-" + id
+}
+
+func uploadInfoName(id string) string {
+	return uploadName(id) + ".info"
+}
+
+func uploadDoneName(id string) string {
+	return uploadName(id) + ".done"
+}
+
+func uploadChunkPrefix(id string) string {
+	return uploadName(id) + ".part-"
+}
+
+// uploadChunkName names each chunk by its offset, zero padded so chunks list in order
+func uploadChunkName(id string, offset int64) string {
+	return fmt.Sprintf("%v%020d", uploadChunkPrefix(id), offset)
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"rq/config"
+	"rq/files"
+	"rq/records"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newUploadTestServer(t *testing.T) (*httptest.Server, *MockMemoryRecordStore, *files.InMemoryFileStore) {
+	store := &MockMemoryRecordStore{db: make(map[string]records.RqRecord)}
+	fileStore, _ := files.NewInMemoryFileStore()
+	recordServer := &RecordServer{Store: store, FileStore: fileStore}
+	uploadServer := &UploadServer{Records: recordServer}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/rq/http", RqHttpMiddleware(recordServer))
+	mux.Handle(uploadsPath, uploadServer)
+	mux.Handle(uploadsPath+"/", uploadServer)
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, store, fileStore
+}
+
+func sendUploadRequest(t *testing.T, method string, url string, headers map[string]string, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	return res
+}
+
+func TestUploadServer_ResumableUpload(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.PermittedFileExtensions = "mp4|jpg"
+	config.Config.Server.AllowedContentTypes = []string{"application/json"}
+
+	server, store, fileStore := newUploadTestServer(t)
+	contents := "a video in two chunks"
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("video.mp4"))
+
+	res := sendUploadRequest(t, http.MethodPost, server.URL+uploadsPath, map[string]string{
+		"Upload-Length":   strconv.Itoa(len(contents)),
+		"Upload-Metadata": metadata,
+	}, "")
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("create got %v, want %v", res.StatusCode, http.StatusCreated)
+	}
+	location := res.Header.Get("Location")
+	id := strings.TrimPrefix(location, uploadsPath+"/")
+	chunkHeaders := func(offset int) map[string]string {
+		return map[string]string{"Upload-Offset": strconv.Itoa(offset), "Content-Type": uploadChunkMimeType}
+	}
+
+	res = sendUploadRequest(t, http.MethodPatch, server.URL+location, chunkHeaders(0), contents[:10])
+	if res.StatusCode != http.StatusNoContent || res.Header.Get("Upload-Offset") != "10" {
+		t.Fatalf("first chunk got %v with offset %v", res.StatusCode, res.Header.Get("Upload-Offset"))
+	}
+
+	// The connection drops, so the client checks how much was received before resuming
+	res = sendUploadRequest(t, http.MethodHead, server.URL+location, nil, "")
+	if res.Header.Get("Upload-Offset") != "10" || res.Header.Get("Upload-Length") != strconv.Itoa(len(contents)) {
+		t.Fatalf("HEAD got offset %v, length %v", res.Header.Get("Upload-Offset"), res.Header.Get("Upload-Length"))
+	}
+
+	res = sendUploadRequest(t, http.MethodPatch, server.URL+location, chunkHeaders(0), contents[:10])
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("chunk at stale offset got %v, want %v", res.StatusCode, http.StatusConflict)
+	}
+
+	res = sendUploadRequest(t, http.MethodPatch, server.URL+location, chunkHeaders(10), contents[10:]+"extra")
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunk past the upload length got %v, want %v", res.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+
+	res = sendUploadRequest(t, http.MethodPatch, server.URL+location, chunkHeaders(10), contents[10:])
+	if res.StatusCode != http.StatusNoContent || res.Header.Get("Upload-Offset") != strconv.Itoa(len(contents)) {
+		t.Fatalf("final chunk got %v with offset %v", res.StatusCode, res.Header.Get("Upload-Offset"))
+	}
+
+	// Uploads can't be attached to a GET request, which has no body to send them in
+	res, _ = http.Get(server.URL + "/api/rq/http?url=https://www.imagination.com&upload=video:" + id)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET with upload got %v, want %v", res.StatusCode, http.StatusBadRequest)
+	}
+
+	// Attach the completed upload to a request
+	res, err := http.Post(server.URL+"/api/rq/http?url=https://www.imagination.com&upload=video:"+id, "application/json", strings.NewReader(`{"title":"a video"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rqreq RqRequest
+	json.NewDecoder(res.Body).Decode(&rqreq)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("enqueue with upload got %v", res.StatusCode)
+	}
+
+	record := store.db[rqreq.Id]
+	storedFiles, _ := record.GetFiles()
+	if record.FileKeys != `["video"]` || storedFiles["video"].Size != int64(len(contents)) {
+		t.Fatalf("record files = %v %+v", record.FileKeys, storedFiles)
+	}
+
+	reader, err := fileStore.Open(storedFiles["video"].Filename)
+	if err != nil {
+		t.Fatalf("uploaded file not in FileStore: %v", err)
+	}
+	got, _ := io.ReadAll(reader)
+	if string(got) != contents {
+		t.Errorf("uploaded file contents = %q, want %q", got, contents)
+	}
+
+	// Only the assembled file remains, and the upload can't be attached twice
+	remaining, _ := fileStore.List("upload-" + id)
+	if len(remaining) != 1 {
+		t.Errorf("FileStore holds %+v for the upload, want only the assembled file", remaining)
+	}
+	res, _ = http.Post(server.URL+"/api/rq/http?url=https://www.imagination.com&upload=video:"+id, "application/json", strings.NewReader(`{"title":"a video"}`))
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("second enqueue with upload got %v, want %v", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestUploadServer_Create(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.PermittedFileExtensions = "mp4|jpg"
+	config.Config.Uploads.MaxFileBytes = 100
+
+	server, _, _ := newUploadTestServer(t)
+	metadata := func(filename string) string {
+		return "filename " + base64.StdEncoding.EncodeToString([]byte(filename))
+	}
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		wantCode int
+	}{
+		{name: "valid", headers: map[string]string{"Upload-Length": "100", "Upload-Metadata": metadata("video.mp4")}, wantCode: http.StatusCreated},
+		{name: "no length", headers: map[string]string{"Upload-Metadata": metadata("video.mp4")}, wantCode: http.StatusBadRequest},
+		{name: "no filename", headers: map[string]string{"Upload-Length": "100"}, wantCode: http.StatusBadRequest},
+		{name: "bad extension", headers: map[string]string{"Upload-Length": "100", "Upload-Metadata": metadata("script.sh")}, wantCode: http.StatusBadRequest},
+		{name: "too large", headers: map[string]string{"Upload-Length": "101", "Upload-Metadata": metadata("video.mp4")}, wantCode: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := sendUploadRequest(t, http.MethodPost, server.URL+uploadsPath, test.headers, "")
+			if res.StatusCode != test.wantCode {
+				t.Errorf("create got %v, want %v", res.StatusCode, test.wantCode)
+			}
+		})
+	}
+
+	res := sendUploadRequest(t, http.MethodHead, server.URL+uploadsPath+"/"+GenerateRequestId(), nil, "")
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("HEAD of unknown upload got %v, want %v", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestUploadServer_TenantIsolation(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.PermittedFileExtensions = "mp4"
+	config.Config.Server.AllowedContentTypes = []string{"application/json"}
+	config.Config.Tenants = map[string]config.RqTenantConfig{"media": {}, "retail": {}}
+	withAuthConfig(t, config.RqAuthConfig{
+		Enabled: true,
+		Keys: []config.RqAuthKeyConfig{
+			{Name: "studio", Type: "api_key", Key: "studio-key", Tenant: "media"},
+			{Name: "kiosk", Type: "api_key", Key: "kiosk-key", Tenant: "retail"},
+		},
+	})
+
+	store := &MockMemoryRecordStore{db: make(map[string]records.RqRecord)}
+	fileStore, _ := files.NewInMemoryFileStore()
+	recordServer := &RecordServer{Store: store, FileStore: fileStore}
+	mux := http.NewServeMux()
+	mux.Handle("/api/rq/http", RqHttpMiddleware(RqAuthMiddleware(recordServer)))
+	mux.Handle(uploadsPath, RqAuthMiddleware(&UploadServer{Records: recordServer}))
+	mux.Handle(uploadsPath+"/", RqAuthMiddleware(&UploadServer{Records: recordServer}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	res := sendUploadRequest(t, http.MethodPost, server.URL+uploadsPath, map[string]string{
+		"X-Api-Key":       "studio-key",
+		"Upload-Length":   "7",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("video.mp4")),
+	}, "")
+	location := res.Header.Get("Location")
+	id := strings.TrimPrefix(location, uploadsPath+"/")
+
+	patchHeaders := func(key string) map[string]string {
+		return map[string]string{"X-Api-Key": key, "Upload-Offset": "0", "Content-Type": uploadChunkMimeType}
+	}
+	jsonHeaders := func(key string) map[string]string {
+		return map[string]string{"X-Api-Key": key, "Content-Type": "application/json"}
+	}
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		headers    map[string]string
+		body       string
+		wantStatus int
+	}{
+		{name: "status for another tenant", method: http.MethodHead, url: location, headers: map[string]string{"X-Api-Key": "kiosk-key"}, wantStatus: http.StatusNotFound},
+		{name: "chunk from another tenant", method: http.MethodPatch, url: location, headers: patchHeaders("kiosk-key"), body: "a video", wantStatus: http.StatusNotFound},
+		{name: "chunk from the owning tenant", method: http.MethodPatch, url: location, headers: patchHeaders("studio-key"), body: "a video", wantStatus: http.StatusNoContent},
+		{name: "attached by another tenant", method: http.MethodPost, url: "/api/rq/http?url=https://www.imagination.com&upload=video:" + id, headers: jsonHeaders("kiosk-key"), body: `{"title":"a video"}`, wantStatus: http.StatusNotFound},
+		{name: "attached by the owning tenant", method: http.MethodPost, url: "/api/rq/http?url=https://www.imagination.com&upload=video:" + id, headers: jsonHeaders("studio-key"), body: `{"title":"a video"}`, wantStatus: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := sendUploadRequest(t, test.method, server.URL+test.url, test.headers, test.body)
+			if res.StatusCode != test.wantStatus {
+				t.Errorf("%v %v got %v, want %v", test.method, test.url, res.StatusCode, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestUploadServer_TenantQuota(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.PermittedFileExtensions = "mp4"
+	config.Config.Tenants = map[string]config.RqTenantConfig{"media": {MaxStoredBytes: 10}}
+	withAuthConfig(t, config.RqAuthConfig{
+		Enabled: true,
+		Keys:    []config.RqAuthKeyConfig{{Name: "studio", Type: "api_key", Key: "studio-key", Tenant: "media"}},
+	})
+
+	recordServer := &RecordServer{Store: &MockMemoryRecordStore{db: make(map[string]records.RqRecord)}}
+	recordServer.FileStore, _ = files.NewInMemoryFileStore()
+	server := httptest.NewServer(RqAuthMiddleware(&UploadServer{Records: recordServer}))
+	defer server.Close()
+
+	// Both uploads fit the quota when created, as nothing has been received for either
+	locations := []string{}
+	for i := 0; i < 2; i++ {
+		res := sendUploadRequest(t, http.MethodPost, server.URL+uploadsPath, map[string]string{
+			"X-Api-Key":       "studio-key",
+			"Upload-Length":   "8",
+			"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("video.mp4")),
+		}, "")
+		if res.StatusCode != http.StatusCreated {
+			t.Fatalf("create got %v, want %v", res.StatusCode, http.StatusCreated)
+		}
+		locations = append(locations, res.Header.Get("Location"))
+	}
+
+	patchHeaders := map[string]string{"X-Api-Key": "studio-key", "Upload-Offset": "0", "Content-Type": uploadChunkMimeType}
+	if res := sendUploadRequest(t, http.MethodPatch, server.URL+locations[0], patchHeaders, "8 bytes!"); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("first upload's chunk got %v, want %v", res.StatusCode, http.StatusNoContent)
+	}
+	if res := sendUploadRequest(t, http.MethodPatch, server.URL+locations[1], patchHeaders, "8 bytes!"); res.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("chunk over the tenant's quota got %v, want %v", res.StatusCode, http.StatusInsufficientStorage)
+	}
+}
+
+func TestUploadServer_Expiry(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.PermittedFileExtensions = "mp4"
+	config.Config.Server.AllowedContentTypes = []string{"application/json"}
+	config.Config.Uploads.ExpirySeconds = 60
+
+	server, store, fileStore := newUploadTestServer(t)
+	create := func(length int) string {
+		res := sendUploadRequest(t, http.MethodPost, server.URL+uploadsPath, map[string]string{
+			"Upload-Length":   strconv.Itoa(length),
+			"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("video.mp4")),
+		}, "")
+		expires, err := http.ParseTime(res.Header.Get("Upload-Expires"))
+		if err != nil || expires.Before(time.Now().Add(59*time.Second)) || expires.After(time.Now().Add(61*time.Second)) {
+			t.Errorf("Upload-Expires = %q, want a minute from now", res.Header.Get("Upload-Expires"))
+		}
+		return strings.TrimPrefix(res.Header.Get("Location"), uploadsPath+"/")
+	}
+	chunkHeaders := map[string]string{"Upload-Offset": "0", "Content-Type": uploadChunkMimeType}
+
+	inProgress := create(10)
+	sendUploadRequest(t, http.MethodPatch, server.URL+uploadsPath+"/"+inProgress, chunkHeaders, "a vid")
+	completed := create(7)
+	sendUploadRequest(t, http.MethodPatch, server.URL+uploadsPath+"/"+completed, chunkHeaders, "a video")
+	attached := create(7)
+	sendUploadRequest(t, http.MethodPatch, server.URL+uploadsPath+"/"+attached, chunkHeaders, "a video")
+	res := sendUploadRequest(t, http.MethodPost, server.URL+"/api/rq/http?url=https://www.imagination.com&upload=video:"+attached,
+		map[string]string{"Content-Type": "application/json"}, `{"title":"a video"}`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("enqueue with upload got %v", res.StatusCode)
+	}
+
+	uploadServer := &UploadServer{Records: &RecordServer{Store: store, FileStore: fileStore}}
+	if err := uploadServer.Sweep(context.Background(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if remaining, _ := fileStore.List(uploadName(inProgress)); len(remaining) == 0 {
+		t.Errorf("upload removed before it expired")
+	}
+
+	if err := uploadServer.Sweep(context.Background(), time.Now().Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{inProgress, completed} {
+		if remaining, _ := fileStore.List(uploadName(id)); len(remaining) != 0 {
+			t.Errorf("FileStore holds %+v for the expired upload, want nothing", remaining)
+		}
+	}
+	if remaining, _ := fileStore.List(uploadName(attached)); len(remaining) != 1 {
+		t.Errorf("FileStore holds %+v for the attached upload, want its file kept", remaining)
+	}
+
+	// An upload is no longer found once it has expired, even before it is swept
+	expired := RqUpload{Id: GenerateRequestId(), Length: 10, Filename: "video.mp4", Created: time.Now().Add(-2 * time.Minute)}
+	out, _ := json.Marshal(expired)
+	fileStore.Save(uploadInfoName(expired.Id), strings.NewReader(string(out)))
+	if res := sendUploadRequest(t, http.MethodHead, server.URL+uploadsPath+"/"+expired.Id, nil, ""); res.StatusCode != http.StatusNotFound {
+		t.Errorf("HEAD of expired upload got %v, want %v", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestRecordServer_AttachUploadOnce(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.PermittedFileExtensions = "mp4"
+	config.Config.Server.AllowedContentTypes = []string{"application/json"}
+
+	store := &MockMemoryRecordStore{db: make(map[string]records.RqRecord)}
+	fileStore, _ := files.NewInMemoryFileStore()
+	recordServer := &RecordServer{Store: store, FileStore: fileStore}
+	uploadServer := &UploadServer{Records: recordServer}
+	mux := http.NewServeMux()
+	mux.Handle("/api/rq/http", RqHttpMiddleware(recordServer))
+	mux.Handle(uploadsPath, uploadServer)
+	mux.Handle(uploadsPath+"/", uploadServer)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	res := sendUploadRequest(t, http.MethodPost, server.URL+uploadsPath, map[string]string{
+		"Upload-Length":   "7",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("video.mp4")),
+	}, "")
+	location := res.Header.Get("Location")
+	id := strings.TrimPrefix(location, uploadsPath+"/")
+	sendUploadRequest(t, http.MethodPatch, server.URL+location, map[string]string{"Upload-Offset": "0", "Content-Type": uploadChunkMimeType}, "a video")
+
+	attach := func() int {
+		res := sendUploadRequest(t, http.MethodPost, server.URL+"/api/rq/http?url=https://www.imagination.com&upload=video:"+id,
+			map[string]string{"Content-Type": "application/json"}, `{"title":"a video"}`)
+		return res.StatusCode
+	}
+
+	// Another request is part way through attaching the upload, so it can't be attached or swept
+	if err := recordServer.claimUpload(id); err != nil {
+		t.Fatal(err)
+	}
+	if status := attach(); status != http.StatusConflict {
+		t.Errorf("enqueue with claimed upload got %v, want %v", status, http.StatusConflict)
+	}
+	uploadServer.Sweep(context.Background(), time.Now().Add(48*time.Hour))
+	if _, err := fileStore.Stat(uploadDoneName(id)); err != nil {
+		t.Errorf("claimed upload swept: %v", err)
+	}
+
+	// The other request failed to save its record, so the upload can be attached again
+	recordServer.unclaimUploads([]string{id})
+	if status := attach(); status != http.StatusOK {
+		t.Errorf("enqueue with released upload got %v, want %v", status, http.StatusOK)
+	}
+	if status := attach(); status != http.StatusNotFound {
+		t.Errorf("enqueue with attached upload got %v, want %v", status, http.StatusNotFound)
+	}
+	if len(store.db) != 1 {
+		t.Errorf("store holds %v records, want 1", len(store.db))
+	}
+}
+
+func TestRecordServer_UploadKeyCollision(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.PermittedFileExtensions = "mp4"
+	config.Config.Server.AllowedContentTypes = []string{"multipart/form-data"}
+
+	server, store, fileStore := newUploadTestServer(t)
+	res := sendUploadRequest(t, http.MethodPost, server.URL+uploadsPath, map[string]string{
+		"Upload-Length":   "7",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("video.mp4")),
+	}, "")
+	location := res.Header.Get("Location")
+	id := strings.TrimPrefix(location, uploadsPath+"/")
+	sendUploadRequest(t, http.MethodPatch, server.URL+location, map[string]string{"Upload-Offset": "0", "Content-Type": uploadChunkMimeType}, "a video")
+
+	// The request sends a file for the key the upload is attached to
+	req := newStreamedMultipartRequest(t, []multipartField{{key: "video", filename: "other.mp4", contents: []byte("another video")}})
+	req.URL.RawQuery += "&upload=video:" + id
+	response := httptest.NewRecorder()
+	RqHttpMiddleware(&RecordServer{Store: store, FileStore: fileStore}).ServeHTTP(response, req)
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("enqueue with file and upload for one key got %v, want %v", response.Code, http.StatusBadRequest)
+	}
+
+	// Only the upload remains, and it can still be attached
+	if stored, _ := fileStore.List(""); len(stored) != 3 {
+		t.Errorf("FileStore holds %+v, want only the upload", stored)
+	}
+	if _, err := loadCompletedUpload(fileStore, id, ""); err != nil {
+		t.Errorf("upload no longer attachable: %v", err)
+	}
+}
+
+// failOnceFileStore fails the first save of a file named by prefix, as a full disk or dropped connection to S3 would
+type failOnceFileStore struct {
+	files.FileStore
+	prefix string
+	failed bool
+}
+
+func (fs *failOnceFileStore) Save(filename string, contents io.Reader) (string, error) {
+	if !fs.failed && fs.prefix != "" && strings.HasPrefix(filename, fs.prefix) {
+		fs.failed = true
+		return "", errors.New("no space left on device")
+	}
+	return fs.FileStore.Save(filename, contents)
+}
+
+func TestUploadServer_CompleteFailure(t *testing.T) {
+	defer func(cfg config.RqConfig) { config.Config = cfg }(config.Config)
+	config.Config.PermittedFileExtensions = "mp4"
+	config.Config.Server.AllowedContentTypes = []string{"application/json"}
+	config.Config.PermittedMimeTypes = []string{"video/mp4"}
+	video := string([]byte{0x00, 0x00, 0x00, 0x18, 'f', 't', 'y', 'p', 'm', 'p', '4', '2', 0x00, 0x00, 0x00, 0x00})
+
+	tests := []struct {
+		name           string
+		contents       string
+		wantStatus     int
+		wantRetry      int
+		wantAttachable bool
+	}{
+		{name: "saving fails, completed when retried", contents: video, wantStatus: http.StatusInternalServerError, wantRetry: http.StatusNoContent, wantAttachable: true},
+		{name: "validation fails, upload removed", contents: "not a video", wantStatus: http.StatusUnsupportedMediaType, wantRetry: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			memoryStore, _ := files.NewInMemoryFileStore()
+			fileStore := &failOnceFileStore{FileStore: memoryStore}
+			store := &MockMemoryRecordStore{db: make(map[string]records.RqRecord)}
+			recordServer := &RecordServer{Store: store, FileStore: fileStore}
+			uploadServer := &UploadServer{Records: recordServer}
+			mux := http.NewServeMux()
+			mux.Handle("/api/rq/http", RqHttpMiddleware(recordServer))
+			mux.Handle(uploadsPath, uploadServer)
+			mux.Handle(uploadsPath+"/", uploadServer)
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			res := sendUploadRequest(t, http.MethodPost, server.URL+uploadsPath, map[string]string{
+				"Upload-Length":   strconv.Itoa(len(test.contents)),
+				"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("video.mp4")),
+			}, "")
+			location := res.Header.Get("Location")
+			id := strings.TrimPrefix(location, uploadsPath+"/")
+			// Only the assembled file fails to save, not the upload's details or chunks
+			fileStore.prefix = uploadName(id) + "-"
+
+			chunkHeaders := map[string]string{"Upload-Offset": "0", "Content-Type": uploadChunkMimeType}
+			res = sendUploadRequest(t, http.MethodPatch, server.URL+location, chunkHeaders, test.contents)
+			if res.StatusCode != test.wantStatus {
+				t.Fatalf("final chunk got %v, want %v", res.StatusCode, test.wantStatus)
+			}
+
+			offsetHeaders := map[string]string{"Upload-Offset": strconv.Itoa(len(test.contents)), "Content-Type": uploadChunkMimeType}
+			res = sendUploadRequest(t, http.MethodPatch, server.URL+location, offsetHeaders, "")
+			if res.StatusCode != test.wantRetry {
+				t.Fatalf("repeated final chunk got %v, want %v", res.StatusCode, test.wantRetry)
+			}
+
+			res, err := http.Post(server.URL+"/api/rq/http?url=https://www.imagination.com&upload=video:"+id, "application/json", strings.NewReader(`{"title":"a video"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if (res.StatusCode == http.StatusOK) != test.wantAttachable {
+				t.Errorf("enqueue with upload got %v, want attachable = %v", res.StatusCode, test.wantAttachable)
+			}
+			if !test.wantAttachable {
+				if remaining, _ := memoryStore.List(uploadName(id)); len(remaining) != 0 {
+					t.Errorf("FileStore holds %+v for the removed upload, want nothing", remaining)
+				}
+			}
+
+			uploadServer.locks.Range(func(key, _ any) bool {
+				t.Errorf("lock for upload %v kept after it finished", key)
+				return true
+			})
+		})
+	}
+}